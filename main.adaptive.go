@@ -0,0 +1,145 @@
+package main
+
+import (
+	"fmt"
+	"sync"
+	"time"
+)
+
+// Adaptive concurrency tuning
+const (
+	adaptiveInterval       = 10 * time.Second //How often the active worker limit is reviewed
+	adaptiveMinCalls       = 5                //Calls needed in an interval before the limit is changed
+	adaptiveErrorRate      = 0.1              //Proportion of failed calls in an interval that means the instance is under stress
+	adaptiveLatencyFactor  = 2.0              //Average latency, as a multiple of the baseline, that means the instance is under stress
+	adaptiveBaselineWeight = 0.2              //Weight given to each healthy interval when moving the baseline latency
+)
+
+// adaptiveConcurrencyStruct - limits how many of the import workers are active at once, scaling the limit down
+// when XMLMC calls slow down or fail, and back up when the instance recovers. Worker N is active while N <= limit
+type adaptiveConcurrencyStruct struct {
+	mutex           sync.Mutex
+	cond            *sync.Cond
+	minWorkers      int
+	maxWorkers      int
+	limit           int
+	windowCalls     int
+	windowErrors    int
+	windowLatency   time.Duration
+	baselineLatency time.Duration
+	stop            chan struct{}
+}
+
+var adaptiveWorkers = newAdaptiveConcurrency()
+
+// newAdaptiveConcurrency - returns a limiter that lets a single worker be active until it is started
+func newAdaptiveConcurrency() *adaptiveConcurrencyStruct {
+	adaptive := &adaptiveConcurrencyStruct{minWorkers: 1, maxWorkers: 1, limit: 1}
+	adaptive.cond = sync.NewCond(&adaptive.mutex)
+	return adaptive
+}
+
+// start - sets the bounds of the active worker limit, and starts reviewing it. The limit starts at the maximum
+func (adaptive *adaptiveConcurrencyStruct) start(minWorkers, maxWorkers int) {
+	adaptive.mutex.Lock()
+	adaptive.minWorkers = minWorkers
+	adaptive.maxWorkers = maxWorkers
+	adaptive.limit = maxWorkers
+	adaptive.resetWindow()
+	adaptive.stop = make(chan struct{})
+	adaptive.cond.Broadcast()
+	adaptive.mutex.Unlock()
+	if minWorkers == maxWorkers {
+		return
+	}
+	logger(1, "Adaptive concurrency enabled - between "+fmt.Sprint(minWorkers)+" and "+fmt.Sprint(maxWorkers)+" active workers", false)
+	go func(stop chan struct{}) {
+		ticker := time.NewTicker(adaptiveInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				adaptive.adjust()
+			case <-stop:
+				return
+			}
+		}
+	}(adaptive.stop)
+}
+
+// finish - stops reviewing the active worker limit, and releases any waiting workers so they can exit
+func (adaptive *adaptiveConcurrencyStruct) finish() {
+	adaptive.mutex.Lock()
+	defer adaptive.mutex.Unlock()
+	if adaptive.stop != nil {
+		close(adaptive.stop)
+		adaptive.stop = nil
+	}
+	adaptive.limit = adaptive.maxWorkers
+	adaptive.cond.Broadcast()
+}
+
+// waitForSlot - blocks while the worker is above the active worker limit
+func (adaptive *adaptiveConcurrencyStruct) waitForSlot(workerID int) {
+	adaptive.mutex.Lock()
+	for workerID > adaptive.limit {
+		adaptive.cond.Wait()
+	}
+	adaptive.mutex.Unlock()
+}
+
+// recordCall - records the response time and outcome of an XMLMC call
+func (adaptive *adaptiveConcurrencyStruct) recordCall(latency time.Duration, err error) {
+	adaptive.mutex.Lock()
+	adaptive.windowCalls++
+	adaptive.windowLatency += latency
+	if err != nil {
+		adaptive.windowErrors++
+	}
+	adaptive.mutex.Unlock()
+}
+
+// resetWindow - clears the calls recorded for the current interval. Caller must hold the mutex
+func (adaptive *adaptiveConcurrencyStruct) resetWindow() {
+	adaptive.windowCalls = 0
+	adaptive.windowErrors = 0
+	adaptive.windowLatency = 0
+}
+
+// adjust - halves the active worker limit if the instance was under stress during the last interval,
+// otherwise raises it by one worker
+func (adaptive *adaptiveConcurrencyStruct) adjust() {
+	adaptive.mutex.Lock()
+	defer adaptive.mutex.Unlock()
+	if adaptive.windowCalls < adaptiveMinCalls {
+		return
+	}
+	avgLatency := adaptive.windowLatency / time.Duration(adaptive.windowCalls)
+	errorRate := float64(adaptive.windowErrors) / float64(adaptive.windowCalls)
+	if adaptive.baselineLatency == 0 {
+		adaptive.baselineLatency = avgLatency
+	}
+	windowSummary := "average latency " + avgLatency.Round(time.Millisecond).String() + " (baseline " + adaptive.baselineLatency.Round(time.Millisecond).String() + "), " +
+		fmt.Sprint(adaptive.windowErrors) + " of " + fmt.Sprint(adaptive.windowCalls) + " calls failed"
+	adaptive.resetWindow()
+
+	stressed := errorRate > adaptiveErrorRate || float64(avgLatency) > float64(adaptive.baselineLatency)*adaptiveLatencyFactor
+	if stressed {
+		if adaptive.limit > adaptive.minWorkers {
+			newLimit := adaptive.limit / 2
+			if newLimit < adaptive.minWorkers {
+				newLimit = adaptive.minWorkers
+			}
+			logger(5, "Instance under stress - "+windowSummary+". Active workers reduced from "+fmt.Sprint(adaptive.limit)+" to "+fmt.Sprint(newLimit), false)
+			adaptive.limit = newLimit
+		}
+		return
+	}
+	//Only healthy intervals move the baseline, so a sustained slow down is still treated as stress
+	adaptive.baselineLatency = time.Duration(float64(adaptive.baselineLatency)*(1-adaptiveBaselineWeight) + float64(avgLatency)*adaptiveBaselineWeight)
+	if adaptive.limit < adaptive.maxWorkers {
+		logger(1, "Instance recovering - "+windowSummary+". Active workers increased from "+fmt.Sprint(adaptive.limit)+" to "+fmt.Sprint(adaptive.limit+1), false)
+		adaptive.limit++
+		adaptive.cond.Broadcast()
+	}
+}
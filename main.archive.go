@@ -0,0 +1,462 @@
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/hornbill/pb"
+)
+
+// Archive entry names
+const (
+	archiveManifestFile     = "manifest.json"
+	archiveCallsFile        = "calls.jsonl"
+	archiveDiaryFile        = "diary.jsonl"
+	archiveAssociationsFile = "associations.jsonl"
+	archiveAttachmentsFile  = "attachments.jsonl"
+	archiveFilesFolder      = "files/"
+)
+
+var (
+	archiveCalls        = make([]archiveCallStruct, 0)
+	archiveDiary        = make(map[string][]map[string]interface{})
+	archiveAssociations = make([]reqRelStruct, 0)
+	archiveAttachments  = make(map[string][]fileAssocStruct)
+	archiveIncomplete   = make(map[string]bool)
+	archiveExtractDir   string
+)
+
+// archiveManifestStruct - describes the contents of an export archive
+type archiveManifestStruct struct {
+	Version           string
+	Exported          string
+	Calls             int
+	DiaryEntries      int
+	Associations      int
+	Attachments       int
+	Files             int
+	IncompleteDiaries []string //The calls whose call diary could not be read in full, so is not all held in the archive
+}
+
+// archiveCallStruct - one line of calls.jsonl, a row returned by the SQLStatement of a request type
+type archiveCallStruct struct {
+	CallClass             string
+	SupportworksCallClass string
+	Row                   map[string]interface{}
+}
+
+// archiveDiaryStruct - one line of diary.jsonl, a row returned by the CallDiaryQuery for a call
+type archiveDiaryStruct struct {
+	CallRef string
+	Row     map[string]interface{}
+}
+
+// archiveAttachmentStruct - one line of attachments.jsonl, a system_cfastore record for a call
+type archiveAttachmentStruct struct {
+	CallRef string
+	File    fileAssocStruct
+}
+
+// getAttachmentFilePath - returns the path of an attachment file, relative to the AttachmentRoot
+func getAttachmentFilePath(fileRecord fileAssocStruct) string {
+	return getSubFolderName(fileRecord.CallRef) + "/" + padCallRef(fileRecord.CallRef, "f", 8) + "." + padCallRef(fileRecord.DataID, "", 3)
+}
+
+// processExport - runs the Supportworks queries for every request type being imported, and writes the results and
+// attachment files to an archive that can be imported with -import-archive, without a database connection
+func processExport(archivePath string) {
+	if configDelta {
+		logger(4, "The -delta switch cannot be used with -export. Use it with -import-archive instead.", true)
+		return
+	}
+	archiveFile, err := os.Create(archivePath)
+	if err != nil {
+		logger(4, "Unable to create export archive "+archivePath+": "+err.Error(), true)
+		return
+	}
+	defer archiveFile.Close()
+	zipWriter := zip.NewWriter(archiveFile)
+	manifest := archiveManifestStruct{Version: version, Exported: time.Now().UTC().Format(time.RFC3339)}
+
+	//Calls for each request type
+	callIDs := make([]string, 0)
+	callsWriter, err := zipWriter.Create(archiveCallsFile)
+	if err != nil {
+		logger(4, "Unable to add "+archiveCallsFile+" to export archive: "+err.Error(), true)
+		return
+	}
+	callsEncoder := json.NewEncoder(callsWriter)
+	for _, val := range swImportConf.RequestTypesToImport {
+		if !val.Import {
+			continue
+		}
+		classCalls := 0
+		var encodeErr error
+		callsFound := queryDBCallDetails(val, connStrAppDB, func(callRecord map[string]interface{}) bool {
+			encodeErr = callsEncoder.Encode(archiveCallStruct{CallClass: val.CallClass, SupportworksCallClass: val.SupportworksCallClass, Row: archiveRow(callRecord)})
+			if encodeErr != nil {
+				return false
+			}
+			callIDs = append(callIDs, getCallID(callRecord))
+			classCalls++
+			return true
+		})
+		if !callsFound {
+			logger(4, "Call Search Failed for Call Class: "+val.CallClass+"["+val.SupportworksCallClass+"], export abandoned", true)
+			return
+		}
+		if encodeErr != nil {
+			logger(4, "Unable to write call to export archive: "+encodeErr.Error(), true)
+			return
+		}
+		logger(1, strconv.Itoa(classCalls)+" "+val.CallClass+" ["+val.SupportworksCallClass+"] calls exported", true)
+	}
+	manifest.Calls = len(callIDs)
+
+	//Call diary for each call
+	diaryWriter, err := zipWriter.Create(archiveDiaryFile)
+	if err != nil {
+		logger(4, "Unable to add "+archiveDiaryFile+" to export archive: "+err.Error(), true)
+		return
+	}
+	diaryEncoder := json.NewEncoder(diaryWriter)
+	logger(1, "Exporting call diaries for "+strconv.Itoa(len(callIDs))+" calls", true)
+	bar := pb.StartNew(len(callIDs))
+	for _, callID := range callIDs {
+		var buffer bytes.Buffer
+		diaryEntries, errCount, diaryOK := queryCallDiary(callID, &buffer)
+		if !diaryOK || errCount > 0 {
+			buffer.WriteString(loggerGen(4, "Unable to read the full call diary for call "+callID+", it has been listed as incomplete in the archive manifest"))
+			manifest.IncompleteDiaries = append(manifest.IncompleteDiaries, callID)
+		}
+		if buffer.Len() > 0 {
+			bufferMutex.Lock()
+			loggerWriteBuffer(buffer.String())
+			bufferMutex.Unlock()
+		}
+		for _, diaryEntry := range diaryEntries {
+			err = diaryEncoder.Encode(archiveDiaryStruct{CallRef: callID, Row: archiveRow(diaryEntry)})
+			if err != nil {
+				logger(4, "Unable to write call diary to export archive: "+err.Error(), true)
+				return
+			}
+			manifest.DiaryEntries++
+		}
+		incrementBar(bar)
+	}
+	bar.FinishPrint("Call Diary Export Complete")
+
+	//Call associations
+	associationsWriter, err := zipWriter.Create(archiveAssociationsFile)
+	if err != nil {
+		logger(4, "Unable to add "+archiveAssociationsFile+" to export archive: "+err.Error(), true)
+		return
+	}
+	associationsEncoder := json.NewEncoder(associationsWriter)
+	requestAssociations, assocOK := queryRequestAssociations()
+	if !assocOK {
+		logger(4, "Unable to read call associations, export abandoned", true)
+		return
+	}
+	for _, requestRels := range requestAssociations {
+		err = associationsEncoder.Encode(requestRels)
+		if err != nil {
+			logger(4, "Unable to write call association to export archive: "+err.Error(), true)
+			return
+		}
+	}
+	manifest.Associations = len(requestAssociations)
+
+	//File attachment records for each call
+	attachmentsWriter, err := zipWriter.Create(archiveAttachmentsFile)
+	if err != nil {
+		logger(4, "Unable to add "+archiveAttachmentsFile+" to export archive: "+err.Error(), true)
+		return
+	}
+	attachmentsEncoder := json.NewEncoder(attachmentsWriter)
+	attachmentFiles := make([]string, 0)
+	logger(1, "Exporting file attachment records for "+strconv.Itoa(len(callIDs))+" calls", true)
+	bar = pb.StartNew(len(callIDs))
+	for _, callID := range callIDs {
+		for _, fileRecord := range queryFileAttachments(callID) {
+			err = attachmentsEncoder.Encode(archiveAttachmentStruct{CallRef: callID, File: fileRecord})
+			if err != nil {
+				logger(4, "Unable to write file attachment record to export archive: "+err.Error(), true)
+				return
+			}
+			attachmentFiles = append(attachmentFiles, getAttachmentFilePath(fileRecord))
+			manifest.Attachments++
+		}
+		incrementBar(bar)
+	}
+	bar.FinishPrint("File Attachment Record Export Complete")
+
+	//Raw attachment files from the cfa_store
+	logger(1, "Exporting "+strconv.Itoa(len(attachmentFiles))+" attachment files", true)
+	bar = pb.StartNew(len(attachmentFiles))
+	for _, attachmentFile := range attachmentFiles {
+		if addArchiveFile(zipWriter, attachmentFile) {
+			manifest.Files++
+		}
+		incrementBar(bar)
+	}
+	bar.FinishPrint("Attachment File Export Complete")
+
+	manifestWriter, err := zipWriter.Create(archiveManifestFile)
+	if err != nil {
+		logger(4, "Unable to add "+archiveManifestFile+" to export archive: "+err.Error(), true)
+		return
+	}
+	err = json.NewEncoder(manifestWriter).Encode(manifest)
+	if err != nil {
+		logger(4, "Unable to write export archive manifest: "+err.Error(), true)
+		return
+	}
+	err = zipWriter.Close()
+	if err != nil {
+		logger(4, "Unable to complete export archive "+archivePath+": "+err.Error(), true)
+		return
+	}
+	logger(1, "Export archive written to "+archivePath, true)
+	logger(1, "Calls Exported: "+strconv.Itoa(manifest.Calls), true)
+	logger(1, "Call Diary Entries Exported: "+strconv.Itoa(manifest.DiaryEntries), true)
+	if len(manifest.IncompleteDiaries) > 0 {
+		logger(5, "Calls With Incomplete Call Diaries: "+strconv.Itoa(len(manifest.IncompleteDiaries))+" - see the log for details", true)
+	}
+	logger(1, "Call Associations Exported: "+strconv.Itoa(manifest.Associations), true)
+	logger(1, "File Attachment Records Exported: "+strconv.Itoa(manifest.Attachments), true)
+	logger(1, "Attachment Files Exported: "+strconv.Itoa(manifest.Files), true)
+}
+
+// addArchiveFile - copies an attachment file from the AttachmentRoot in to the export archive
+func addArchiveFile(zipWriter *zip.Writer, attachmentFile string) bool {
+	fullFilePath := swImportConf.AttachmentRoot + "/" + attachmentFile
+	file, err := os.Open(fullFilePath)
+	if err != nil {
+		logger(4, "Unable to open attachment file "+fullFilePath+": "+err.Error(), false)
+		return false
+	}
+	defer file.Close()
+	fileWriter, err := zipWriter.Create(archiveFilesFolder + attachmentFile)
+	if err != nil {
+		logger(4, "Unable to add attachment file "+fullFilePath+" to export archive: "+err.Error(), false)
+		return false
+	}
+	_, err = io.Copy(fileWriter, file)
+	if err != nil {
+		logger(4, "Unable to copy attachment file "+fullFilePath+" in to export archive: "+err.Error(), false)
+		return false
+	}
+	return true
+}
+
+// archiveRow - converts the values of a database row so they survive the round trip through JSON
+func archiveRow(row map[string]interface{}) map[string]interface{} {
+	for column, value := range row {
+		if byteValue, ok := value.([]byte); ok {
+			row[column] = string(byteValue)
+		}
+	}
+	return row
+}
+
+// restoreRow - converts the numbers in a row read from the archive back to the types returned by the database drivers
+func restoreRow(row map[string]interface{}) map[string]interface{} {
+	for column, value := range row {
+		numberValue, ok := value.(json.Number)
+		if !ok {
+			continue
+		}
+		if intValue, err := numberValue.Int64(); err == nil {
+			row[column] = intValue
+		} else if floatValue, err := numberValue.Float64(); err == nil {
+			row[column] = floatValue
+		} else {
+			row[column] = numberValue.String()
+		}
+	}
+	return row
+}
+
+// openImportArchive - loads the calls, call diary, associations and attachment records from an export archive,
+// and extracts the attachment files so they can be read from the AttachmentRoot
+func openImportArchive(archivePath string) bool {
+	zipReader, err := zip.OpenReader(archivePath)
+	if err != nil {
+		logger(4, "Unable to open import archive "+archivePath+": "+err.Error(), true)
+		return false
+	}
+	defer zipReader.Close()
+
+	archiveExtractDir, err = os.MkdirTemp("", "swimport")
+	if err != nil {
+		logger(4, "Unable to create folder to extract attachment files to: "+err.Error(), true)
+		return false
+	}
+	swImportConf.AttachmentRoot = filepath.ToSlash(filepath.Join(archiveExtractDir, "files"))
+
+	for _, zipFile := range zipReader.File {
+		switch {
+		case zipFile.Name == archiveManifestFile:
+			var manifest archiveManifestStruct
+			err = readArchiveEntries(zipFile, func(decoder *json.Decoder) error {
+				return decoder.Decode(&manifest)
+			})
+			if err == nil {
+				logger(1, "Import archive exported on "+manifest.Exported+" by version "+manifest.Version+": "+strconv.Itoa(manifest.Calls)+" calls, "+strconv.Itoa(manifest.DiaryEntries)+" call diary entries, "+strconv.Itoa(manifest.Associations)+" associations, "+strconv.Itoa(manifest.Files)+" attachment files", true)
+				if len(manifest.IncompleteDiaries) > 0 {
+					logger(5, "The call diaries of "+strconv.Itoa(len(manifest.IncompleteDiaries))+" calls could not be read in full when the archive was exported, so their Historic Updates will be incomplete: "+strings.Join(manifest.IncompleteDiaries, ", "), true)
+				}
+				for _, callID := range manifest.IncompleteDiaries {
+					archiveIncomplete[callID] = true
+				}
+			}
+		case zipFile.Name == archiveCallsFile:
+			err = readArchiveEntries(zipFile, func(decoder *json.Decoder) error {
+				var archiveCall archiveCallStruct
+				if err := decoder.Decode(&archiveCall); err != nil {
+					return err
+				}
+				archiveCall.Row = restoreRow(archiveCall.Row)
+				archiveCalls = append(archiveCalls, archiveCall)
+				return nil
+			})
+		case zipFile.Name == archiveDiaryFile:
+			err = readArchiveEntries(zipFile, func(decoder *json.Decoder) error {
+				var archiveDiaryEntry archiveDiaryStruct
+				if err := decoder.Decode(&archiveDiaryEntry); err != nil {
+					return err
+				}
+				archiveDiary[archiveDiaryEntry.CallRef] = append(archiveDiary[archiveDiaryEntry.CallRef], restoreRow(archiveDiaryEntry.Row))
+				return nil
+			})
+		case zipFile.Name == archiveAssociationsFile:
+			err = readArchiveEntries(zipFile, func(decoder *json.Decoder) error {
+				var requestRels reqRelStruct
+				if err := decoder.Decode(&requestRels); err != nil {
+					return err
+				}
+				archiveAssociations = append(archiveAssociations, requestRels)
+				return nil
+			})
+		case zipFile.Name == archiveAttachmentsFile:
+			err = readArchiveEntries(zipFile, func(decoder *json.Decoder) error {
+				var archiveAttachment archiveAttachmentStruct
+				if err := decoder.Decode(&archiveAttachment); err != nil {
+					return err
+				}
+				archiveAttachments[archiveAttachment.CallRef] = append(archiveAttachments[archiveAttachment.CallRef], archiveAttachment.File)
+				return nil
+			})
+		case strings.HasPrefix(zipFile.Name, archiveFilesFolder):
+			err = extractArchiveFile(zipFile)
+		}
+		if err != nil {
+			logger(4, "Unable to read "+zipFile.Name+" from import archive "+archivePath+": "+err.Error(), true)
+			return false
+		}
+	}
+	logger(1, "Import archive "+archivePath+" loaded", true)
+	return true
+}
+
+// closeImportArchive - removes the attachment files extracted from the import archive
+func closeImportArchive() {
+	if archiveExtractDir != "" {
+		os.RemoveAll(archiveExtractDir)
+	}
+}
+
+// readArchiveEntries - decodes each JSON value held in an archive entry in turn
+func readArchiveEntries(zipFile *zip.File, decodeEntry func(decoder *json.Decoder) error) error {
+	entryReader, err := zipFile.Open()
+	if err != nil {
+		return err
+	}
+	defer entryReader.Close()
+	decoder := json.NewDecoder(entryReader)
+	decoder.UseNumber()
+	for decoder.More() {
+		if err := decodeEntry(decoder); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// extractArchiveFile - writes an attachment file from the archive in to the extract folder
+func extractArchiveFile(zipFile *zip.File) error {
+	targetPath := filepath.Join(archiveExtractDir, filepath.FromSlash(zipFile.Name))
+	if !strings.HasPrefix(targetPath, filepath.Clean(archiveExtractDir)+string(os.PathSeparator)) {
+		return errors.New("invalid file path in archive")
+	}
+	if zipFile.FileInfo().IsDir() {
+		return os.MkdirAll(targetPath, 0777)
+	}
+	err := os.MkdirAll(filepath.Dir(targetPath), 0777)
+	if err != nil {
+		return err
+	}
+	entryReader, err := zipFile.Open()
+	if err != nil {
+		return err
+	}
+	defer entryReader.Close()
+	targetFile, err := os.Create(targetPath)
+	if err != nil {
+		return err
+	}
+	defer targetFile.Close()
+	_, err = io.Copy(targetFile, entryReader)
+	return err
+}
+
+// loadArchiveCallDetails - passes each call of the request type in the import archive to processCall in turn,
+// until processCall returns false
+func loadArchiveCallDetails(callConf swCallConfStruct, processCall func(map[string]interface{}) bool) bool {
+	callCount := 0
+	for _, archiveCall := range archiveCalls {
+		if archiveCall.CallClass != callConf.CallClass || archiveCall.SupportworksCallClass != callConf.SupportworksCallClass {
+			continue
+		}
+		callCount++
+		if !processCall(archiveCall.Row) {
+			break
+		}
+	}
+	logger(3, "[ARCHIVE] "+strconv.Itoa(callCount)+" "+callConf.CallClass+"s, "+callConf.SupportworksCallClass+" loaded from the import archive", false)
+	return true
+}
+
+// countArchiveCallDetails - returns the number of calls of the request type held in the import archive
+func countArchiveCallDetails(callConf swCallConfStruct) int {
+	callCount := 0
+	for _, archiveCall := range archiveCalls {
+		if archiveCall.CallClass == callConf.CallClass && archiveCall.SupportworksCallClass == callConf.SupportworksCallClass {
+			callCount++
+		}
+	}
+	return callCount
+}
+
+// archiveCallDiary - returns the call diary entries of a call from the import archive, along with 1 if its call diary
+// could not be read in full when the archive was exported, or 0 if it could
+func archiveCallDiary(swCallRef string) ([]map[string]interface{}, int) {
+	if archiveIncomplete[swCallRef] {
+		return archiveDiary[swCallRef], 1
+	}
+	return archiveDiary[swCallRef], 0
+}
+
+// archiveFileAttachments - returns the file attachment records of a call from the import archive
+func archiveFileAttachments(swCallRef string) []fileAssocStruct {
+	return append([]fileAssocStruct(nil), archiveAttachments[swCallRef]...)
+}
@@ -29,16 +29,45 @@ func processAttachments() {
 		return
 
 	}
+	defer releaseInstanceSession(espXmlmc)
 	logger(1, "Processing file attachments for "+fmt.Sprint(len(arrCallsLogged))+" imported requests.", true)
 	bar := pb.StartNew(len(arrCallsLogged))
 	for swRef, smRef := range arrCallsLogged {
-		processFileAttachments(swRef, smRef, espXmlmc)
-		bar.Increment()
+		waitWhilePaused()
+		if shutdownRequested() {
+			bar.Finish()
+			logger(5, "File Attachment Import stopped by a shutdown signal", true)
+			return
+		}
+		if configResume || configDelta {
+			if stepStatus, _ := ledgerStepStatus(swRef, stepAttachments); stepStatus == stepStatusOK {
+				incrementBar(bar)
+				continue
+			}
+		}
+		attachmentsOK := processFileAttachments(swRef, smRef, espXmlmc)
+		if !configDryRun {
+			recordLedgerStep(swRef, stepAttachments, attachmentsOK)
+		}
+		incrementBar(bar)
 	}
 	bar.FinishPrint("File Attachment Import Complete")
 }
 
-func processFileAttachments(swCallRef, smCallRef string, espXmlmc *apiLib.XmlmcInstStruct) {
+//processFileAttachments - imports the attachments of a single request, returns false if any attachment failed.
+//The outcome of each file is recorded in the ledger, and files already attached by an earlier run are not attached again
+func processFileAttachments(swCallRef, smCallRef string, espXmlmc *apiLib.XmlmcInstStruct) bool {
+	attachmentsOK := true
+	attachFile := func(attachmentKey, entityName string, fileRecord fileAssocStruct) bool {
+		if ledgerAttachmentAdded(swCallRef, attachmentKey) {
+			return true
+		}
+		fileAdded := addFileContent(entityName, fileRecord, espXmlmc)
+		if !configDryRun {
+			recordLedgerAttachment(swCallRef, attachmentKey, fileAdded)
+		}
+		return fileAdded
+	}
 
 	requestAttachments := fileAttachmentData(swCallRef, smCallRef)
 	if len(requestAttachments) > 0 {
@@ -74,7 +103,9 @@ func processFileAttachments(swCallRef, smCallRef string, espXmlmc *apiLib.XmlmcI
 					fileRecord.FileData = base64.StdEncoding.EncodeToString([]byte(swmDecoded.Content))
 				}
 				fileRecord.Description = "Originally added by " + fileRecord.AddedBy
-				addFileContent(entityRequest, fileRecord, espXmlmc)
+				if !attachFile(fileRecord.DataID, entityRequest, fileRecord) {
+					attachmentsOK = false
+				}
 				for j := 0; j < len(swmDecoded.Attachments); j++ {
 					fileRecord.Description = "File extracted from " + fileRecord.FileName
 					fileRecord.EmailAttachment = swmDecoded.Attachments[j]
@@ -82,18 +113,28 @@ func processFileAttachments(swCallRef, smCallRef string, espXmlmc *apiLib.XmlmcI
 					fileRecord.FileData = swmDecoded.Attachments[j].FileData
 					fileRecord.SizeU, _ = strconv.ParseFloat(swmDecoded.Attachments[j].FileSize, 64)
 					fileRecord.SizeC, _ = strconv.ParseFloat(swmDecoded.Attachments[j].FileSize, 64)
-					addFileContent(entityRequest, fileRecord, espXmlmc)
+					//Files extracted from an email are recorded by their position within it
+					if !attachFile(fileRecord.DataID+"/"+strconv.Itoa(j+1), entityRequest, fileRecord) {
+						attachmentsOK = false
+					}
 				}
+			} else {
+				attachmentsOK = false
 			}
 		} else {
 			var err error
 			fileRecord.FileData, err = getFileEncoded(fileRecord)
 			if err == nil {
 				fileRecord.Description = "Originally added by " + fileRecord.AddedBy
-				addFileContent(entityRequest, fileRecord, espXmlmc)
+				if !attachFile(fileRecord.DataID, entityRequest, fileRecord) {
+					attachmentsOK = false
+				}
+			} else {
+				attachmentsOK = false
 			}
 		}
 	}
+	return attachmentsOK
 }
 
 //getFileEncoded - get encoded file data
@@ -128,8 +169,16 @@ func getFileEncoded(fileRecord fileAssocStruct) (string, error) {
 	return fileEncoded, nil
 }
 
-//Get file attachment records from Supportworks
+//Get file attachment records from the import archive or Supportworks
 func fileAttachmentData(swRequest, smRequest string) []fileAssocStruct {
+	if configImportArchive != "" {
+		return archiveFileAttachments(swRequest)
+	}
+	return queryFileAttachments(swRequest)
+}
+
+//queryFileAttachments - get file attachment records for a call from the Supportworks system database
+func queryFileAttachments(swRequest string) []fileAssocStruct {
 	intSwCallRef := getCallRefInt(swRequest)
 	var returnArray = make([]fileAssocStruct, 0)
 	//Connect to the JSON specified DB
@@ -161,6 +210,8 @@ func fileAttachmentData(swRequest, smRequest string) []fileAssocStruct {
 		if err != nil {
 			logger(4, " Data Mapping Error: "+err.Error(), false)
 		}
+		requestAttachment.FileName = sanitiseSourceText(requestAttachment.FileName, swImportConf.SWSystemDBConf.Encoding, "filename")
+		requestAttachment.AddedBy = sanitiseSourceText(requestAttachment.AddedBy, swImportConf.SWSystemDBConf.Encoding, "addedby")
 		//Add to array for reponse
 		returnArray = append(returnArray, requestAttachment)
 	}
@@ -544,7 +595,7 @@ func addFileContent(entityName string, fileRecord fileAssocStruct, espXmlmc *api
 			logger(1, "entityAddRecord::RequestHistoricUpdateAttachments:"+XMLSTRING, false)
 		}
 
-		XMLHistAtt, xmlmcErr := espXmlmc.Invoke("data", "entityAddRecord")
+		XMLHistAtt, xmlmcErr := invokeXmlmc(espXmlmc, "data", "entityAddRecord")
 		if xmlmcErr != nil {
 			logger(1, "RequestHistoricUpdateAttachments entityAddRecord Failed "+fmt.Sprintf("%s", xmlmcErr), false)
 			if configDebug {
@@ -588,7 +639,7 @@ func addFileContent(entityName string, fileRecord fileAssocStruct, espXmlmc *api
 	if configDebug {
 		logger(1, "entityAttachFile:"+XMLSTRINGDATA, false)
 	}
-	XMLAttach, xmlmcErr := espXmlmc.Invoke("data", "entityAttachFile")
+	XMLAttach, xmlmcErr := invokeXmlmc(espXmlmc, "data", "entityAttachFile")
 	if xmlmcErr != nil {
 		logger(4, "Could not add Attachment File Data for ["+useFileName+"] ["+fileRecord.SmCallRef+"]: "+xmlmcErr.Error(), false)
 		if configDebug {
@@ -620,7 +671,7 @@ func addFileContent(entityName string, fileRecord fileAssocStruct, espXmlmc *api
 				espXmlmc.SetParam("h_request_id", fileRecord.SmCallRef)
 				espXmlmc.SetParam("h_description", fileRecord.Description)
 				espXmlmc.SetParam("h_filename", useFileName)
-				espXmlmc.SetParam("h_timestamp", epochToDateTime(fileRecord.TimeAdded))
+				espXmlmc.SetParam("h_timestamp", convertDateValue(fileRecord.TimeAdded, getFieldFormat("h_timestamp")))
 				espXmlmc.SetParam("h_visibility", "trustedGuest")
 				espXmlmc.CloseElement("record")
 				espXmlmc.CloseElement("primaryEntityData")
@@ -629,7 +680,7 @@ func addFileContent(entityName string, fileRecord fileAssocStruct, espXmlmc *api
 					logger(1, "entityAddRecord::RequestAttachments:"+XMLSTRINGDATA, false)
 				}
 
-				XMLContentLoc, xmlmcErrContent := espXmlmc.Invoke("data", "entityAddRecord")
+				XMLContentLoc, xmlmcErrContent := invokeXmlmc(espXmlmc, "data", "entityAddRecord")
 				if xmlmcErrContent != nil {
 					logger(4, "Could not update request ["+fileRecord.SmCallRef+"] with attachment ["+useFileName+"]: "+xmlmcErrContent.Error(), false)
 					if configDebug {
@@ -0,0 +1,135 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+)
+
+// circuitBreakerStruct - watches the outcome of each request created or updated, and stops the import when
+// too many fail, so a bad mapping doesn't fail every call in the import
+type circuitBreakerStruct struct {
+	mutex          sync.Mutex
+	outcomes       []bool //Sliding window of the latest outcomes, true where the call failed
+	outcomePos     int
+	outcomeCount   int
+	windowFailures int
+	consecutive    int
+	errorCounts    map[string]int
+	tripped        bool
+	reason         string
+}
+
+// errorCountStruct - the number of times an error message was returned
+type errorCountStruct struct {
+	Message string
+	Count   int
+}
+
+var circuitBreaker = &circuitBreakerStruct{errorCounts: make(map[string]int)}
+
+// startCircuitBreaker - sets the size of the sliding window of outcomes
+func startCircuitBreaker(windowSize int) {
+	circuitBreaker.mutex.Lock()
+	defer circuitBreaker.mutex.Unlock()
+	if windowSize > 0 {
+		circuitBreaker.outcomes = make([]bool, windowSize)
+	}
+}
+
+// recordSuccess - records a request that was created or updated
+func (breaker *circuitBreakerStruct) recordSuccess() {
+	breaker.mutex.Lock()
+	defer breaker.mutex.Unlock()
+	breaker.consecutive = 0
+	breaker.addOutcome(false)
+}
+
+// recordFailure - records a request that could not be created or updated, and stops the import if a limit has been passed
+func (breaker *circuitBreakerStruct) recordFailure(errorMessage string) {
+	breaker.mutex.Lock()
+	defer breaker.mutex.Unlock()
+	breaker.errorCounts[errorMessage]++
+	breaker.consecutive++
+	breaker.addOutcome(true)
+	if breaker.tripped {
+		return
+	}
+	if configBreakerStreak > 0 && breaker.consecutive >= configBreakerStreak {
+		breaker.trip(fmt.Sprintf("%d consecutive requests failed", breaker.consecutive))
+		return
+	}
+	windowSize := len(breaker.outcomes)
+	if configBreakerRatio > 0 && windowSize > 0 && breaker.outcomeCount == windowSize &&
+		float64(breaker.windowFailures)/float64(windowSize) >= configBreakerRatio {
+		breaker.trip(fmt.Sprintf("%d of the last %d requests failed", breaker.windowFailures, windowSize))
+	}
+}
+
+// addOutcome - adds an outcome to the sliding window, dropping the oldest once the window is full. Caller must hold the mutex
+func (breaker *circuitBreakerStruct) addOutcome(failed bool) {
+	windowSize := len(breaker.outcomes)
+	if windowSize == 0 {
+		return
+	}
+	if breaker.outcomeCount == windowSize {
+		if breaker.outcomes[breaker.outcomePos] {
+			breaker.windowFailures--
+		}
+	} else {
+		breaker.outcomeCount++
+	}
+	breaker.outcomes[breaker.outcomePos] = failed
+	if failed {
+		breaker.windowFailures++
+	}
+	breaker.outcomePos = (breaker.outcomePos + 1) % windowSize
+}
+
+// trip - stops the import. Caller must hold the mutex
+func (breaker *circuitBreakerStruct) trip(reason string) {
+	breaker.tripped = true
+	breaker.reason = reason
+	logger(4, "Circuit breaker tripped - "+reason+". No more calls will be imported", false)
+}
+
+// isTripped - returns true once the import has been stopped
+func (breaker *circuitBreakerStruct) isTripped() bool {
+	breaker.mutex.Lock()
+	defer breaker.mutex.Unlock()
+	return breaker.tripped
+}
+
+// topErrors - returns the most frequent error messages, most frequent first
+func (breaker *circuitBreakerStruct) topErrors(maxErrors int) []errorCountStruct {
+	breaker.mutex.Lock()
+	defer breaker.mutex.Unlock()
+	errorCounts := make([]errorCountStruct, 0, len(breaker.errorCounts))
+	for errorMessage, errorCount := range breaker.errorCounts {
+		errorCounts = append(errorCounts, errorCountStruct{Message: errorMessage, Count: errorCount})
+	}
+	sort.Slice(errorCounts, func(i, j int) bool {
+		if errorCounts[i].Count != errorCounts[j].Count {
+			return errorCounts[i].Count > errorCounts[j].Count
+		}
+		return errorCounts[i].Message < errorCounts[j].Message
+	})
+	if len(errorCounts) > maxErrors {
+		errorCounts = errorCounts[:maxErrors]
+	}
+	return errorCounts
+}
+
+// processCircuitBreakerStop - checkpoints the ledger after the import was stopped, and explains how to continue
+func processCircuitBreakerStop() {
+	checkpointLedger()
+	logger(4, "Import stopped by the circuit breaker: "+circuitBreaker.reason, true)
+	if counters.notProcessed > 0 {
+		logger(4, fmt.Sprintf("%d", counters.notProcessed)+" calls already read from the source were not started once the circuit breaker tripped", true)
+	}
+	if configDelta {
+		logger(4, "The delta watermark has not been moved on. Fix the cause of the errors below, then run the delta import again.", true)
+	} else {
+		logger(4, "Every request created so far is recorded in the ledger "+getLedgerPath()+". Fix the cause of the errors below, then run again with -resume to continue.", true)
+	}
+}
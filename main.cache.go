@@ -112,9 +112,10 @@ func loadOrgs() error {
 	if err != nil {
 		return err
 	}
+	defer releaseInstanceSession(espXmlmc)
 	espXmlmc.SetParam("application", appServiceManager)
 	espXmlmc.SetParam("queryName", "getOrganizationContainers")
-	XMLOrgSearch, xmlmcErr := espXmlmc.Invoke("data", "queryExec")
+	XMLOrgSearch, xmlmcErr := invokeXmlmc(espXmlmc, "data", "queryExec")
 	if xmlmcErr != nil {
 		return xmlmcErr
 	}
@@ -10,17 +10,17 @@ import (
 )
 
 //getCallCategoryID takes the Call Record and returns a correct Category ID if one exists on the Instance
-func getCallCategoryID(callMap map[string]interface{}, categoryGroup string, espXmlmc *apiLib.XmlmcInstStruct, buffer *bytes.Buffer) (string, string) {
+func getCallCategoryID(callMap map[string]interface{}, callConf swCallConfStruct, categoryGroup string, espXmlmc *apiLib.XmlmcInstStruct, buffer *bytes.Buffer) (string, string) {
 	categoryID := ""
 	categoryString := ""
 	categoryNameMapping := ""
 	categoryCode := ""
 	if categoryGroup == "Request" {
-		categoryNameMapping = fmt.Sprintf("%v", mapGenericConf.CoreFieldMapping["h_category_id"])
+		categoryNameMapping = fmt.Sprintf("%v", callConf.CoreFieldMapping["h_category_id"])
 		categoryCode = getFieldValue(categoryNameMapping, callMap)
-		if swImportConf.CategoryMapping[categoryCode] != nil {
+		if mappedCode := getMappedValue("CategoryMapping", callConf.CallClass, categoryCode); mappedCode != nil {
 			//Get Category Code from JSON mapping
-			categoryCode = fmt.Sprintf("%s", swImportConf.CategoryMapping[categoryCode])
+			categoryCode = fmt.Sprintf("%s", mappedCode)
 		} else {
 			//Mapping doesn't exist - replace hyphens from SW Profile code with another string, and try to use this
 			//SMProfileCodeSeperator allows us to specify in the config, the seperator used within Service Manager
@@ -29,11 +29,11 @@ func getCallCategoryID(callMap map[string]interface{}, categoryGroup string, esp
 		}
 
 	} else {
-		categoryNameMapping = fmt.Sprintf("%v", mapGenericConf.CoreFieldMapping["h_closure_category_id"])
+		categoryNameMapping = fmt.Sprintf("%v", callConf.CoreFieldMapping["h_closure_category_id"])
 		categoryCode = getFieldValue(categoryNameMapping, callMap)
-		if swImportConf.ResolutionCategoryMapping[categoryCode] != nil {
+		if mappedCode := getMappedValue("ResolutionCategoryMapping", callConf.CallClass, categoryCode); mappedCode != nil {
 			//Get Category Code from JSON mapping
-			categoryCode = fmt.Sprintf("%s", swImportConf.ResolutionCategoryMapping[categoryCode])
+			categoryCode = fmt.Sprintf("%s", mappedCode)
 		} else {
 			//Mapping doesn't exist - replace hyphens from SW Profile code with colon, and try to use this
 			categoryCode = strings.Replace(categoryCode, "-", swImportConf.SMProfileCodeSeperator, -1)
@@ -76,7 +76,7 @@ func searchCategory(categoryCode, categoryGroup string, espXmlmc *apiLib.XmlmcIn
 	//-- ESP Query for category
 	espXmlmc.SetParam("codeGroup", categoryGroup)
 	espXmlmc.SetParam("code", categoryCode)
-	XMLCategorySearch, xmlmcErr := espXmlmc.Invoke("data", "profileCodeLookup")
+	XMLCategorySearch, xmlmcErr := invokeXmlmc(espXmlmc, "data", "profileCodeLookup")
 	if xmlmcErr != nil {
 		buffer.WriteString(loggerGen(4, "XMLMC API Invoke Failed for "+categoryGroup+" Category ["+categoryCode+"]: "+xmlmcErr.Error()))
 		return boolReturn, idReturn, strReturn
@@ -0,0 +1,282 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"reflect"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+	//The time zone database is embedded, so SourceTimeZone works where the system has none, such as on Windows
+	_ "time/tzdata"
+)
+
+// hornbillDateFormat - the layout of the date and time values accepted by the Hornbill APIs
+const hornbillDateFormat = "2006-01-02 15:04:05"
+
+// minEpochSeconds, maxEpochSeconds - the EPOCH seconds of the first and last dates that can be written as a Hornbill date
+const (
+	minEpochSeconds = -62135596800
+	maxEpochSeconds = 253402300799
+)
+
+// dateFormatTokens - the tokens of a DateFormat or SourceFormat in FieldFormats, and the Go layout each stands for
+var dateFormatTokens = strings.NewReplacer("YYYY", "2006", "MM", "01", "DD", "02", "HH", "15", "mm", "04", "ss", "05")
+
+// sourceDateLayouts - the layouts tried for a date field with no SourceFormat, when the value is not an EPOCH number
+var sourceDateLayouts = []string{hornbillDateFormat, "2006-01-02T15:04:05", "2006-01-02 15:04", "2006-01-02"}
+
+// dateFieldNames - the Hornbill fields that are converted as dates unless FieldFormats sets another Type
+var dateFieldNames = map[string]bool{
+	"h_datelogged":   true,
+	"h_dateclosed":   true,
+	"h_dateresolved": true,
+	"h_start_time":   true,
+	"h_end_time":     true,
+	"h_updatedate":   true,
+	"h_timestamp":    true,
+}
+
+// unsupportedValueTypes - the column value types that have already been reported as unsupported
+var unsupportedValueTypes sync.Map
+
+// sourceLocations - the time zones loaded for SourceTimeZone, by name
+var sourceLocations sync.Map
+
+// getFieldFormat - returns the FieldFormats of a Hornbill field, with the defaults for its Type and SourceTimeZone applied
+func getFieldFormat(fieldName string) fieldFormatStruct {
+	fieldFormat := swImportConf.FieldFormats[fieldName]
+	if fieldFormat.Type == "" && dateFieldNames[fieldName] {
+		fieldFormat.Type = "date"
+	}
+	if fieldFormat.SourceTimeZone == "" {
+		fieldFormat.SourceTimeZone = swImportConf.SourceTimeZone
+	}
+	return fieldFormat
+}
+
+// formatColumnValue - converts a column value returned by any of the database drivers, or read from an export
+// archive, to a string, using the number, date and true/false options of the field it is being mapped to
+func formatColumnValue(value interface{}, fieldFormat fieldFormatStruct) string {
+	switch typedValue := value.(type) {
+	case nil:
+		return ""
+	case string:
+		return formatNumericText(typedValue, fieldFormat)
+	case []byte:
+		//Text, and the decimal types of mssql and mysql, are returned as bytes
+		return formatNumericText(string(typedValue), fieldFormat)
+	case int64:
+		return formatInteger(typedValue, fieldFormat)
+	case int32:
+		return formatInteger(int64(typedValue), fieldFormat)
+	case int:
+		return formatInteger(int64(typedValue), fieldFormat)
+	case int16:
+		return formatInteger(int64(typedValue), fieldFormat)
+	case int8:
+		return formatInteger(int64(typedValue), fieldFormat)
+	case uint64:
+		if fieldFormat.NumberFormat == "" {
+			return strconv.FormatUint(typedValue, 10)
+		}
+		return formatFloat(float64(typedValue), fieldFormat)
+	case uint32:
+		return formatInteger(int64(typedValue), fieldFormat)
+	case uint16:
+		return formatInteger(int64(typedValue), fieldFormat)
+	case uint8:
+		return formatInteger(int64(typedValue), fieldFormat)
+	case float64:
+		return formatFloat(typedValue, fieldFormat)
+	case float32:
+		return formatFloat(float64(typedValue), fieldFormat)
+	case bool:
+		if typedValue {
+			return getFormatOption(fieldFormat.TrueValue, "1")
+		}
+		return getFormatOption(fieldFormat.FalseValue, "0")
+	case time.Time:
+		if fieldFormat.SourceTimeZone != "" {
+			//The drivers return the date and time as stored, in a time zone that depends on the driver
+			typedValue = inSourceTimeZone(typedValue, fieldFormat.SourceTimeZone)
+		}
+		return formatDate(typedValue, fieldFormat)
+	case fmt.Stringer:
+		return typedValue.String()
+	}
+	valueType := reflect.TypeOf(value).String()
+	if _, reported := unsupportedValueTypes.LoadOrStore(valueType, true); !reported {
+		logger(5, "Column values of type "+valueType+" cannot be converted to text reliably, and may be imported incorrectly", false)
+	}
+	return fmt.Sprintf("%v", value)
+}
+
+// getFormatOption - returns a format option, or its default if it is not set
+func getFormatOption(option, defaultOption string) string {
+	if option == "" {
+		return defaultOption
+	}
+	return option
+}
+
+// getNumberDecimals - returns the number of decimal places of a NumberFormat such as 0 or 0.00, or -1 if the format is
+// not set or not valid
+func getNumberDecimals(numberFormat string) int {
+	if numberFormat == "" || !reNumberFormat.MatchString(numberFormat) {
+		return -1
+	}
+	if dotPos := strings.Index(numberFormat, "."); dotPos != -1 {
+		return len(numberFormat) - dotPos - 1
+	}
+	return 0
+}
+
+// formatInteger - converts a whole number, with decimal places if the NumberFormat has them
+func formatInteger(value int64, fieldFormat fieldFormatStruct) string {
+	if getNumberDecimals(fieldFormat.NumberFormat) > 0 {
+		return formatFloat(float64(value), fieldFormat)
+	}
+	return strconv.FormatInt(value, 10)
+}
+
+// formatFloat - converts a number to the decimal places of the NumberFormat, or to the fewest digits that represent
+// it exactly, without an exponent
+func formatFloat(value float64, fieldFormat fieldFormatStruct) string {
+	if math.IsNaN(value) || math.IsInf(value, 0) {
+		return ""
+	}
+	return strconv.FormatFloat(value, 'f', getNumberDecimals(fieldFormat.NumberFormat), 64)
+}
+
+// formatNumericText - applies the NumberFormat to text holding a number, such as a decimal column. Other text is
+// returned as it is
+func formatNumericText(value string, fieldFormat fieldFormatStruct) string {
+	if getNumberDecimals(fieldFormat.NumberFormat) == -1 {
+		return value
+	}
+	numberValue, err := strconv.ParseFloat(strings.TrimSpace(value), 64)
+	if err != nil {
+		return value
+	}
+	return formatFloat(numberValue, fieldFormat)
+}
+
+// formatDate - converts a date and time to the DateFormat of the field, in UTC. By default the format accepted by
+// the Hornbill APIs is used
+func formatDate(value time.Time, fieldFormat fieldFormatStruct) string {
+	if fieldFormat.DateFormat == "rfc3339" {
+		return value.Format(time.RFC3339)
+	}
+	value = value.UTC()
+	switch fieldFormat.DateFormat {
+	case "":
+		return value.Format(hornbillDateFormat)
+	case "epoch":
+		return strconv.FormatInt(value.Unix(), 10)
+	case "epochms":
+		return strconv.FormatInt(value.UnixNano()/int64(time.Millisecond), 10)
+	}
+	return value.Format(dateFormatTokens.Replace(fieldFormat.DateFormat))
+}
+
+// convertDateValue - reads the value of a date field using its SourceFormat and SourceTimeZone, and returns it in its
+// DateFormat. Empty and 0 values, and values that cannot be read as a date, are returned empty
+func convertDateValue(sourceValue string, fieldFormat fieldFormatStruct) string {
+	sourceValue = strings.TrimSpace(sourceValue)
+	if sourceValue == "" || sourceValue == "0" {
+		return ""
+	}
+	dateValue, err := parseSourceDate(sourceValue, fieldFormat)
+	if err != nil {
+		logger(5, "Unable to read \""+sourceValue+"\" as a date: "+err.Error(), false)
+		return ""
+	}
+	return formatDate(dateValue, fieldFormat)
+}
+
+// parseSourceDate - reads a date from an EPOCH number of seconds or milliseconds, or from a layout of the SourceFormat
+// in the SourceTimeZone. With no SourceFormat, numbers are read as EPOCH seconds, and text in the common layouts.
+// Values of date and time columns are also accepted whatever the SourceFormat
+func parseSourceDate(sourceValue string, fieldFormat fieldFormatStruct) (time.Time, error) {
+	var dateValue time.Time
+	var err error
+	switch fieldFormat.SourceFormat {
+	case "epoch":
+		dateValue, err = parseEpoch(sourceValue, time.Second)
+	case "epochms":
+		dateValue, err = parseEpoch(sourceValue, time.Millisecond)
+	case "":
+		dateValue, err = parseEpoch(sourceValue, time.Second)
+		for _, layout := range sourceDateLayouts {
+			if err == nil {
+				break
+			}
+			dateValue, err = time.ParseInLocation(layout, sourceValue, getSourceLocation(fieldFormat.SourceTimeZone))
+		}
+	default:
+		dateValue, err = time.ParseInLocation(dateFormatTokens.Replace(fieldFormat.SourceFormat), sourceValue, getSourceLocation(fieldFormat.SourceTimeZone))
+	}
+	if err == nil {
+		return dateValue, nil
+	}
+	//Date and time columns are passed to date fields in RFC 3339 format, as are those read from an export archive
+	columnDate, columnErr := time.Parse(time.RFC3339, sourceValue)
+	if columnErr != nil {
+		return dateValue, err
+	}
+	if fieldFormat.SourceTimeZone != "" {
+		columnDate = inSourceTimeZone(columnDate, fieldFormat.SourceTimeZone)
+	}
+	return columnDate, nil
+}
+
+// parseEpoch - reads a whole or decimal number of seconds or milliseconds since 1970
+// Values outside the years 0001 to 9999 are returned as an error, as they cannot be written as a Hornbill date
+func parseEpoch(sourceValue string, unit time.Duration) (time.Time, error) {
+	unitsPerSecond := int64(time.Second / unit)
+	if epochValue, err := strconv.ParseInt(sourceValue, 10, 64); err == nil {
+		if epochValue/unitsPerSecond < minEpochSeconds || epochValue/unitsPerSecond > maxEpochSeconds {
+			return time.Time{}, fmt.Errorf("%q is outside the range of EPOCH dates", sourceValue)
+		}
+		if unit == time.Millisecond {
+			return time.UnixMilli(epochValue), nil
+		}
+		return time.Unix(epochValue, 0), nil
+	}
+	epochValue, err := strconv.ParseFloat(sourceValue, 64)
+	if err != nil || math.IsNaN(epochValue) || math.IsInf(epochValue, 0) {
+		return time.Time{}, fmt.Errorf("%q is not an EPOCH number", sourceValue)
+	}
+	//The range is checked before the conversion to a whole number, which is undefined for values out of range
+	if epochValue/float64(unitsPerSecond) < minEpochSeconds || epochValue/float64(unitsPerSecond) > maxEpochSeconds {
+		return time.Time{}, fmt.Errorf("%q is outside the range of EPOCH dates", sourceValue)
+	}
+	wholeUnits, fractionUnits := math.Modf(epochValue)
+	nanoseconds := (int64(wholeUnits)%unitsPerSecond)*int64(unit) + int64(math.Round(fractionUnits*float64(unit)))
+	return time.Unix(int64(wholeUnits)/unitsPerSecond, nanoseconds), nil
+}
+
+// inSourceTimeZone - returns the date and time as written, in the SourceTimeZone
+func inSourceTimeZone(value time.Time, zoneName string) time.Time {
+	return time.Date(value.Year(), value.Month(), value.Day(), value.Hour(), value.Minute(), value.Second(), value.Nanosecond(), getSourceLocation(zoneName))
+}
+
+// getSourceLocation - returns the time zone of a SourceTimeZone, loading it on first use. UTC is returned when no time
+// zone is set, or the time zone is not known
+func getSourceLocation(zoneName string) *time.Location {
+	if zoneName == "" {
+		return time.UTC
+	}
+	if location, ok := sourceLocations.Load(zoneName); ok {
+		return location.(*time.Location)
+	}
+	location, err := time.LoadLocation(zoneName)
+	if err != nil {
+		logger(5, "Unknown SourceTimeZone "+zoneName+", UTC will be used: "+err.Error(), false)
+		location = time.UTC
+	}
+	sourceLocations.Store(zoneName, location)
+	return location
+}
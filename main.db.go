@@ -1,7 +1,6 @@
 package main
 
 import (
-	"fmt"
 	"regexp"
 	"strconv"
 	"strings"
@@ -85,8 +84,97 @@ func buildConnectionString(strDataSource string) string {
 	return connectString
 }
 
-//queryDBCallDetails -- Query call data & set map of calls to add to Hornbill
-func queryDBCallDetails(callClass, swCallClass, connString string) bool {
+//connectDatabases -- Check the SQL drivers in the configuration, and open the Supportworks application & system database connections
+func connectDatabases() bool {
+	//Set SQL driver ID string for Application Data
+	if swImportConf.SWAppDBConf.Driver == "" {
+		logger(4, "SWAppDBConf SQL Driver not set in configuration.", true)
+		return false
+	}
+	if swImportConf.SWAppDBConf.Driver == "swsql" {
+		appDBDriver = "mysql320"
+	} else if swImportConf.SWAppDBConf.Driver == "mysql" || swImportConf.SWAppDBConf.Driver == "mssql" || swImportConf.SWAppDBConf.Driver == "mysql320" || swImportConf.SWAppDBConf.Driver == "odbc" || swImportConf.SWAppDBConf.Driver == "ODBC" {
+		appDBDriver = swImportConf.SWAppDBConf.Driver
+	} else {
+		logger(4, "The SQL driver ("+swImportConf.SWAppDBConf.Driver+") for the Supportworks Application Database specified in the configuration file is not valid.", true)
+		return false
+	}
+	//Set SQL driver ID string for Cache Data
+	if swImportConf.SWSystemDBConf.Driver == "" {
+		logger(4, "SWSystemDBConf SQL Driver not set in configuration.", true)
+		return false
+	}
+	if swImportConf.SWSystemDBConf.Driver == "swsql" {
+		cacheDBDriver = "mysql320"
+	} else if swImportConf.SWSystemDBConf.Driver == "mysql" || swImportConf.SWSystemDBConf.Driver == "mysql320" {
+		cacheDBDriver = swImportConf.SWSystemDBConf.Driver
+	} else {
+		logger(4, "The SQL driver ("+swImportConf.SWSystemDBConf.Driver+") for the Supportworks System Database specified in the configuration file is not valid.", true)
+		return false
+	}
+
+	//-- Build DB connection strings for sw_systemdb and swdata
+	connStrSysDB = buildConnectionString("cache")
+	connStrAppDB = buildConnectionString("app")
+
+	var db2err error
+	//fmt.Println(connStrAppDB)
+	dbapp, db2err = sqlx.Open(appDBDriver, connStrAppDB)
+	if db2err != nil {
+		logger(4, "Could not open app DB connection"+db2err.Error(), true)
+		return false
+	}
+
+	if swImportConf.SWSystemDBConf.Driver == "mysql" && swImportConf.SWSystemDBConf.Driver == swImportConf.SWAppDBConf.Driver {
+		dbsys = dbapp
+	} else {
+		var dberr error
+		dbsys, dberr = sqlx.Open(cacheDBDriver, connStrSysDB)
+		if dberr != nil {
+			logger(4, "Could not open cache DB connection"+dberr.Error(), true)
+			return false
+		}
+	}
+	return true
+}
+
+//closeDatabases -- Close the Supportworks application & system database connections
+func closeDatabases() {
+	if dbsys != nil && dbsys != dbapp {
+		dbsys.Close()
+	}
+	if dbapp != nil {
+		dbapp.Close()
+	}
+}
+
+//loadCallDetails -- Reads the calls to add to Hornbill from the import archive or the Supportworks database,
+//passing each to processCall in turn. Reading stops early if processCall returns false
+func loadCallDetails(callConf swCallConfStruct, processCall func(map[string]interface{}) bool) bool {
+	if configImportArchive != "" {
+		return loadArchiveCallDetails(callConf, processCall)
+	}
+	return queryDBCallDetails(callConf, connStrAppDB, processCall)
+}
+
+//countCallDetails -- Returns the number of calls that will be read for the progress bar, or 0 if this is not known
+func countCallDetails(callConf swCallConfStruct) int {
+	if configImportArchive != "" {
+		return countArchiveCallDetails(callConf)
+	}
+	return countDBCallDetails(callConf, connStrAppDB)
+}
+
+//getCallID -- Returns the Supportworks call reference of a call record as a string
+func getCallID(callMap map[string]interface{}) string {
+	return formatColumnValue(callMap["callref"], fieldFormatStruct{})
+}
+
+//queryDBCallDetails -- Query call data, passing each call to processCall as it is read from the database,
+//until processCall returns false. Returns false if the calls could not all be read
+func queryDBCallDetails(callConf swCallConfStruct, connString string, processCall func(map[string]interface{}) bool) bool {
+	callClass := callConf.CallClass
+	swCallClass := callConf.SupportworksCallClass
 	if callClass == "" || connString == "" {
 		return false
 	}
@@ -108,7 +196,7 @@ func queryDBCallDetails(callClass, swCallClass, connString string) bool {
 	logger(3, "[DATABASE] Retrieving "+callClass+"s, "+swCallClass+" from Supportworks.", true)
 	logger(3, "[DATABASE] Please Wait...", true)
 	//build query
-	sqlCallQuery = mapGenericConf.SQLStatement
+	sqlCallQuery := applyWatermark(callConf.SQLStatement)
 	logger(3, "[DATABASE] Query to retrieve "+callClass+" calls from Supportworks: "+sqlCallQuery, false)
 
 	//Run Query
@@ -118,32 +206,88 @@ func queryDBCallDetails(callClass, swCallClass, connString string) bool {
 		return false
 	}
 	defer rows.Close()
-	//Clear down existing Call Details map
-	arrCallDetailsMaps = nil
-	//Build map full of calls to import
-	intCallCount := 0
+	rowErrors := 0
 	for rows.Next() {
-		intCallCount++
-
-		mutexCounters.Lock()
-		counters.callsReturned++
-		mutexCounters.Unlock()
-
 		results := make(map[string]interface{})
 		err = rows.MapScan(results)
 		if err != nil {
 			//something is wrong with this row just log then skip it
 			logger(4, " Database Result error"+err.Error(), true)
+			rowErrors++
 			continue
 		}
-		//Stick marshalled data map in to parent slice
-		arrCallDetailsMaps = append(arrCallDetailsMaps, results)
+		sanitiseRow(results, swImportConf.SWAppDBConf.Encoding)
+		if !processCall(results) {
+			break
+		}
+	}
+	if err = rows.Err(); err != nil {
+		//The result set was cut short, so the calls after this point have not been read
+		logger(4, " Database Result error, "+callClass+" calls were not all read: "+err.Error(), true)
+		return false
+	}
+	if rowErrors > 0 {
+		logger(4, strconv.Itoa(rowErrors)+" "+callClass+" calls could not be read and were skipped", true)
+		return false
 	}
 	return true
 }
 
+//countDBCallDetails -- Runs the SQLCountStatement of the request type, or a count of the rows returned by the
+//SQLStatement if one is not set. Returns 0 if the count cannot be run
+func countDBCallDetails(callConf swCallConfStruct, connString string) int {
+	callClass := callConf.CallClass
+	countQuery := applyWatermark(callConf.SQLCountStatement)
+	if countQuery == "" {
+		//The Supportworks SQL server does not support sub-queries, so the calls can only be counted by SQLCountStatement
+		if appDBDriver == "mysql320" {
+			logger(5, "SQLCountStatement is not set for "+callClass+" calls, progress will be shown without a total", true)
+			return 0
+		}
+		countQuery = "SELECT COUNT(*) FROM (" + applyWatermark(callConf.SQLStatement) + ") callcount"
+	}
+	db2, err := sqlx.Open(appDBDriver, connString)
+	if err != nil {
+		logger(4, "[DATABASE] Database Connection Error: "+err.Error(), true)
+		return 0
+	}
+	defer db2.Close()
+	logger(3, "[DATABASE] Query to count "+callClass+" calls from Supportworks: "+countQuery, false)
+	var callCount int
+	err = db2.QueryRow(countQuery).Scan(&callCount)
+	if err != nil {
+		logger(5, "Unable to count "+callClass+" calls, progress will be shown without a total. Set SQLCountStatement for the request type to avoid this: "+err.Error(), true)
+		return 0
+	}
+	return callCount
+}
+
 // getFieldValue --Retrieve field value from mapping via SQL record map
 func getFieldValue(v string, u map[string]interface{}) string {
+	return formatFieldValue(v, u, fieldFormatStruct{})
+}
+
+// getMappedFieldValue -- Retrieve the value of a Hornbill field from its mapping, using the FieldFormats set for the field.
+// The values of date fields are read as dates and normalised
+func getMappedFieldValue(fieldName, v string, u map[string]interface{}) string {
+	fieldFormat := getFieldFormat(fieldName)
+	if fieldFormat.Type != "date" {
+		return formatFieldValue(v, u, fieldFormat)
+	}
+	return convertDateValue(formatFieldValue(v, u, fieldFormatStruct{DateFormat: "rfc3339", SourceTimeZone: fieldFormat.SourceTimeZone}), fieldFormat)
+}
+
+// formatFieldValue -- Retrieve field value from mapping via SQL record map, converting column values with the given format
+func formatFieldValue(v string, u map[string]interface{}, fieldFormat fieldFormatStruct) string {
+	//-- Mappings containing {{expressions}} are evaluated by the expression language
+	if strings.Contains(v, "{{") {
+		return evalFieldTemplate(v, u, fieldFormat)
+	}
+	return replaceColumnReferences(v, u, fieldFormat)
+}
+
+// replaceColumnReferences -- Replace each [column] in a mapping with its value from the SQL record map
+func replaceColumnReferences(v string, u map[string]interface{}, fieldFormat fieldFormatStruct) string {
 	fieldMap := v
 	//-- Match $variable from String
 	re1, err := regexp.Compile(`\[(.*?)\]`)
@@ -152,59 +296,31 @@ func getFieldValue(v string, u map[string]interface{}) string {
 	}
 
 	result := re1.FindAllString(fieldMap, 100)
-	valFieldMap := ""
 	//-- Loop Matches
 	for _, val := range result {
-		valFieldMap = ""
-		valFieldMap = strings.Replace(val, "[", "", 1)
+		valFieldMap := strings.Replace(val, "[", "", 1)
 		valFieldMap = strings.Replace(valFieldMap, "]", "", 1)
-		if valFieldMap == "oldCallRef" {
-			valFieldMap = "h_formattedcallref"
-			if u[valFieldMap] != nil {
-
-				if valField, ok := u[valFieldMap].(int64); ok {
-					valFieldMap = strconv.FormatInt(valField, 10)
-				} else {
-					valFieldMap = fmt.Sprintf("%+s", u[valFieldMap])
-				}
-
-				if valFieldMap != "<nil>" {
-					fieldMap = strings.Replace(fieldMap, val, valFieldMap, 1)
-				}
-
-			} else {
-				valFieldMap = "callref"
-				if u[valFieldMap] != nil {
-
-					if valField, ok := u[valFieldMap].(int64); ok {
-						valFieldMap = strconv.FormatInt(valField, 10)
-					} else {
-						valFieldMap = fmt.Sprintf("%+s", u[valFieldMap])
-					}
-
-					if valFieldMap != "<nil>" {
-						fieldMap = strings.Replace(fieldMap, val, padCallRef(valFieldMap, "F", 7), 1)
-					}
-				} else {
-					fieldMap = strings.Replace(fieldMap, val, "", 1)
-				}
-			}
-		} else {
-			if u[valFieldMap] != nil {
-
-				if valField, ok := u[valFieldMap].(int64); ok {
-					valFieldMap = strconv.FormatInt(valField, 10)
-				} else {
-					valFieldMap = fmt.Sprintf("%+s", u[valFieldMap])
-				}
+		fieldMap = strings.Replace(fieldMap, val, getColumnValue(valFieldMap, u, fieldFormat), 1)
+	}
+	return fieldMap
+}
 
-				if valFieldMap != "<nil>" {
-					fieldMap = strings.Replace(fieldMap, val, valFieldMap, 1)
-				}
-			} else {
-				fieldMap = strings.Replace(fieldMap, val, "", 1)
-			}
+// getColumnValue -- Returns the value of a column from the SQL record map, or the Supportworks call reference for
+// the special column oldCallRef. A missing column returns an empty string
+func getColumnValue(columnName string, u map[string]interface{}, fieldFormat fieldFormatStruct) string {
+	padValue := false
+	if columnName == "oldCallRef" {
+		columnName = "h_formattedcallref"
+		if u[columnName] == nil {
+			columnName = "callref"
+			padValue = true
 		}
 	}
-	return fieldMap
+	if u[columnName] == nil {
+		return ""
+	}
+	if padValue {
+		return padCallRef(formatColumnValue(u[columnName], fieldFormatStruct{}), "F", 7)
+	}
+	return formatColumnValue(u[columnName], fieldFormat)
 }
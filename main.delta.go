@@ -0,0 +1,179 @@
+package main
+
+import (
+	"bytes"
+	"encoding/xml"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+
+	apiLib "github.com/hornbill/goApiLib"
+)
+
+var (
+	deltaWatermark    int64
+	deltaNewWatermark int64
+	sourceReadFailed  bool //A request class could not be read in full, so changes may have been missed
+	mutexWatermark    = &sync.Mutex{}
+)
+
+// getWatermarkPath - returns the full path to the delta watermark file, held alongside the ledger
+func getWatermarkPath() string {
+	cwd, _ := os.Getwd()
+	return cwd + "/ledger/" + strings.TrimSuffix(configLedgerFile, filepath.Ext(configLedgerFile)) + ".watermark"
+}
+
+// loadWatermark - loads the watermark saved by the last successful delta run. No watermark means every call is returned
+func loadWatermark() bool {
+	if swImportConf.DeltaWatermarkColumn == "" {
+		logger(4, "DeltaWatermarkColumn must be set in the configuration to run in delta mode.", true)
+		return false
+	}
+	watermarkBytes, err := os.ReadFile(getWatermarkPath())
+	if os.IsNotExist(err) {
+		logger(5, "No delta watermark found at "+getWatermarkPath()+", all calls returned by the queries will be processed", true)
+		return true
+	}
+	if err != nil {
+		logger(4, "Unable to read delta watermark "+getWatermarkPath()+": "+err.Error(), true)
+		return false
+	}
+	deltaWatermark, err = strconv.ParseInt(strings.TrimSpace(string(watermarkBytes)), 10, 64)
+	if err != nil {
+		logger(4, "Delta watermark "+getWatermarkPath()+" is not a valid number: "+err.Error(), true)
+		return false
+	}
+	deltaNewWatermark = deltaWatermark
+	logger(1, "Delta watermark loaded: "+swImportConf.DeltaWatermarkColumn+" >= "+strconv.FormatInt(deltaWatermark, 10), true)
+	return true
+}
+
+// applyWatermark - replaces the [watermark] token in a call query with the watermark of the last successful delta run.
+// Outside of delta mode the watermark is 0, so every call is returned
+func applyWatermark(sqlQuery string) string {
+	return strings.ReplaceAll(sqlQuery, "[watermark]", strconv.FormatInt(deltaWatermark, 10))
+}
+
+// callChangedSinceWatermark - returns true if the call was created or changed since the last successful delta run,
+// and moves the watermark for this run on to the latest change seen
+func callChangedSinceWatermark(callMap map[string]interface{}) bool {
+	watermarkValue := getFieldValue("["+swImportConf.DeltaWatermarkColumn+"]", callMap)
+	callWatermark, err := strconv.ParseInt(watermarkValue, 10, 64)
+	if err != nil {
+		//Unable to tell when the call last changed, so process it anyway
+		logger(5, "Unable to read delta watermark column ["+swImportConf.DeltaWatermarkColumn+"] value ["+watermarkValue+"] as a number, call will be processed", false)
+		return true
+	}
+	if callWatermark < deltaWatermark {
+		return false
+	}
+	mutexWatermark.Lock()
+	if callWatermark > deltaNewWatermark {
+		deltaNewWatermark = callWatermark
+	}
+	mutexWatermark.Unlock()
+	return true
+}
+
+// setSourceReadFailed - records that the calls of a request class could not all be read, so the watermark is not saved
+func setSourceReadFailed() {
+	mutexWatermark.Lock()
+	sourceReadFailed = true
+	mutexWatermark.Unlock()
+}
+
+// saveWatermark - saves the latest change seen as the watermark for the next delta run, only if every call was read
+// and processed successfully
+func saveWatermark() {
+	if configDryRun {
+		return
+	}
+	if counters.createdSkipped > 0 || counters.updateFailed > 0 {
+		logger(5, "Not all calls were processed successfully, so the delta watermark has not been moved on from "+strconv.FormatInt(deltaWatermark, 10), true)
+		return
+	}
+	mutexWatermark.Lock()
+	readFailed := sourceReadFailed
+	mutexWatermark.Unlock()
+	if readFailed {
+		//Another class may have moved the watermark past calls that were never read
+		logger(5, "Not all calls could be read from the source, so the delta watermark has not been moved on from "+strconv.FormatInt(deltaWatermark, 10), true)
+		return
+	}
+	err := os.WriteFile(getWatermarkPath(), []byte(strconv.FormatInt(deltaNewWatermark, 10)), 0644)
+	if err != nil {
+		logger(4, "Unable to save delta watermark "+getWatermarkPath()+": "+err.Error(), true)
+		return
+	}
+	logger(1, "Delta watermark saved: "+strconv.FormatInt(deltaNewWatermark, 10), true)
+}
+
+// ledgerStepData - returns a copy of the step data held in the ledger for a call
+func ledgerStepData(swCallRef string) *requestStepDataStruct {
+	mutexLedger.Lock()
+	defer mutexLedger.Unlock()
+	stepData := requestStepDataStruct{}
+	if entry, ok := ledgerEntries[swCallRef]; ok && entry.StepData != nil {
+		stepData = *entry.StepData
+	}
+	return &stepData
+}
+
+// updateDeltaRequest - applies the mapped fields already set in the XMLMC params to an existing request,
+// then imports any call diary entries added since the request was last imported
+func updateDeltaRequest(swCallID, smCallID string, requestClass *requestClassStruct, espXmlmc *apiLib.XmlmcInstStruct, buffer *bytes.Buffer) {
+	XMLRequest := espXmlmc.GetParam()
+	if configDebug {
+		buffer.WriteString(loggerGen(1, "entityUpdateRecord::Requests:"+XMLRequest))
+	}
+	XMLUpdate, xmlmcErr := invokeXmlmc(espXmlmc, "data", "entityUpdateRecord")
+	if xmlmcErr != nil {
+		mutexCounters.Lock()
+		requestClass.Counters.updateFailed++
+		mutexCounters.Unlock()
+		circuitBreaker.recordFailure(xmlmcErr.Error())
+		buffer.WriteString(loggerGen(4, "Unable to update request ["+smCallID+"] for Supportworks call ["+swCallID+"]: "+xmlmcErr.Error()))
+		return
+	}
+	var xmlRespon xmlmcResponse
+	err := xml.Unmarshal([]byte(XMLUpdate), &xmlRespon)
+	if err != nil {
+		mutexCounters.Lock()
+		requestClass.Counters.updateFailed++
+		mutexCounters.Unlock()
+		circuitBreaker.recordFailure(err.Error())
+		buffer.WriteString(loggerGen(4, "Unable to read response when updating request ["+smCallID+"]: "+err.Error()))
+		return
+	}
+	if xmlRespon.MethodResult != "ok" {
+		mutexCounters.Lock()
+		requestClass.Counters.updateFailed++
+		mutexCounters.Unlock()
+		circuitBreaker.recordFailure(xmlRespon.State.ErrorRet)
+		buffer.WriteString(loggerGen(4, "Update Request Failed ["+smCallID+"]: "+xmlRespon.State.ErrorRet))
+		if configSplitLogs {
+			uploadLogger(xmlRespon.State.ErrorRet)
+			uploadLogger(XMLRequest)
+		}
+		return
+	}
+	circuitBreaker.recordSuccess()
+	buffer.WriteString(loggerGen(1, "Update Request Successful ["+smCallID+"]"))
+	mutexArrCallsLogged.Lock()
+	arrCallsLogged[swCallID] = smCallID
+	mutexArrCallsLogged.Unlock()
+	mutexCounters.Lock()
+	requestClass.Counters.updated++
+	mutexCounters.Unlock()
+
+	//Only the diary entries added since the last import are applied
+	request := RequestReferences{SwCallID: swCallID, SmCallID: smCallID}
+	stepResults := runRequestSteps(request, ledgerStepData(swCallID), []string{stepHistoric}, espXmlmc, buffer)
+	if stepResults[stepHistoric] == stepStatusFailed {
+		mutexCounters.Lock()
+		requestClass.Counters.updateFailed++
+		mutexCounters.Unlock()
+	}
+}
@@ -0,0 +1,298 @@
+package main
+
+import (
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+
+	apiLib "github.com/hornbill/goApiLib"
+	"github.com/hornbill/sqlx"
+)
+
+// discoverySourceStruct - a mapping whose source values are read from swdata, with the lookup used to make a
+// best guess at the Service Manager target
+type discoverySourceStruct struct {
+	Mapping string
+	Column  string
+	Query   func(callClassFilter string) string
+	Guess   func(value string, espXmlmc *apiLib.XmlmcInstStruct, buffer *bytes.Buffer) string
+}
+
+// discoveryValueStruct - a distinct source value, with the number of calls it appears in and the suggested target
+type discoveryValueStruct struct {
+	Mapping string
+	Column  string
+	Value   string
+	Count   int
+	Target  string
+	Match   string //existing - already in the configuration, exact - matched by name on the instance, none - no match
+}
+
+// discoveryOutputStruct - the JSON mapping skeleton, in the same shape as the mappings in the configuration file
+type discoveryOutputStruct struct {
+	PriorityMapping           map[string]string
+	TeamMapping               map[string]string
+	CategoryMapping           map[string]string
+	ResolutionCategoryMapping map[string]string
+	ServiceMapping            map[string]string
+	StatusMapping             map[string]string
+	RowCounts                 map[string]map[string]int
+}
+
+// discoverySources - the mappings discovered, in report order
+var discoverySources = []discoverySourceStruct{
+	{Mapping: "PriorityMapping", Column: "priority", Query: func(callClassFilter string) string {
+		return "SELECT priority, COUNT(*) FROM opencall" + callClassFilter + " GROUP BY priority"
+	}, Guess: func(value string, espXmlmc *apiLib.XmlmcInstStruct, buffer *bytes.Buffer) string {
+		if getPriorityID(value, espXmlmc, buffer) != "" {
+			return value
+		}
+		return ""
+	}},
+	{Mapping: "TeamMapping", Column: "suppgroup", Query: func(callClassFilter string) string {
+		return "SELECT suppgroup, COUNT(*) FROM opencall" + callClassFilter + " GROUP BY suppgroup"
+	}, Guess: func(value string, espXmlmc *apiLib.XmlmcInstStruct, buffer *bytes.Buffer) string {
+		if getTeamID(value, espXmlmc, buffer) != "" {
+			return value
+		}
+		return ""
+	}},
+	{Mapping: "CategoryMapping", Column: "probcode", Query: func(callClassFilter string) string {
+		return "SELECT probcode, COUNT(*) FROM opencall" + callClassFilter + " GROUP BY probcode"
+	}, Guess: func(value string, espXmlmc *apiLib.XmlmcInstStruct, buffer *bytes.Buffer) string {
+		return guessCategoryCode(value, "Request", espXmlmc, buffer)
+	}},
+	{Mapping: "ResolutionCategoryMapping", Column: "fixcode", Query: func(callClassFilter string) string {
+		return "SELECT fixcode, COUNT(*) FROM opencall" + callClassFilter + " GROUP BY fixcode"
+	}, Guess: func(value string, espXmlmc *apiLib.XmlmcInstStruct, buffer *bytes.Buffer) string {
+		return guessCategoryCode(value, "Closure", espXmlmc, buffer)
+	}},
+	{Mapping: "ServiceMapping", Column: "sc_folder.service_name", Query: func(callClassFilter string) string {
+		serviceFilter := " WHERE sc_folder.fk_cmdb_id = opencall.itsm_fk_service"
+		if callClassFilter != "" {
+			serviceFilter += " AND" + strings.TrimPrefix(callClassFilter, " WHERE")
+		}
+		return "SELECT sc_folder.service_name, COUNT(*) FROM opencall, sc_folder" + serviceFilter + " GROUP BY sc_folder.service_name"
+	}, Guess: func(value string, espXmlmc *apiLib.XmlmcInstStruct, buffer *bytes.Buffer) string {
+		if getServiceID(value, espXmlmc, buffer) != "" {
+			return value
+		}
+		return ""
+	}},
+	{Mapping: "StatusMapping", Column: "status", Query: func(callClassFilter string) string {
+		return "SELECT status, COUNT(*) FROM opencall" + callClassFilter + " GROUP BY status"
+	}, Guess: func(value string, espXmlmc *apiLib.XmlmcInstStruct, buffer *bytes.Buffer) string {
+		//Statuses aren't looked up on the instance, so the standard Supportworks status is suggested
+		return discoveryStatusGuesses[value]
+	}},
+}
+
+// discoveryStatusGuesses - the Service Manager status suggested for each standard Supportworks status
+var discoveryStatusGuesses = map[string]string{
+	"1":  "status.open",
+	"2":  "status.open",
+	"3":  "status.open",
+	"4":  "status.onHold",
+	"5":  "status.open",
+	"6":  "status.resolved",
+	"8":  "status.new",
+	"9":  "status.open",
+	"10": "status.open",
+	"11": "status.open",
+	"16": "status.closed",
+	"17": "status.cancelled",
+	"18": "status.closed",
+}
+
+// guessCategoryCode - returns the Supportworks profile code as a Service Manager profile code, if a category with
+// that code exists on the instance
+func guessCategoryCode(profileCode, categoryGroup string, espXmlmc *apiLib.XmlmcInstStruct, buffer *bytes.Buffer) string {
+	categoryCode := strings.Replace(profileCode, "-", swImportConf.SMProfileCodeSeperator, -1)
+	categoryID, _ := getCategoryID(categoryCode, categoryGroup, espXmlmc, buffer)
+	if categoryID != "" {
+		return categoryCode
+	}
+	return ""
+}
+
+// processDiscovery - reads the distinct values of each mapped Supportworks column, with their row counts, and writes
+// a mapping skeleton to the given file, as JSON or CSV depending on its extension. Existing mappings from the
+// configuration are kept, otherwise a target is suggested where a value matches by name on the instance
+func processDiscovery(discoveryFile string, requestClasses []*requestClassStruct) bool {
+	fileExt := strings.ToLower(filepath.Ext(discoveryFile))
+	if fileExt != ".json" && fileExt != ".csv" {
+		logger(4, "The -discover file must have a .json or .csv extension: "+discoveryFile, true)
+		return false
+	}
+	espXmlmc, err := NewEspXmlmcSession()
+	if err != nil {
+		logger(4, "Could not connect to Hornbill Instance: "+err.Error(), true)
+		return false
+	}
+	defer releaseInstanceSession(espXmlmc)
+	db2, err := sqlx.Open(appDBDriver, connStrAppDB)
+	if err != nil {
+		logger(4, "[DATABASE] Database Connection Error: "+err.Error(), true)
+		return false
+	}
+	defer db2.Close()
+	err = db2.Ping()
+	if err != nil {
+		logger(4, "[DATABASE] [PING] Database Connection Error: "+err.Error(), true)
+		return false
+	}
+
+	//Only the calls of the classes being imported are counted
+	callClasses := make([]string, 0)
+	for _, requestClass := range requestClasses {
+		if requestClass.Conf.SupportworksCallClass != "" {
+			callClasses = append(callClasses, "'"+strings.Replace(requestClass.Conf.SupportworksCallClass, "'", "''", -1)+"'")
+		}
+	}
+	callClassFilter := ""
+	if len(callClasses) > 0 {
+		callClassFilter = " WHERE opencall.callclass IN (" + strings.Join(callClasses, ", ") + ")"
+	}
+
+	var buffer bytes.Buffer
+	defer flushLogBuffer(&buffer)
+	discovered := make([]discoveryValueStruct, 0)
+	for _, source := range discoverySources {
+		if importStopped() {
+			return false
+		}
+		sourceValues, ok := queryDiscoveryValues(db2, source, callClassFilter)
+		if !ok {
+			continue
+		}
+		configMapping := getConfigMapping(source.Mapping)
+		exactCount := 0
+		for i := range sourceValues {
+			sourceValue := &sourceValues[i]
+			if configMapping[sourceValue.Value] != nil {
+				sourceValue.Target = fmt.Sprintf("%v", configMapping[sourceValue.Value])
+				sourceValue.Match = "existing"
+			} else if sourceValue.Target = source.Guess(sourceValue.Value, espXmlmc, &buffer); sourceValue.Target != "" {
+				sourceValue.Match = "exact"
+				exactCount++
+			} else {
+				sourceValue.Match = "none"
+			}
+		}
+		logger(1, "[DISCOVER] "+source.Mapping+" ("+source.Column+"): "+strconv.Itoa(len(sourceValues))+" distinct value(s), "+strconv.Itoa(exactCount)+" matched on the instance", true)
+		discovered = append(discovered, sourceValues...)
+	}
+
+	if fileExt == ".csv" {
+		err = writeDiscoveryCSV(discoveryFile, discovered)
+	} else {
+		err = writeDiscoveryJSON(discoveryFile, discovered)
+	}
+	if err != nil {
+		logger(4, "Unable to write mapping discovery file "+discoveryFile+": "+err.Error(), true)
+		return false
+	}
+	logger(1, "Mapping skeleton written to "+discoveryFile, true)
+	return true
+}
+
+// queryDiscoveryValues - returns the distinct values of a Supportworks column and their row counts, most frequent first.
+// Values that differ only by leading or trailing whitespace are counted together. Returns false if the values could not all be read
+func queryDiscoveryValues(db2 *sqlx.DB, source discoverySourceStruct, callClassFilter string) ([]discoveryValueStruct, bool) {
+	sqlQuery := source.Query(callClassFilter)
+	logger(3, "[DATABASE] Query to discover "+source.Mapping+" values: "+sqlQuery, false)
+	rows, err := db2.Query(sqlQuery)
+	if err != nil {
+		logger(5, "[DISCOVER] Unable to read "+source.Mapping+" values from Supportworks: "+err.Error(), true)
+		return nil, false
+	}
+	defer rows.Close()
+	sourceValues := make([]discoveryValueStruct, 0)
+	valuePositions := make(map[string]int)
+	for rows.Next() {
+		var rowValue interface{}
+		var rowCount int
+		err = rows.Scan(&rowValue, &rowCount)
+		if err != nil {
+			logger(4, "[DISCOVER] Unable to read "+source.Mapping+" values from Supportworks: "+err.Error(), true)
+			return nil, false
+		}
+		value := strings.TrimSpace(sanitiseSourceText(formatColumnValue(rowValue, fieldFormatStruct{}), swImportConf.SWAppDBConf.Encoding, source.Column))
+		if value == "" {
+			continue
+		}
+		if valuePos, ok := valuePositions[value]; ok {
+			sourceValues[valuePos].Count += rowCount
+			continue
+		}
+		valuePositions[value] = len(sourceValues)
+		sourceValues = append(sourceValues, discoveryValueStruct{Mapping: source.Mapping, Column: source.Column, Value: value, Count: rowCount})
+	}
+	if err = rows.Err(); err != nil {
+		logger(4, "[DISCOVER] Unable to read "+source.Mapping+" values from Supportworks: "+err.Error(), true)
+		return nil, false
+	}
+	sort.Slice(sourceValues, func(i, j int) bool {
+		if sourceValues[i].Count != sourceValues[j].Count {
+			return sourceValues[i].Count > sourceValues[j].Count
+		}
+		return sourceValues[i].Value < sourceValues[j].Value
+	})
+	return sourceValues, true
+}
+
+// writeDiscoveryJSON - writes the discovered values as mappings that can be copied into the configuration file.
+// Values with no suggested target are left blank to be filled in
+func writeDiscoveryJSON(discoveryFile string, discovered []discoveryValueStruct) error {
+	output := discoveryOutputStruct{
+		PriorityMapping:           make(map[string]string),
+		TeamMapping:               make(map[string]string),
+		CategoryMapping:           make(map[string]string),
+		ResolutionCategoryMapping: make(map[string]string),
+		ServiceMapping:            make(map[string]string),
+		StatusMapping:             make(map[string]string),
+		RowCounts:                 make(map[string]map[string]int),
+	}
+	mappings := map[string]map[string]string{
+		"PriorityMapping":           output.PriorityMapping,
+		"TeamMapping":               output.TeamMapping,
+		"CategoryMapping":           output.CategoryMapping,
+		"ResolutionCategoryMapping": output.ResolutionCategoryMapping,
+		"ServiceMapping":            output.ServiceMapping,
+		"StatusMapping":             output.StatusMapping,
+	}
+	for _, discoveredValue := range discovered {
+		mappings[discoveredValue.Mapping][discoveredValue.Value] = discoveredValue.Target
+		if output.RowCounts[discoveredValue.Mapping] == nil {
+			output.RowCounts[discoveredValue.Mapping] = make(map[string]int)
+		}
+		output.RowCounts[discoveredValue.Mapping][discoveredValue.Value] += discoveredValue.Count
+	}
+	jsonOutput, err := json.MarshalIndent(output, "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(discoveryFile, append(jsonOutput, '\n'), 0644)
+}
+
+// writeDiscoveryCSV - writes one row per discovered value, with its row count, suggested target and how it was matched
+func writeDiscoveryCSV(discoveryFile string, discovered []discoveryValueStruct) error {
+	csvFile, err := os.Create(discoveryFile)
+	if err != nil {
+		return err
+	}
+	defer csvFile.Close()
+	csvWriter := csv.NewWriter(csvFile)
+	csvWriter.Write([]string{"Mapping", "Column", "SourceValue", "RowCount", "Target", "Match"})
+	for _, discoveredValue := range discovered {
+		csvWriter.Write([]string{discoveredValue.Mapping, discoveredValue.Column, discoveredValue.Value, strconv.Itoa(discoveredValue.Count), discoveredValue.Target, discoveredValue.Match})
+	}
+	csvWriter.Flush()
+	return csvWriter.Error()
+}
@@ -0,0 +1,102 @@
+package main
+
+import (
+	"bytes"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"strings"
+
+	apiLib "github.com/hornbill/goApiLib"
+)
+
+// Duplicate request check actions
+const (
+	duplicateCheckSkip  = "skip"
+	duplicateCheckAdopt = "adopt"
+)
+
+// checkDuplicateRequest - looks for an existing request on the instance with the same external reference as the call.
+// Returns true if the call should not be logged, having been skipped or adopted as per DuplicateRequestCheck, or
+// failed because the search could not be completed
+func checkDuplicateRequest(swCallID string, requestClass *requestClassStruct, callMap map[string]interface{}, espXmlmc *apiLib.XmlmcInstStruct, buffer *bytes.Buffer) bool {
+	duplicateAction := strings.ToLower(swImportConf.DuplicateRequestCheck)
+	if duplicateAction != duplicateCheckSkip && duplicateAction != duplicateCheckAdopt {
+		return false
+	}
+	externalRef := getExternalRef(requestClass.Conf, callMap)
+	if externalRef == "" {
+		return false
+	}
+
+	smCallRef, err := searchRequestByExternalRef(externalRef, espXmlmc)
+	if err != nil {
+		//Logging the request without knowing whether it already exists could create a duplicate
+		buffer.WriteString(loggerGen(4, "Unable to check for an existing request with External Reference ["+externalRef+"], Supportworks call ["+swCallID+"] has not been imported: "+err.Error()))
+		mutexCounters.Lock()
+		requestClass.Counters.createdSkipped++
+		mutexCounters.Unlock()
+		circuitBreaker.recordFailure(err.Error())
+		return true
+	}
+	if smCallRef == "" {
+		return false
+	}
+	if duplicateAction == duplicateCheckSkip {
+		buffer.WriteString(loggerGen(5, "Request ["+smCallRef+"] already exists with External Reference ["+externalRef+"], skipping Supportworks call ["+swCallID+"]"))
+		mutexCounters.Lock()
+		requestClass.Counters.duplicatesSkipped++
+		mutexCounters.Unlock()
+		return true
+	}
+
+	buffer.WriteString(loggerGen(5, "Request ["+smCallRef+"] already exists with External Reference ["+externalRef+"], adopting it for Supportworks call ["+swCallID+"]"))
+	mutexArrCallsLogged.Lock()
+	arrCallsLogged[swCallID] = smCallRef
+	mutexArrCallsLogged.Unlock()
+	if !configDryRun {
+		writeLedgerEntry(ledgerEntryStruct{SwCallRef: swCallID, SmCallRef: smCallRef, CallClass: requestClass.Conf.CallClass, Adopted: true, Steps: map[string]string{stepCreate: stepStatusOK}})
+	}
+	mutexCounters.Lock()
+	requestClass.Counters.duplicatesAdopted++
+	mutexCounters.Unlock()
+	return true
+}
+
+// getExternalRef - returns the external reference mapped to h_external_ref_number for a call, or an empty string if
+// the request type does not map one
+func getExternalRef(callConf swCallConfStruct, callMap map[string]interface{}) string {
+	externalRefMapping, ok := callConf.CoreFieldMapping["h_external_ref_number"]
+	if !ok || fmt.Sprintf("%v", externalRefMapping) == "" {
+		return ""
+	}
+	return getFieldValue(fmt.Sprintf("%v", externalRefMapping), callMap)
+}
+
+// searchRequestByExternalRef - searches the Requests entity for a request with the given external reference, returning
+// its reference, or an empty string if there is none. Returns an error if the search could not be completed
+func searchRequestByExternalRef(externalRef string, espXmlmc *apiLib.XmlmcInstStruct) (string, error) {
+	espXmlmc.SetParam("application", appServiceManager)
+	espXmlmc.SetParam("entity", "Requests")
+	espXmlmc.SetParam("matchScope", "all")
+	espXmlmc.OpenElement("searchFilter")
+	espXmlmc.SetParam("column", "h_external_ref_number")
+	espXmlmc.SetParam("value", externalRef)
+	espXmlmc.SetParam("matchType", "exact")
+	espXmlmc.CloseElement("searchFilter")
+	espXmlmc.SetParam("maxResults", "1")
+
+	XMLRequestSearch, xmlmcErr := invokeXmlmc(espXmlmc, "data", "entityBrowseRecords2")
+	if xmlmcErr != nil {
+		return "", xmlmcErr
+	}
+	var xmlRespon xmlmcRequestSearchResponse
+	err := xml.Unmarshal([]byte(XMLRequestSearch), &xmlRespon)
+	if err != nil {
+		return "", err
+	}
+	if xmlRespon.MethodResult != "ok" {
+		return "", errors.New(xmlRespon.State.ErrorRet)
+	}
+	return xmlRespon.RequestID, nil
+}
@@ -0,0 +1,118 @@
+package main
+
+import (
+	"strings"
+	"unicode/utf8"
+)
+
+// sourceEncodings - the names accepted for the Encoding of SWAppDBConf and SWSystemDBConf
+var sourceEncodings = []string{"UTF-8", "ISO-8859-1", "Latin1", "Windows-1252", "CP1252"}
+
+// windows1252Runes - the characters of bytes 0x80 to 0x9F in Windows-1252. The 5 undefined bytes are left as the
+// matching control characters, and are then stripped
+var windows1252Runes = [32]rune{
+	0x20AC, 0x0081, 0x201A, 0x0192, 0x201E, 0x2026, 0x2020, 0x2021, 0x02C6, 0x2030, 0x0160, 0x2039, 0x0152, 0x008D, 0x017D, 0x008F,
+	0x0090, 0x2018, 0x2019, 0x201C, 0x201D, 0x2022, 0x2013, 0x2014, 0x02DC, 0x2122, 0x0161, 0x203A, 0x0153, 0x009D, 0x017E, 0x0178,
+}
+
+// isSourceEncoding - returns true if the name is an encoding that text can be read from. Empty means UTF-8
+func isSourceEncoding(encoding string) bool {
+	if encoding == "" {
+		return true
+	}
+	for _, encodingName := range sourceEncodings {
+		if strings.EqualFold(encoding, encodingName) {
+			return true
+		}
+	}
+	return false
+}
+
+// sanitiseRow - converts the text values of a row read from a Supportworks database from the Encoding of the database
+// to UTF-8, and removes the characters Hornbill rejects. Altered values are counted for the import summary
+func sanitiseRow(row map[string]interface{}, encoding string) {
+	for columnName, value := range row {
+		var sourceText string
+		switch typedValue := value.(type) {
+		case []byte:
+			sourceText = string(typedValue)
+		case string:
+			sourceText = typedValue
+		default:
+			continue
+		}
+		row[columnName] = sanitiseSourceText(sourceText, encoding, columnName)
+	}
+}
+
+// sanitiseSourceText - converts a text value read from a Supportworks database to UTF-8, and removes the characters
+// Hornbill rejects. Altered values are counted for the import summary
+func sanitiseSourceText(sourceText, encoding, columnName string) string {
+	sanitisedText, altered := sanitiseText(decodeSourceText(sourceText, encoding))
+	if altered {
+		mutexCounters.Lock()
+		counters.fieldsSanitised++
+		mutexCounters.Unlock()
+		if configDebug {
+			logger(3, "Control characters or invalid UTF-8 removed from the text in column "+columnName, false)
+		}
+	}
+	return sanitisedText
+}
+
+// decodeSourceText - converts text from a single byte encoding to UTF-8. UTF-8 text is returned as it is
+func decodeSourceText(sourceText, encoding string) string {
+	isWindows1252 := strings.EqualFold(encoding, "Windows-1252") || strings.EqualFold(encoding, "CP1252")
+	if !isWindows1252 && !strings.EqualFold(encoding, "ISO-8859-1") && !strings.EqualFold(encoding, "Latin1") {
+		return sourceText
+	}
+	var decodedText strings.Builder
+	decodedText.Grow(len(sourceText))
+	for i := 0; i < len(sourceText); i++ {
+		sourceByte := sourceText[i]
+		switch {
+		case sourceByte < 0x80:
+			decodedText.WriteByte(sourceByte)
+		case isWindows1252 && sourceByte < 0xA0:
+			decodedText.WriteRune(windows1252Runes[sourceByte-0x80])
+		default:
+			//The ISO-8859-1 characters are the first 256 Unicode characters
+			decodedText.WriteRune(rune(sourceByte))
+		}
+	}
+	return decodedText.String()
+}
+
+// sanitiseText - replaces invalid UTF-8 with the Unicode replacement character, and removes control characters
+// other than tab, line feed and carriage return. Returns true if the text was altered
+func sanitiseText(text string) (string, bool) {
+	if utf8.ValidString(text) && strings.IndexFunc(text, isRejectedRune) == -1 {
+		return text, false
+	}
+	var sanitisedText strings.Builder
+	sanitisedText.Grow(len(text))
+	for i, textRune := range text {
+		if textRune == utf8.RuneError {
+			if _, runeSize := utf8.DecodeRuneInString(text[i:]); runeSize == 1 {
+				sanitisedText.WriteRune(utf8.RuneError)
+				continue
+			}
+		}
+		if !isRejectedRune(textRune) {
+			sanitisedText.WriteRune(textRune)
+		}
+	}
+	return sanitisedText.String(), true
+}
+
+// isRejectedRune - returns true for the control characters, and the non-characters U+FFFE and U+FFFF, that are not
+// valid in the XML sent to Hornbill or are never wanted in imported text
+func isRejectedRune(textRune rune) bool {
+	switch {
+	case textRune == '\t' || textRune == '\n' || textRune == '\r':
+		return false
+	case textRune < 0x20 || (textRune >= 0x7F && textRune <= 0x9F):
+		return true
+	}
+	return textRune == 0xFFFE || textRune == 0xFFFF
+}
@@ -0,0 +1,468 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// A field mapping can contain expressions between {{ and }}, alongside the usual text and [column] references:
+//
+//	"h_summary": "{{ default(trim([itsm_title]), 'No Summary') }}"
+//	"h_custom_a": "{{ join(' - ', [site], upper([suppgroup])) }}"
+//
+// An expression is a [column], a 'string' or "string", a whole number, or a function call. Functions only ever
+// work on strings, and a value that is empty or only whitespace is treated as empty (false) by the functions
+// that test for it
+
+// fieldExprNode - a parsed expression, evaluated against the SQL record of a call
+type fieldExprNode interface {
+	eval(callMap map[string]interface{}, fieldFormat fieldFormatStruct) string
+}
+
+type fieldLiteralNode struct {
+	value string
+}
+
+type fieldColumnNode struct {
+	column string
+}
+
+type fieldFunctionNode struct {
+	name     string
+	args     []fieldExprNode
+	function fieldFunctionStruct
+	pattern  *regexp.Regexp //Compiled when the pattern of replace or matches is a literal
+}
+
+// fieldFunctionStruct - a function of the expression language. MaxArgs of -1 allows any number of arguments
+type fieldFunctionStruct struct {
+	MinArgs int
+	MaxArgs int
+	Eval    func(args []string, pattern *regexp.Regexp) (string, error)
+}
+
+// fieldTemplatePart - a part of a field mapping, either text with [column] references, or an expression
+type fieldTemplatePart struct {
+	text string
+	expr fieldExprNode
+}
+
+// fieldTemplateStruct - a parsed field mapping
+type fieldTemplateStruct struct {
+	parts   []fieldTemplatePart
+	columns []string
+	lookups []string
+	err     error
+}
+
+// fieldExprError - a problem parsing a field mapping, at a character position within it
+type fieldExprError struct {
+	Pos     int
+	Message string
+}
+
+func (exprErr *fieldExprError) Error() string {
+	return fmt.Sprintf("invalid expression at character %d: %s", exprErr.Pos+1, exprErr.Message)
+}
+
+// fieldTemplates - parsed field mappings, by mapping text
+var fieldTemplates sync.Map
+
+// fieldExprTrue - the value returned by functions that test a condition, when it is true
+const fieldExprTrue = "true"
+
+// fieldFunctions - the functions that can be used in expressions
+var fieldFunctions = map[string]fieldFunctionStruct{
+	"default": {MinArgs: 2, MaxArgs: -1, Eval: func(args []string, _ *regexp.Regexp) (string, error) {
+		for _, arg := range args {
+			if !isEmptyExprValue(arg) {
+				return arg, nil
+			}
+		}
+		return "", nil
+	}},
+	"trim": {MinArgs: 1, MaxArgs: 1, Eval: func(args []string, _ *regexp.Regexp) (string, error) {
+		return strings.TrimSpace(args[0]), nil
+	}},
+	"upper": {MinArgs: 1, MaxArgs: 1, Eval: func(args []string, _ *regexp.Regexp) (string, error) {
+		return strings.ToUpper(args[0]), nil
+	}},
+	"lower": {MinArgs: 1, MaxArgs: 1, Eval: func(args []string, _ *regexp.Regexp) (string, error) {
+		return strings.ToLower(args[0]), nil
+	}},
+	"substr": {MinArgs: 2, MaxArgs: 3, Eval: evalSubstr},
+	"replace": {MinArgs: 3, MaxArgs: 3, Eval: func(args []string, pattern *regexp.Regexp) (string, error) {
+		pattern, err := getExprPattern(args[1], pattern)
+		if err != nil {
+			return args[0], err
+		}
+		return pattern.ReplaceAllString(args[0], args[2]), nil
+	}},
+	"matches": {MinArgs: 2, MaxArgs: 2, Eval: func(args []string, pattern *regexp.Regexp) (string, error) {
+		pattern, err := getExprPattern(args[1], pattern)
+		if err != nil {
+			return "", err
+		}
+		return exprBool(pattern.MatchString(args[0])), nil
+	}},
+	"concat": {MinArgs: 1, MaxArgs: -1, Eval: func(args []string, _ *regexp.Regexp) (string, error) {
+		return strings.Join(args, ""), nil
+	}},
+	"join": {MinArgs: 2, MaxArgs: -1, Eval: func(args []string, _ *regexp.Regexp) (string, error) {
+		parts := make([]string, 0, len(args)-1)
+		for _, arg := range args[1:] {
+			if !isEmptyExprValue(arg) {
+				parts = append(parts, arg)
+			}
+		}
+		return strings.Join(parts, args[0]), nil
+	}},
+	"if": {MinArgs: 2, MaxArgs: 3, Eval: func(args []string, _ *regexp.Regexp) (string, error) {
+		if !isEmptyExprValue(args[0]) {
+			return args[1], nil
+		}
+		if len(args) == 3 {
+			return args[2], nil
+		}
+		return "", nil
+	}},
+	"eq": {MinArgs: 2, MaxArgs: 2, Eval: func(args []string, _ *regexp.Regexp) (string, error) {
+		return exprBool(args[0] == args[1]), nil
+	}},
+	"ne": {MinArgs: 2, MaxArgs: 2, Eval: func(args []string, _ *regexp.Regexp) (string, error) {
+		return exprBool(args[0] != args[1]), nil
+	}},
+	"contains": {MinArgs: 2, MaxArgs: 2, Eval: func(args []string, _ *regexp.Regexp) (string, error) {
+		return exprBool(strings.Contains(args[0], args[1])), nil
+	}},
+	"empty": {MinArgs: 1, MaxArgs: 1, Eval: func(args []string, _ *regexp.Regexp) (string, error) {
+		return exprBool(isEmptyExprValue(args[0])), nil
+	}},
+	"not": {MinArgs: 1, MaxArgs: 1, Eval: func(args []string, _ *regexp.Regexp) (string, error) {
+		return exprBool(isEmptyExprValue(args[0])), nil
+	}},
+	"and": {MinArgs: 2, MaxArgs: -1, Eval: func(args []string, _ *regexp.Regexp) (string, error) {
+		for _, arg := range args {
+			if isEmptyExprValue(arg) {
+				return "", nil
+			}
+		}
+		return fieldExprTrue, nil
+	}},
+	"lookup": {MinArgs: 2, MaxArgs: 2, Eval: func(args []string, _ *regexp.Regexp) (string, error) {
+		return lookupValue(args[0], args[1]), nil
+	}},
+	"or": {MinArgs: 2, MaxArgs: -1, Eval: func(args []string, _ *regexp.Regexp) (string, error) {
+		for _, arg := range args {
+			if !isEmptyExprValue(arg) {
+				return fieldExprTrue, nil
+			}
+		}
+		return "", nil
+	}},
+}
+
+// isEmptyExprValue - returns true if a value is empty or only whitespace
+func isEmptyExprValue(value string) bool {
+	return strings.TrimSpace(value) == ""
+}
+
+// exprBool - returns the value of a condition, true or empty
+func exprBool(condition bool) string {
+	if condition {
+		return fieldExprTrue
+	}
+	return ""
+}
+
+// evalSubstr - returns part of a value, from a start character counted from 1, for an optional number of characters
+func evalSubstr(args []string, _ *regexp.Regexp) (string, error) {
+	value := []rune(args[0])
+	start, err := strconv.Atoi(strings.TrimSpace(args[1]))
+	if err != nil || start < 1 {
+		return "", fmt.Errorf("substr start must be a whole number of 1 or more, not %q", args[1])
+	}
+	if start > len(value) {
+		return "", nil
+	}
+	end := len(value)
+	if len(args) == 3 {
+		length, err := strconv.Atoi(strings.TrimSpace(args[2]))
+		if err != nil || length < 0 {
+			return "", fmt.Errorf("substr length must be a whole number of 0 or more, not %q", args[2])
+		}
+		if start-1+length < end {
+			end = start - 1 + length
+		}
+	}
+	return string(value[start-1 : end]), nil
+}
+
+// getExprPattern - returns the pattern compiled when the expression was parsed, or compiles the pattern from a column
+func getExprPattern(patternText string, pattern *regexp.Regexp) (*regexp.Regexp, error) {
+	if pattern != nil {
+		return pattern, nil
+	}
+	return regexp.Compile(patternText)
+}
+
+func (node *fieldLiteralNode) eval(callMap map[string]interface{}, fieldFormat fieldFormatStruct) string {
+	return node.value
+}
+
+func (node *fieldColumnNode) eval(callMap map[string]interface{}, fieldFormat fieldFormatStruct) string {
+	return getColumnValue(node.column, callMap, fieldFormat)
+}
+
+func (node *fieldFunctionNode) eval(callMap map[string]interface{}, fieldFormat fieldFormatStruct) string {
+	args := make([]string, len(node.args))
+	for i, arg := range node.args {
+		args[i] = arg.eval(callMap, fieldFormat)
+	}
+	result, err := node.function.Eval(args, node.pattern)
+	if err != nil {
+		logger(4, "Field mapping function "+node.name+" failed: "+err.Error(), false)
+	}
+	return result
+}
+
+// getFieldTemplate - returns the parsed field mapping, parsing it on first use
+func getFieldTemplate(fieldMapping string) *fieldTemplateStruct {
+	if cachedTemplate, ok := fieldTemplates.Load(fieldMapping); ok {
+		return cachedTemplate.(*fieldTemplateStruct)
+	}
+	fieldTemplate := parseFieldTemplate(fieldMapping)
+	fieldTemplates.Store(fieldMapping, fieldTemplate)
+	return fieldTemplate
+}
+
+// evalFieldTemplate - returns the value of a field mapping containing expressions for a call. A mapping that cannot
+// be parsed is output with only its [column] references replaced, as before expressions were supported
+func evalFieldTemplate(fieldMapping string, callMap map[string]interface{}, fieldFormat fieldFormatStruct) string {
+	fieldTemplate := getFieldTemplate(fieldMapping)
+	if fieldTemplate.err != nil {
+		logger(4, "Field mapping "+fieldMapping+" - "+fieldTemplate.err.Error(), false)
+		return replaceColumnReferences(fieldMapping, callMap, fieldFormat)
+	}
+	var fieldValue strings.Builder
+	for _, part := range fieldTemplate.parts {
+		if part.expr != nil {
+			fieldValue.WriteString(part.expr.eval(callMap, fieldFormat))
+		} else {
+			fieldValue.WriteString(replaceColumnReferences(part.text, callMap, fieldFormat))
+		}
+	}
+	return fieldValue.String()
+}
+
+// parseFieldTemplate - splits a field mapping in to text and {{expressions}}, and parses each expression
+func parseFieldTemplate(fieldMapping string) *fieldTemplateStruct {
+	fieldTemplate := &fieldTemplateStruct{}
+	pos := 0
+	for pos < len(fieldMapping) {
+		exprStart := strings.Index(fieldMapping[pos:], "{{")
+		if exprStart == -1 {
+			fieldTemplate.addText(fieldMapping[pos:])
+			break
+		}
+		exprStart += pos
+		fieldTemplate.addText(fieldMapping[pos:exprStart])
+		parser := &fieldExprParser{input: fieldMapping, pos: exprStart + 2}
+		expr, err := parser.parseExpr()
+		if err == nil {
+			parser.skipSpace()
+			if !strings.HasPrefix(fieldMapping[parser.pos:], "}}") {
+				err = parser.errorf("expected }} to end the expression started at character %d", exprStart+1)
+			}
+		}
+		if err != nil {
+			fieldTemplate.err = err
+			return fieldTemplate
+		}
+		fieldTemplate.parts = append(fieldTemplate.parts, fieldTemplatePart{expr: expr})
+		fieldTemplate.columns = append(fieldTemplate.columns, parser.columns...)
+		fieldTemplate.lookups = append(fieldTemplate.lookups, parser.lookups...)
+		pos = parser.pos + 2
+	}
+	return fieldTemplate
+}
+
+// addText - adds a text part to a template, recording the columns it refers to
+func (fieldTemplate *fieldTemplateStruct) addText(text string) {
+	if text == "" {
+		return
+	}
+	fieldTemplate.parts = append(fieldTemplate.parts, fieldTemplatePart{text: text})
+	for _, reference := range reFieldReference.FindAllStringSubmatch(text, -1) {
+		fieldTemplate.columns = append(fieldTemplate.columns, reference[1])
+	}
+}
+
+// fieldExprParser - a recursive descent parser for a single expression
+type fieldExprParser struct {
+	input   string
+	pos     int
+	columns []string
+	lookups []string
+}
+
+func (parser *fieldExprParser) errorf(format string, args ...interface{}) error {
+	return &fieldExprError{Pos: parser.pos, Message: fmt.Sprintf(format, args...)}
+}
+
+func (parser *fieldExprParser) skipSpace() {
+	for parser.pos < len(parser.input) && isSQLSpace(parser.input[parser.pos]) {
+		parser.pos++
+	}
+}
+
+// parseExpr - parses a [column], string, whole number or function call
+func (parser *fieldExprParser) parseExpr() (fieldExprNode, error) {
+	parser.skipSpace()
+	if parser.pos >= len(parser.input) {
+		return nil, parser.errorf("expression is not complete")
+	}
+	char := parser.input[parser.pos]
+	switch {
+	case char == '[':
+		columnEnd := strings.IndexByte(parser.input[parser.pos:], ']')
+		if columnEnd == -1 {
+			return nil, parser.errorf("[ is not closed with ]")
+		}
+		column := parser.input[parser.pos+1 : parser.pos+columnEnd]
+		if column == "" {
+			return nil, parser.errorf("column name is empty")
+		}
+		parser.pos += columnEnd + 1
+		parser.columns = append(parser.columns, column)
+		return &fieldColumnNode{column: column}, nil
+	case char == '\'' || char == '"':
+		return parser.parseString(char)
+	case char == '-' || (char >= '0' && char <= '9'):
+		numberStart := parser.pos
+		parser.pos++
+		for parser.pos < len(parser.input) && parser.input[parser.pos] >= '0' && parser.input[parser.pos] <= '9' {
+			parser.pos++
+		}
+		if parser.input[numberStart:parser.pos] == "-" {
+			parser.pos = numberStart
+			return nil, parser.errorf("- must be followed by a number")
+		}
+		return &fieldLiteralNode{value: parser.input[numberStart:parser.pos]}, nil
+	case isExprNameChar(char):
+		return parser.parseFunction()
+	}
+	return nil, parser.errorf("unexpected %q", char)
+}
+
+// parseString - parses a string in single or double quotes. A quote is included by doubling it, and \ is kept as
+// it is, for regular expression patterns
+func (parser *fieldExprParser) parseString(quote byte) (fieldExprNode, error) {
+	stringStart := parser.pos
+	parser.pos++
+	var value strings.Builder
+	for parser.pos < len(parser.input) {
+		char := parser.input[parser.pos]
+		switch {
+		case char == quote && parser.pos+1 < len(parser.input) && parser.input[parser.pos+1] == quote:
+			value.WriteByte(quote)
+			parser.pos += 2
+		case char == quote:
+			parser.pos++
+			return &fieldLiteralNode{value: value.String()}, nil
+		default:
+			value.WriteByte(char)
+			parser.pos++
+		}
+	}
+	parser.pos = stringStart
+	return nil, parser.errorf("string is not closed with %c", quote)
+}
+
+// parseFunction - parses a function name and its arguments in brackets, checking the function exists and has
+// the right number of arguments
+func (parser *fieldExprParser) parseFunction() (fieldExprNode, error) {
+	nameStart := parser.pos
+	for parser.pos < len(parser.input) && isExprNameChar(parser.input[parser.pos]) {
+		parser.pos++
+	}
+	name := strings.ToLower(parser.input[nameStart:parser.pos])
+	function, ok := fieldFunctions[name]
+	if !ok {
+		parser.pos = nameStart
+		return nil, parser.errorf("unknown function %s - columns must be written as [%s]", name, parser.input[nameStart:nameStart+len(name)])
+	}
+	parser.skipSpace()
+	if parser.pos >= len(parser.input) || parser.input[parser.pos] != '(' {
+		return nil, parser.errorf("expected ( after %s", name)
+	}
+	parser.pos++
+	node := &fieldFunctionNode{name: name, function: function}
+	parser.skipSpace()
+	if parser.pos < len(parser.input) && parser.input[parser.pos] == ')' {
+		parser.pos++
+	} else {
+		for {
+			arg, err := parser.parseExpr()
+			if err != nil {
+				return nil, err
+			}
+			node.args = append(node.args, arg)
+			parser.skipSpace()
+			if parser.pos >= len(parser.input) {
+				return nil, parser.errorf("%s( is not closed with )", name)
+			}
+			if parser.input[parser.pos] == ')' {
+				parser.pos++
+				break
+			}
+			if parser.input[parser.pos] != ',' {
+				return nil, parser.errorf("expected , or ) in the arguments of %s", name)
+			}
+			parser.pos++
+		}
+	}
+	if len(node.args) < function.MinArgs || (function.MaxArgs != -1 && len(node.args) > function.MaxArgs) {
+		return nil, &fieldExprError{Pos: nameStart, Message: fmt.Sprintf("%s takes %s, not %d", name, describeArgCount(function), len(node.args))}
+	}
+	//Literal patterns are compiled now, so a bad pattern is reported when the configuration is loaded
+	if name == "replace" || name == "matches" {
+		if literal, ok := node.args[1].(*fieldLiteralNode); ok {
+			pattern, err := regexp.Compile(literal.value)
+			if err != nil {
+				return nil, &fieldExprError{Pos: nameStart, Message: "invalid pattern in " + name + ": " + err.Error()}
+			}
+			node.pattern = pattern
+		}
+	}
+	//Lookup tables are named with a literal, so the table can be checked when the configuration is loaded
+	if name == "lookup" {
+		literal, ok := node.args[0].(*fieldLiteralNode)
+		if !ok {
+			return nil, &fieldExprError{Pos: nameStart, Message: "the table name in lookup must be a string"}
+		}
+		parser.lookups = append(parser.lookups, literal.value)
+	}
+	return node, nil
+}
+
+// isExprNameChar - returns true if the character can be part of a function name
+func isExprNameChar(char byte) bool {
+	return (char >= 'a' && char <= 'z') || (char >= 'A' && char <= 'Z') || char == '_'
+}
+
+// describeArgCount - describes the number of arguments a function takes
+func describeArgCount(function fieldFunctionStruct) string {
+	switch {
+	case function.MaxArgs == -1:
+		return fmt.Sprintf("%d or more arguments", function.MinArgs)
+	case function.MinArgs == function.MaxArgs && function.MinArgs == 1:
+		return "1 argument"
+	case function.MinArgs == function.MaxArgs:
+		return fmt.Sprintf("%d arguments", function.MinArgs)
+	}
+	return fmt.Sprintf("%d to %d arguments", function.MinArgs, function.MaxArgs)
+}
@@ -2,13 +2,13 @@ package main
 
 import (
 	"fmt"
+	"os"
 	"strconv"
 	"strings"
 	"time"
 
 	"github.com/tcnksm/go-latest" //-- For Version checking
 
-	"github.com/hornbill/sqlx"
 	//SQL Drivers
 	_ "github.com/alexbrainman/odbc"
 	_ "github.com/hornbill/go-mssqldb" //Microsoft SQL Server driver - v2005+
@@ -36,6 +36,35 @@ func main() {
 	logger(1, "Flag - Config File "+configFileName, true)
 	logger(1, "Flag - Dry Run "+fmt.Sprintf("%v", configDryRun), true)
 	logger(1, "Flag - Concurrent Requests "+fmt.Sprintf("%v", configMaxRoutines), true)
+	logger(1, "Flag - Minimum Concurrent Requests "+fmt.Sprintf("%v", configMinRoutines), true)
+	logger(1, "Flag - Requests Per Second "+fmt.Sprintf("%v", configRequestRate), true)
+	logger(1, "Flag - API Call Retries "+fmt.Sprintf("%v", configRetries), true)
+	logger(1, "Flag - Retry Backoff (ms) "+fmt.Sprintf("%v", configRetryBackoff), true)
+	logger(1, "Flag - Circuit Breaker Window "+fmt.Sprintf("%v", configBreakerWindow), true)
+	logger(1, "Flag - Circuit Breaker Ratio "+fmt.Sprintf("%v", configBreakerRatio), true)
+	logger(1, "Flag - Circuit Breaker Consecutive Failures "+fmt.Sprintf("%v", configBreakerStreak), true)
+	logger(1, "Flag - Pause File "+configPauseFile, true)
+	logger(1, "Flag - Ledger File "+configLedgerFile, true)
+	logger(1, "Flag - Resume "+fmt.Sprintf("%v", configResume), true)
+	logger(1, "Flag - Delta "+fmt.Sprintf("%v", configDelta), true)
+	if configExport != "" {
+		logger(1, "Flag - Export "+configExport, true)
+	}
+	if configImportArchive != "" {
+		logger(1, "Flag - Import Archive "+configImportArchive, true)
+	}
+	if configValidateConf {
+		logger(1, "Flag - Validate Config "+fmt.Sprintf("%v", configValidateConf), true)
+	}
+	logger(1, "Flag - Preflight "+fmt.Sprintf("%v", configPreflight), true)
+	if configDiscoverFile != "" {
+		logger(1, "Flag - Discover "+configDiscoverFile, true)
+	}
+	logger(1, "Flag - Retry Failed Steps "+fmt.Sprintf("%v", configRetryFailedSteps), true)
+	if configRollback != "" {
+		logger(1, "Flag - Rollback Run "+configRollback, true)
+		logger(1, "Flag - Rollback Class "+configRollbackClass, true)
+	}
 
 	//Check maxGoroutines for valid value
 	maxRoutines, err := strconv.Atoi(configMaxRoutines)
@@ -45,44 +74,87 @@ func main() {
 	}
 	maxGoroutines = maxRoutines
 
-	if maxGoroutines < 1 || maxGoroutines > 10 {
-		logger(4, "The maximum concurrent requests allowed is between 1 and 10 (inclusive).\n\n", true)
+	if maxGoroutines < 1 {
+		logger(4, "The minimum concurrent requests allowed is 1.\n\n", true)
 		logger(4, "You have selected "+configMaxRoutines+". Please try again, with a valid value against ", true)
 		logger(4, "the -concurrent switch.", true)
 		return
 	}
+	minRoutines, err := strconv.Atoi(configMinRoutines)
+	if err != nil {
+		logger(4, "Unable to convert minimum concurrency of ["+configMinRoutines+"] to type INT for processing", true)
+		return
+	}
+	if minRoutines < 1 || minRoutines > maxGoroutines {
+		logger(4, "The -concurrent-min switch must be between 1 and the -concurrent value of "+configMaxRoutines+" (inclusive).", true)
+		return
+	}
+	minGoroutines = minRoutines
+	if configRetries < 0 || configRetryBackoff < 1 {
+		logger(4, "The -retries switch cannot be negative, and the -retry-backoff switch must be at least 1 millisecond.", true)
+		return
+	}
+	if configBreakerWindow < 0 || configBreakerRatio < 0 || configBreakerRatio > 1 || configBreakerStreak < 0 {
+		logger(4, "The -breaker-window and -breaker-consecutive switches cannot be negative, and -breaker-ratio must be between 0 and 1.", true)
+		return
+	}
+	startCircuitBreaker(configBreakerWindow)
+	if configRequestRate < 0 {
+		logger(4, "The -rps switch cannot be negative. Use 0 for no limit on API calls per second.", true)
+		return
+	}
+	if maxGoroutines > 10 && configRequestRate == 0 {
+		logger(5, "More than 10 concurrent requests with no -rps limit could affect the performance of your Hornbill instance", true)
+	}
+	startRateLimiter(configRequestRate)
 
 	//-- Load Configuration File Into Struct
 	swImportConf, boolConfLoaded = loadConfig()
-	if !boolConfLoaded {
-		logger(4, "Unable to load config, process closing.", true)
+	//-- Validating the configuration ends here, with a non-zero exit code if it cannot be loaded
+	if configValidateConf {
+		if !boolConfLoaded || !loadMappingFiles() || !loadLookupTables() {
+			logger(4, "Configuration File "+configFileName+" is not valid", true)
+			os.Exit(102)
+		}
+		logger(1, "Configuration File "+configFileName+" is valid", true)
 		return
 	}
-
-	//Set SQL driver ID string for Application Data
-	if swImportConf.SWAppDBConf.Driver == "" {
-		logger(4, "SWAppDBConf SQL Driver not set in configuration.", true)
+	if !boolConfLoaded {
+		logger(4, "Unable to load config, process closing.", true)
 		return
 	}
-	if swImportConf.SWAppDBConf.Driver == "swsql" {
-		appDBDriver = "mysql320"
-	} else if swImportConf.SWAppDBConf.Driver == "mysql" || swImportConf.SWAppDBConf.Driver == "mssql" || swImportConf.SWAppDBConf.Driver == "mysql320" || swImportConf.SWAppDBConf.Driver == "odbc" || swImportConf.SWAppDBConf.Driver == "ODBC" {
-		appDBDriver = swImportConf.SWAppDBConf.Driver
-	} else {
-		logger(4, "The SQL driver ("+swImportConf.SWAppDBConf.Driver+") for the Supportworks Application Database specified in the configuration file is not valid.", true)
+	if !loadMappingFiles() {
+		logger(4, "Unable to load the mapping files in MappingFiles, process closing.", true)
 		return
 	}
-	//Set SQL driver ID string for Cache Data
-	if swImportConf.SWSystemDBConf.Driver == "" {
-		logger(4, "SWSystemDBConf SQL Driver not set in configuration.", true)
+	if !loadLookupTables() {
+		logger(4, "Unable to load the files in LookupTables, process closing.", true)
 		return
 	}
-	if swImportConf.SWSystemDBConf.Driver == "swsql" {
-		cacheDBDriver = "mysql320"
-	} else if swImportConf.SWSystemDBConf.Driver == "mysql" || swImportConf.SWSystemDBConf.Driver == "mysql320" {
-		cacheDBDriver = swImportConf.SWSystemDBConf.Driver
+
+	//-- Calls are read from an export archive instead of the Supportworks databases when importing offline
+	if configImportArchive != "" {
+		if configExport != "" {
+			logger(4, "The -export and -import-archive switches cannot be used together.", true)
+			return
+		}
+		if !openImportArchive(configImportArchive) {
+			return
+		}
+		defer closeImportArchive()
 	} else {
-		logger(4, "The SQL driver ("+swImportConf.SWSystemDBConf.Driver+") for the Supportworks System Database specified in the configuration file is not valid.", true)
+		if !connectDatabases() {
+			return
+		}
+		defer closeDatabases()
+	}
+
+	//-- Export writes the Supportworks data to an archive then ends, without connecting to the Hornbill instance
+	if configExport != "" {
+		processExport(configExport)
+		endTime = time.Since(startTime)
+		logger(1, "Time Taken: "+fmt.Sprintf("%v", endTime), true)
+		logger(1, "---- Supportworks Call Export Complete ---- ", true)
 		return
 	}
 
@@ -96,29 +168,41 @@ func main() {
 		defer logout()
 	}
 
-	//-- Build DB connection strings for sw_systemdb and swdata
-	connStrSysDB = buildConnectionString("cache")
-	connStrAppDB = buildConnectionString("app")
-
-	var db2err error
-	//fmt.Println(connStrAppDB)
-	dbapp, db2err = sqlx.Open(appDBDriver, connStrAppDB)
-	if db2err != nil {
-		logger(4, "Could not open app DB connection"+db2err.Error(), true)
+	//-- Load the ledger of previously imported requests, and open it for this run
+	if configRetryFailedSteps && configDryRun {
+		logger(4, "The -retry-failed-steps switch cannot be used in a dry run.", true)
 		return
 	}
-	defer dbapp.Close()
-
-	if swImportConf.SWSystemDBConf.Driver == "mysql" && swImportConf.SWSystemDBConf.Driver == swImportConf.SWAppDBConf.Driver {
-		dbsys = dbapp
-	} else {
-		var dberr error
-		dbsys, dberr = sqlx.Open(cacheDBDriver, connStrSysDB)
-		if dberr != nil {
-			logger(4, "Could not open cache DB connection"+dberr.Error(), true)
+	if !openLedger() {
+		return
+	}
+	defer closeLedger()
+	//-- From here on, a shutdown signal lets the requests in progress finish and the ledger be written before the import ends
+	watchForShutdown()
+	if configResume {
+		loadLedgerCallsLogged()
+		logger(1, "Resuming import - "+fmt.Sprintf("%d", len(arrCallsLogged))+" previously imported request(s) will be skipped", true)
+	}
+	if configDelta {
+		if configRetryFailedSteps {
+			logger(4, "The -delta and -retry-failed-steps switches cannot be used together.", true)
 			return
 		}
-		defer dbsys.Close()
+		if !loadWatermark() {
+			return
+		}
+		//Previously imported requests are needed to resolve associations to changed calls
+		loadLedgerCallsLogged()
+		logger(1, "Delta import - "+fmt.Sprintf("%d", len(arrCallsLogged))+" previously imported request(s) will be updated if changed", true)
+	}
+
+	//-- Rollback removes the requests created by a previous run, then ends
+	if configRollback != "" {
+		processRollback(configRollback, configRollbackClass)
+		endTime = time.Since(startTime)
+		logger(1, "Time Taken: "+fmt.Sprintf("%v", endTime), true)
+		logger(1, "---- Supportworks Call Import Rollback Complete ---- ", true)
+		return
 	}
 
 	err = loadOrgs()
@@ -126,33 +210,125 @@ func main() {
 		logger(4, "Error when trying to cache Organisation records from instance: "+err.Error(), true)
 	}
 
-	//Get request type import config, process each in turn
+	//Get request type import config for every enabled class
+	requestClasses := make([]*requestClassStruct, 0)
 	for _, val := range swImportConf.RequestTypesToImport {
 		if val.Import {
-			reqPrefix = getRequestPrefix(val.CallClass)
-			mapGenericConf = val
-			processCallData()
+			requestClasses = append(requestClasses, &requestClassStruct{Conf: val, Prefix: getRequestPrefix(val.CallClass)})
 		}
 	}
 
-	if len(arrCallsLogged) > 0 {
-		//Process associations
-		processCallAssociations()
-		//Add file attachments to requests
-		processAttachments()
+	//-- Discovery writes a mapping skeleton from the Supportworks data, then ends without creating any requests
+	if configDiscoverFile != "" {
+		if configImportArchive != "" {
+			logger(4, "The -discover and -import-archive switches cannot be used together.", true)
+			return
+		}
+		processDiscovery(configDiscoverFile, requestClasses)
+		endTime = time.Since(startTime)
+		logger(1, "Time Taken: "+fmt.Sprintf("%v", endTime), true)
+		logger(1, "---- Supportworks Call Import Mapping Discovery Complete ---- ", true)
+		return
+	}
+
+	//-- Preflight checks the lookups for every class, then ends without creating any requests
+	if configPreflight {
+		unresolvedCount, preflightComplete := processPreflight(requestClasses)
+		if unresolvedCount > 0 {
+			logger(5, "Preflight found "+fmt.Sprintf("%d", unresolvedCount)+" unresolved value(s) - see above for the values of each mapping", true)
+		} else if preflightComplete {
+			logger(1, "Preflight found no unresolved values", true)
+		}
+		endTime = time.Since(startTime)
+		logger(1, "Time Taken: "+fmt.Sprintf("%v", endTime), true)
+		if !preflightComplete {
+			logger(4, "---- Supportworks Call Import Preflight Failed - the calls of every class could not be checked ---- ", true)
+			os.Exit(1)
+		}
+		logger(1, "---- Supportworks Call Import Preflight Complete ---- ", true)
+		return
+	}
+
+	if configRetryFailedSteps {
+		//Re-run failed steps from the ledger only
+		processRetryFailedSteps()
+	} else {
+		//Process every enabled class at once
+		processCallData(requestClasses)
+
+		if circuitBreaker.isTripped() {
+			processCircuitBreakerStop()
+		} else if !shutdownRequested() {
+			if len(arrCallsLogged) > 0 {
+				//Process associations
+				processCallAssociations()
+				//Add file attachments to requests
+				if !shutdownRequested() {
+					processAttachments()
+				}
+			}
+			if configDelta && !shutdownRequested() {
+				saveWatermark()
+			}
+		}
+	}
+	if shutdownRequested() {
+		processShutdownStop()
 	}
 
 	//-- End output
 	logger(1, "Requests Returned: "+fmt.Sprintf("%d", counters.callsReturned), true)
 	logger(1, "Requests Logged: "+fmt.Sprintf("%d", counters.created), true)
 	logger(1, "Requests Skipped: "+fmt.Sprintf("%d", counters.createdSkipped), true)
+	if counters.resumedSkipped > 0 {
+		logger(1, "Requests Skipped (Already in Ledger): "+fmt.Sprintf("%d", counters.resumedSkipped), true)
+	}
+	if counters.notProcessed > 0 {
+		logger(1, "Requests Not Processed (Import Stopped): "+fmt.Sprintf("%d", counters.notProcessed), true)
+	}
+	if counters.duplicatesSkipped > 0 {
+		logger(1, "Requests Skipped (Duplicate External Reference): "+fmt.Sprintf("%d", counters.duplicatesSkipped), true)
+	}
+	if counters.duplicatesAdopted > 0 {
+		logger(1, "Existing Requests Adopted (Duplicate External Reference): "+fmt.Sprintf("%d", counters.duplicatesAdopted), true)
+	}
+	if configDelta {
+		logger(1, "Requests Updated: "+fmt.Sprintf("%d", counters.updated), true)
+		logger(1, "Requests Failed To Update: "+fmt.Sprintf("%d", counters.updateFailed), true)
+	}
 	if counters.existingRequests > 0 {
 		logger(1, "Existing Requests Processed: "+fmt.Sprintf("%d", counters.existingRequests), true)
 	}
+	if configRetryFailedSteps {
+		logger(1, "Steps Retried Successfully: "+fmt.Sprintf("%d", counters.stepsRetried), true)
+		logger(1, "Steps Still Failing: "+fmt.Sprintf("%d", counters.stepsFailed), true)
+	}
 	logger(1, "Files Attached: "+fmt.Sprintf("%d", counters.filesAttached), true)
+	if counters.fieldsSanitised > 0 {
+		logger(1, "Text Fields Sanitised (Control Characters or Invalid UTF-8 Removed): "+fmt.Sprintf("%d", counters.fieldsSanitised), true)
+	}
+	topErrors := circuitBreaker.topErrors(5)
+	if len(topErrors) > 0 {
+		logger(1, "Most Frequent Request Errors:", true)
+		for _, topError := range topErrors {
+			logger(1, "    "+fmt.Sprintf("%d", topError.Count)+" x "+topError.Message, true)
+		}
+	}
+	logger(1, "API Calls Per Second: "+fmt.Sprintf("%.1f", rateLimiter.effectiveRate()), true)
+	logger(1, "API Call Retries: "+fmt.Sprintf("%d", counters.xmlmcRetries)+" (up to "+fmt.Sprintf("%d", configRetries)+" per call)", true)
+	if counters.sessionRenewals > 0 {
+		logger(1, "Hornbill Sessions Renewed: "+fmt.Sprintf("%d", counters.sessionRenewals), true)
+	}
+	if counters.xmlmcRetries > 0 {
+		logger(1, "API Calls Recovered By Retrying: "+fmt.Sprintf("%d", counters.xmlmcRecovered), true)
+		logger(1, "API Calls Failed After Retrying: "+fmt.Sprintf("%d", counters.xmlmcRetryFailed), true)
+	}
 	//-- Show Time Takens
 	endTime = time.Since(startTime)
 	logger(1, "Time Taken: "+fmt.Sprintf("%v", endTime), true)
+	if pausedDuration() > 0 {
+		logger(1, "Time Paused: "+fmt.Sprintf("%v", pausedDuration()), true)
+	}
 	logger(1, "---- Supportworks Call Import Complete ---- ", true)
 
 }
@@ -23,7 +23,7 @@ func searchGroup(groupID string, espXmlmc *apiLib.XmlmcInstStruct, buffer *bytes
 
 	//-- ESP Query for team
 	espXmlmc.SetParam("id", groupID)
-	XMLTeamSearch, xmlmcErr := espXmlmc.Invoke("admin", "groupGetInfo")
+	XMLTeamSearch, xmlmcErr := invokeXmlmc(espXmlmc, "admin", "groupGetInfo")
 	if xmlmcErr != nil {
 		buffer.WriteString(loggerGen(4, "Unable to Search for Group: "+xmlmcErr.Error()))
 		return groupFound, groupName
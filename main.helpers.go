@@ -1,15 +1,16 @@
 package main
 
 import (
+	"bytes"
 	"encoding/json"
 	"encoding/xml"
 	"flag"
 	"fmt"
+	"io"
 	"log"
 	"os"
 	"strconv"
 	"strings"
-	"time"
 
 	"github.com/fatih/color"
 )
@@ -30,15 +31,23 @@ func loadConfig() (swImportConfStruct, bool) {
 	//-- Check For Error Reading File
 	if fileError != nil {
 		logger(4, "Error Opening Configuration File: "+fileError.Error(), true)
-		boolLoadConf = false
+		return swImportConfStruct{}, false
 	}
 
-	//-- New Decoder
-	decoder := json.NewDecoder(file)
-	//-- New Var based on swImportConfStruct
+	defer file.Close()
+	//-- Read and strictly validate the JSON before decoding, so unknown keys and values of the wrong type are reported
 	edbConf := swImportConfStruct{}
+	configBytes, err := io.ReadAll(file)
+	if err != nil {
+		logger(4, "Error Reading Configuration File: "+err.Error(), true)
+		return edbConf, false
+	}
+	if logConfigProblems(validateConfig(configBytes)) {
+		logger(4, "Error Validating Configuration File - see above for each problem", true)
+		return edbConf, false
+	}
 	//-- Decode JSON
-	err := decoder.Decode(&edbConf)
+	err = json.Unmarshal(configBytes, &edbConf)
 	//-- Error Checking
 	if err != nil {
 		logger(4, "Error Decoding Configuration File: "+err.Error(), true)
@@ -65,6 +74,18 @@ func loggerGen(t int, s string) string {
 	}
 	return errorLogPrefix + s + "\n\r"
 }
+
+//flushLogBuffer - writes out and empties a worker's log buffer
+func flushLogBuffer(buffer *bytes.Buffer) {
+	if buffer.Len() == 0 {
+		return
+	}
+	bufferMutex.Lock()
+	loggerWriteBuffer(buffer.String())
+	bufferMutex.Unlock()
+	buffer.Reset()
+}
+
 func loggerWriteBuffer(s string) {
 	if s != "" {
 		logLines := strings.Split(s, "\n\r")
@@ -185,21 +206,6 @@ func uploadLogger(s string) {
 	log.Println(s)
 }
 
-//epochToDateTime - converts an EPOCH value STRING var in to a date-time format compatible with Hornbill APIs
-func epochToDateTime(epochDateString string) string {
-	dateTime := ""
-	i, err := strconv.ParseInt(epochDateString, 10, 64)
-	if err != nil {
-		logger(5, "EPOCH String to Int conversion FAILED: "+err.Error(), false)
-	} else {
-		dateTimeStr := time.Unix(i, 0).UTC().String() //Force UTC
-		for i := 0; i < 19; i++ {
-			dateTime = dateTime + string(dateTimeStr[i])
-		}
-	}
-	return dateTime
-}
-
 //padCalLRef -- Function to pad Call Reference to specified digits, adding an optional prefix
 func padCallRef(strIntCallRef, prefix string, length int) (paddedRef string) {
 	if len(strIntCallRef) < length {
@@ -228,10 +234,29 @@ func parseFlags() {
 	flag.BoolVar(&configDryRun, "dryrun", false, "Dump import XML to log instead of creating requests")
 	flag.BoolVar(&configDebug, "debug", false, "Additional logging for debugging.")
 	flag.StringVar(&configMaxRoutines, "concurrent", "1", "Maximum number of requests to import concurrently.")
+	flag.StringVar(&configMinRoutines, "concurrent-min", "1", "Minimum number of requests to import concurrently, when the instance is under stress.")
+	flag.IntVar(&configRetries, "retries", 3, "Maximum number of times an API call that failed with a transport error or throttling is retried")
+	flag.IntVar(&configRetryBackoff, "retry-backoff", 1000, "Backoff in milliseconds before the first retry of a failed API call, doubling for each further retry")
+	flag.IntVar(&configBreakerWindow, "breaker-window", 100, "Number of the most recent requests the -breaker-ratio is measured over")
+	flag.Float64Var(&configBreakerRatio, "breaker-ratio", 0.5, "Stop the import when this proportion of the requests in the -breaker-window failed. 0 disables this check")
+	flag.IntVar(&configBreakerStreak, "breaker-consecutive", 50, "Stop the import when this many requests fail in a row. 0 disables this check")
+	flag.StringVar(&configPauseFile, "pausefile", "SW_Call_Import.pause", "The import pauses, between requests, while a file of this name exists in the working folder")
+	flag.Float64Var(&configRequestRate, "rps", 0, "Maximum number of API calls per second made to the Hornbill instance, shared by all workers. 0 is unlimited")
 	flag.BoolVar(&configCustomerOrg, "custorg", false, "Adopt Contact Organisation or User Company for the call rather than mapped values")
 	flag.BoolVar(&boolProcessAttachments, "attachments", false, "Import attachemnts without prompting.")
 	flag.BoolVar(&configVersion, "version", false, "Returns the version of the tool before exiting")
 	flag.BoolVar(&configSplitLogs, "splitlogs", false, "Splits the log file into three different logs")
+	flag.StringVar(&configLedgerFile, "ledger", "SW_Call_Import_Ledger.jsonl", "Name of the ledger file, within the ledger folder, that records each request imported")
+	flag.BoolVar(&configResume, "resume", false, "Reload the ledger and skip calls that have already been imported")
+	flag.StringVar(&configRollback, "rollback", "", "Run ID from the ledger of an import run to roll back. All requests created by that run are deleted from the instance")
+	flag.StringVar(&configRollbackClass, "rollbackclass", "", "Only roll back requests of this Service Manager request class")
+	flag.BoolVar(&configDelta, "delta", false, "Only import calls created or changed since the last successful delta run, updating requests already in the ledger")
+	flag.StringVar(&configExport, "export", "", "Export the Supportworks calls, call diaries, associations and attachments to this archive file, without connecting to the Hornbill instance")
+	flag.StringVar(&configImportArchive, "import-archive", "", "Import from this archive file, created by -export, instead of connecting to the Supportworks databases")
+	flag.BoolVar(&configPreflight, "preflight", false, "Check that the source values of every mapped lookup field resolve on the instance, without creating any requests")
+	flag.BoolVar(&configValidateConf, "validate-config", false, "Validate the configuration file and any mapping files, then exit without connecting to Supportworks or the instance")
+	flag.StringVar(&configDiscoverFile, "discover", "", "Write a mapping skeleton of the distinct Supportworks priority, team, category, resolution category, service and status values to this .json or .csv file, without creating any requests")
+	flag.BoolVar(&configRetryFailedSteps, "retry-failed-steps", false, "Re-run only the failed steps of requests recorded in the ledger, without creating any requests")
 	flag.Parse()
 }
 
@@ -242,6 +267,7 @@ func getRequestPrefix(callclass string) string {
 		logger(4, "Unable to attach to XMLMC session to get Request Prefix. Using default ["+callclass+"].", false)
 		return callclass
 	}
+	defer releaseInstanceSession(espXmlmc)
 
 	strSetting := ""
 	callclass = strings.ToLower(callclass)
@@ -262,7 +288,7 @@ func getRequestPrefix(callclass string) string {
 
 	espXmlmc.SetParam("appName", appServiceManager)
 	espXmlmc.SetParam("filter", strSetting)
-	response, err := espXmlmc.Invoke("session", "getApplicationOption")
+	response, err := invokeXmlmc(espXmlmc, "session", "getApplicationOption")
 	if err != nil {
 		logger(4, "Could not retrieve System Setting for Request Prefix. Using default ["+callclass+"].", false)
 		return callclass
@@ -4,6 +4,7 @@ import (
 	"bytes"
 	"encoding/xml"
 	"fmt"
+	"sort"
 	"strconv"
 	"strings"
 
@@ -14,15 +15,217 @@ import (
 )
 
 //applyHistoricalUpdates - takes call diary records from Supportworks, imports to Hornbill as Historical Updates
-func applyHistoricalUpdates(request RequestReferences, espXmlmc *apiLib.XmlmcInstStruct, buffer *bytes.Buffer) {
+//Diary records already imported against the request, keyed by their udindex, are skipped so the import can be re-run safely.
+//Returns false if any diary record could not be imported
+func applyHistoricalUpdates(request RequestReferences, stepData *requestStepDataStruct, espXmlmc *apiLib.XmlmcInstStruct, buffer *bytes.Buffer) bool {
 
 	smCallRef := request.SmCallID
 	swCallRef := request.SwCallID
 
+	importedIndexes, indexesOK := getImportedUpdateIndexes(smCallRef, stepData, espXmlmc, buffer)
+	if !indexesOK {
+		//Importing without knowing what is already there would duplicate the call diary
+		return false
+	}
+
+	diaryEntries, errCount, diaryOK := getCallDiary(swCallRef, buffer)
+	if !diaryOK {
+		return false
+	}
+	sucCount := 0
+	skipCount := 0
+	//Process each call diary entry, insert in to Hornbill
+	for _, diaryEntry := range diaryEntries {
+		//Update Time - read using the SourceFormat and SourceTimeZone of h_updatedate, EPOCH seconds by default
+		diaryTimeFormat := getFieldFormat("h_updatedate")
+		diaryTime := convertDateValue(formatColumnValue(diaryEntry["updatetimex"], fieldFormatStruct{DateFormat: "rfc3339", SourceTimeZone: diaryTimeFormat.SourceTimeZone}), diaryTimeFormat)
+
+		//Column values of any type are converted to text, nil values are returned empty
+		diarySource := formatColumnValue(diaryEntry["udsource"], getFieldFormat("h_actionsource"))
+		diaryCode := formatColumnValue(diaryEntry["udcode"], getFieldFormat("h_actiontype"))
+		diaryText := formatColumnValue(diaryEntry["updatetxt"], getFieldFormat("h_description"))
+		diaryIndex := formatColumnValue(diaryEntry["udindex"], fieldFormatStruct{})
+		diaryIndexInt, diaryIndexErr := strconv.Atoi(diaryIndex)
+		if diaryIndexErr == nil && importedIndexes[diaryIndexInt] {
+			//Already imported by a previous run
+			skipCount++
+			continue
+		}
+		diaryTimeSpent := formatColumnValue(diaryEntry["timespent"], getFieldFormat("h_timespent"))
+		diaryType := formatColumnValue(diaryEntry["udtype"], getFieldFormat("h_updatetype"))
+		diaryAnalyst := formatColumnValue(diaryEntry["repid"], getFieldFormat("h_updateby"))
+		diaryGroup := formatColumnValue(diaryEntry["groupid"], getFieldFormat("h_updatebygroup"))
+
+		//Fields in HistoricUpdateMapping replace the values taken from the call diary
+		diaryTime = getHistoricUpdateValue("h_updatedate", diaryTime, diaryEntry)
+		diaryTimeSpent = getHistoricUpdateValue("h_timespent", diaryTimeSpent, diaryEntry)
+		diaryType = getHistoricUpdateValue("h_updatetype", diaryType, diaryEntry)
+		diaryUpdateByType := getHistoricUpdateValue("h_updatebytype", "1", diaryEntry)
+		diaryUpdateBy := getHistoricUpdateValue("h_updateby", diaryAnalyst, diaryEntry)
+		diaryUpdateByName := getHistoricUpdateValue("h_updatebyname", diaryAnalyst, diaryEntry)
+		diaryGroup = getHistoricUpdateValue("h_updatebygroup", diaryGroup, diaryEntry)
+		diaryCode = getHistoricUpdateValue("h_actiontype", diaryCode, diaryEntry)
+		diarySource = getHistoricUpdateValue("h_actionsource", diarySource, diaryEntry)
+		diaryText = getHistoricUpdateValue("h_description", diaryText, diaryEntry)
+
+		espXmlmc.SetParam("application", appServiceManager)
+		espXmlmc.SetParam("entity", "RequestHistoricUpdates")
+		espXmlmc.OpenElement("primaryEntityData")
+		espXmlmc.OpenElement("record")
+		espXmlmc.SetParam("h_fk_reference", smCallRef)
+		espXmlmc.SetParam("h_updatedate", diaryTime)
+		if diaryTimeSpent != "" && diaryTimeSpent != "0" {
+			espXmlmc.SetParam("h_timespent", diaryTimeSpent)
+		}
+		if diaryType != "" {
+			espXmlmc.SetParam("h_updatetype", diaryType)
+		}
+		espXmlmc.SetParam("h_updatebytype", diaryUpdateByType)
+		espXmlmc.SetParam("h_updateindex", diaryIndex)
+		if diaryUpdateBy != "" {
+			espXmlmc.SetParam("h_updateby", diaryUpdateBy)
+		}
+		if diaryUpdateByName != "" {
+			espXmlmc.SetParam("h_updatebyname", diaryUpdateByName)
+		}
+		if diaryGroup != "" {
+			espXmlmc.SetParam("h_updatebygroup", diaryGroup)
+		}
+		if diaryCode != "" {
+			espXmlmc.SetParam("h_actiontype", diaryCode)
+		}
+		if diarySource != "" {
+			espXmlmc.SetParam("h_actionsource", diarySource)
+		}
+		if diaryText != "" {
+			espXmlmc.SetParam("h_description", diaryText)
+		}
+		for _, fieldName := range getHistoricUpdateExtraFields() {
+			if fieldValue := getMappedFieldValue(fieldName, fmt.Sprintf("%v", swImportConf.HistoricUpdateMapping[fieldName]), diaryEntry); fieldValue != "" {
+				espXmlmc.SetParam(fieldName, fieldValue)
+			}
+		}
+		espXmlmc.CloseElement("record")
+		espXmlmc.CloseElement("primaryEntityData")
+
+		if configDebug {
+			buffer.WriteString(loggerGen(3, "XMLMC data::entityAddRecord::RequestHistoricUpdates: "+espXmlmc.GetParam()))
+		}
+		XMLUpdate, xmlmcErr := invokeXmlmc(espXmlmc, "data", "entityAddRecord")
+		if xmlmcErr != nil {
+			buffer.WriteString(loggerGen(3, "API Invoke Failed Unable to add Historical Call Diary Update: "+xmlmcErr.Error()))
+			errCount++
+			continue
+		}
+		var xmlRespon xmlmcResponse
+		errXMLMC := xml.Unmarshal([]byte(XMLUpdate), &xmlRespon)
+		if errXMLMC != nil {
+			buffer.WriteString(loggerGen(4, "Unable to read response from Hornbill instance: "+errXMLMC.Error()))
+			errCount++
+			continue
+		}
+		if xmlRespon.MethodResult != "ok" {
+			buffer.WriteString(loggerGen(3, "API Call Failed Unable to add Historical Call Diary Update: "+xmlRespon.State.ErrorRet))
+			errCount++
+			continue
+		}
+		sucCount++
+		if diaryIndexErr == nil {
+			importedIndexes[diaryIndexInt] = true
+		}
+	}
+	buffer.WriteString(loggerGen(1, strconv.Itoa(sucCount)+" of "+strconv.Itoa(sucCount+errCount)+" Historic Update records created"))
+	if skipCount > 0 {
+		buffer.WriteString(loggerGen(1, strconv.Itoa(skipCount)+" Historic Update records already imported, skipped"))
+	}
+	if stepData != nil {
+		stepData.UpdateIndexes = make([]int, 0, len(importedIndexes))
+		for updateIndex := range importedIndexes {
+			stepData.UpdateIndexes = append(stepData.UpdateIndexes, updateIndex)
+		}
+		sort.Ints(stepData.UpdateIndexes)
+	}
+	return errCount == 0
+}
+
+// historicUpdateFields - the Historic Update fields the tool sets from the call diary, which HistoricUpdateMapping can replace
+var historicUpdateFields = map[string]bool{
+	"h_fk_reference":  true,
+	"h_updatedate":    true,
+	"h_timespent":     true,
+	"h_updatetype":    true,
+	"h_updatebytype":  true,
+	"h_updateindex":   true,
+	"h_updateby":      true,
+	"h_updatebyname":  true,
+	"h_updatebygroup": true,
+	"h_actiontype":    true,
+	"h_actionsource":  true,
+	"h_description":   true,
+}
+
+//getHistoricUpdateValue - returns the value of a Historic Update field from HistoricUpdateMapping, evaluated against the
+//call diary entry, or the value taken from the call diary if the field is not mapped
+func getHistoricUpdateValue(fieldName, diaryValue string, diaryEntry map[string]interface{}) string {
+	if swImportConf.HistoricUpdateMapping[fieldName] == nil {
+		return diaryValue
+	}
+	return getMappedFieldValue(fieldName, fmt.Sprintf("%v", swImportConf.HistoricUpdateMapping[fieldName]), diaryEntry)
+}
+
+//getHistoricUpdateExtraFields - returns the fields in HistoricUpdateMapping that the tool doesn't otherwise set, in name order
+func getHistoricUpdateExtraFields() []string {
+	extraFields := make([]string, 0)
+	for fieldName := range swImportConf.HistoricUpdateMapping {
+		if !historicUpdateFields[fieldName] {
+			extraFields = append(extraFields, fieldName)
+		}
+	}
+	sort.Strings(extraFields)
+	return extraFields
+}
+
+//getImportedUpdateIndexes - returns the call diary udindexes already imported as Historic Updates against a request.
+//These are taken from the ledger when known, otherwise from the Historic Updates held on the instance
+func getImportedUpdateIndexes(smCallRef string, stepData *requestStepDataStruct, espXmlmc *apiLib.XmlmcInstStruct, buffer *bytes.Buffer) (map[int]bool, bool) {
+	importedIndexes := make(map[int]bool)
+	if stepData != nil && stepData.UpdateIndexes != nil {
+		for _, updateIndex := range stepData.UpdateIndexes {
+			importedIndexes[updateIndex] = true
+		}
+		return importedIndexes, true
+	}
+	updateIndexes, err := browseEntityColumnPages("RequestHistoricUpdates", "h_fk_reference", smCallRef, "h_updateindex", espXmlmc)
+	if err != nil {
+		buffer.WriteString(loggerGen(4, "Unable to retrieve existing Historic Updates for ["+smCallRef+"]: "+err.Error()))
+		return importedIndexes, false
+	}
+	for _, updateIndex := range updateIndexes {
+		if updateIndexInt, err := strconv.Atoi(updateIndex); err == nil {
+			importedIndexes[updateIndexInt] = true
+		}
+	}
+	return importedIndexes, true
+}
+
+//getCallDiary - returns the call diary entries of a Supportworks call, from the import archive or the Supportworks database,
+//along with the number of entries that could not be read
+func getCallDiary(swCallRef string, buffer *bytes.Buffer) ([]map[string]interface{}, int, bool) {
+	if configImportArchive != "" {
+		diaryEntries, errCount := archiveCallDiary(swCallRef)
+		return diaryEntries, errCount, true
+	}
+	return queryCallDiary(swCallRef, buffer)
+}
+
+//queryCallDiary - runs the CallDiaryQuery for a Supportworks call, returning the call diary entries
+//along with the number of entries that could not be read
+func queryCallDiary(swCallRef string, buffer *bytes.Buffer) ([]map[string]interface{}, int, bool) {
+	diaryEntries := make([]map[string]interface{}, 0)
 	db2, err := sqlx.Open(appDBDriver, connStrAppDB)
 	if err != nil {
 		logger(4, "[DATABASE] Database Connection Error: "+err.Error(), true)
-		return
+		return diaryEntries, 0, false
 	}
 	defer db2.Close()
 	diaryQuery := strings.ReplaceAll(swImportConf.CallDiaryQuery, "[sourceref]", swCallRef)
@@ -36,130 +239,20 @@ func applyHistoricalUpdates(request RequestReferences, espXmlmc *apiLib.XmlmcIns
 	rows, err := db2.Queryx(diaryQuery)
 	if err != nil {
 		buffer.WriteString(loggerGen(4, " Database Query Error: "+err.Error()))
-		return
+		return diaryEntries, 0, false
 	}
 	defer rows.Close()
-	sucCount := 0
 	errCount := 0
-	//Process each call diary entry, insert in to Hornbill
 	for rows.Next() {
 		diaryEntry := make(map[string]interface{})
 		err = rows.MapScan(diaryEntry)
 		if err != nil {
 			buffer.WriteString(loggerGen(4, "Unable to retrieve data from SQL query: "+err.Error()))
 			errCount++
-		} else {
-			//Update Time - EPOCH to Date/Time Conversion
-			diaryTime := ""
-			if diaryEntry["updatetimex"] != nil {
-				diaryTimex := ""
-				if updateTime, ok := diaryEntry["updatetimex"].(int64); ok {
-					diaryTimex = strconv.FormatInt(updateTime, 10)
-				} else {
-					diaryTimex = fmt.Sprintf("%+s", diaryEntry["updatetimex"])
-				}
-				diaryTime = epochToDateTime(diaryTimex)
-			}
-
-			//Check for source/code/text having nil value
-			diarySource := ""
-			if diaryEntry["udsource"] != nil {
-				diarySource = fmt.Sprintf("%+s", diaryEntry["udsource"])
-			}
-
-			diaryCode := ""
-			if diaryEntry["udcode"] != nil {
-				diaryCode = fmt.Sprintf("%+s", diaryEntry["udcode"])
-			}
-
-			diaryText := ""
-			if diaryEntry["updatetxt"] != nil {
-				diaryText = fmt.Sprintf("%+s", diaryEntry["updatetxt"])
-			}
-
-			diaryIndex := ""
-			if diaryEntry["udindex"] != nil {
-				if updateIndex, ok := diaryEntry["udindex"].(int64); ok {
-					diaryIndex = strconv.FormatInt(updateIndex, 10)
-				} else {
-					diaryIndex = fmt.Sprintf("%+s", diaryEntry["udindex"])
-				}
-			}
-
-			diaryTimeSpent := ""
-			if diaryEntry["timespent"] != nil {
-				if updateSpent, ok := diaryEntry["timespent"].(int64); ok {
-					diaryTimeSpent = strconv.FormatInt(updateSpent, 10)
-				} else {
-					diaryTimeSpent = fmt.Sprintf("%+s", diaryEntry["timespent"])
-				}
-			}
-
-			diaryType := ""
-			if diaryEntry["udtype"] != nil {
-				if updateType, ok := diaryEntry["udtype"].(int64); ok {
-					diaryType = strconv.FormatInt(updateType, 10)
-				} else {
-					diaryType = fmt.Sprintf("%+s", diaryEntry["udtype"])
-				}
-			}
-
-			espXmlmc.SetParam("application", appServiceManager)
-			espXmlmc.SetParam("entity", "RequestHistoricUpdates")
-			espXmlmc.OpenElement("primaryEntityData")
-			espXmlmc.OpenElement("record")
-			espXmlmc.SetParam("h_fk_reference", smCallRef)
-			espXmlmc.SetParam("h_updatedate", diaryTime)
-			if diaryTimeSpent != "" && diaryTimeSpent != "0" {
-				espXmlmc.SetParam("h_timespent", diaryTimeSpent)
-			}
-			if diaryType != "" {
-				espXmlmc.SetParam("h_updatetype", diaryType)
-			}
-			espXmlmc.SetParam("h_updatebytype", "1")
-			espXmlmc.SetParam("h_updateindex", diaryIndex)
-			if diaryEntry["repid"] != nil {
-				espXmlmc.SetParam("h_updateby", fmt.Sprintf("%+s", diaryEntry["repid"]))
-			}
-			if diaryEntry["repid"] != nil {
-				espXmlmc.SetParam("h_updatebyname", fmt.Sprintf("%+s", diaryEntry["repid"]))
-			}
-			if diaryEntry["groupid"] != nil {
-				espXmlmc.SetParam("h_updatebygroup", fmt.Sprintf("%+s", diaryEntry["groupid"]))
-			}
-			if diaryCode != "" {
-				espXmlmc.SetParam("h_actiontype", diaryCode)
-			}
-			if diarySource != "" {
-				espXmlmc.SetParam("h_actionsource", diarySource)
-			}
-			if diaryText != "" {
-				espXmlmc.SetParam("h_description", diaryText)
-			}
-			espXmlmc.CloseElement("record")
-			espXmlmc.CloseElement("primaryEntityData")
-
-			if configDebug {
-				buffer.WriteString(loggerGen(3, "XMLMC data::entityAddRecord::RequestHistoricUpdates: "+espXmlmc.GetParam()))
-			}
-			XMLUpdate, xmlmcErr := espXmlmc.Invoke("data", "entityAddRecord")
-			if xmlmcErr != nil {
-				buffer.WriteString(loggerGen(3, "API Invoke Failed Unable to add Historical Call Diary Update: "+xmlmcErr.Error()))
-				errCount++
-			}
-			var xmlRespon xmlmcResponse
-			errXMLMC := xml.Unmarshal([]byte(XMLUpdate), &xmlRespon)
-			if errXMLMC != nil {
-				buffer.WriteString(loggerGen(4, "Unable to read response from Hornbill instance: "+errXMLMC.Error()))
-				errCount++
-			}
-			if xmlRespon.MethodResult != "ok" {
-				buffer.WriteString(loggerGen(3, "API Call Failed Unable to add Historical Call Diary Update: "+xmlRespon.State.ErrorRet))
-				errCount++
-			}
-			sucCount++
-
+			continue
 		}
+		sanitiseRow(diaryEntry, swImportConf.SWAppDBConf.Encoding)
+		diaryEntries = append(diaryEntries, diaryEntry)
 	}
-	buffer.WriteString(loggerGen(1, strconv.Itoa(sucCount)+" of "+strconv.Itoa(sucCount+errCount)+" Historic Update records created"))
+	return diaryEntries, errCount, true
 }
@@ -4,7 +4,9 @@ import (
 	"bytes"
 	"encoding/base64"
 	"encoding/xml"
+	"errors"
 	"fmt"
+	"strconv"
 
 	/* non core libraries */
 	apiLib "github.com/hornbill/goApiLib"
@@ -16,7 +18,7 @@ func espLogger(message, severity string) {
 	espXmlmc.SetParam("group", "general")
 	espXmlmc.SetParam("severity", severity)
 	espXmlmc.SetParam("message", message)
-	espXmlmc.Invoke("system", "logMessage")
+	invokeXmlmc(espXmlmc, "system", "logMessage")
 }
 
 //doesUserExist takes an User ID string and returns a true if one exists in the cache or on the Instance
@@ -31,7 +33,7 @@ func doesUserExist(userID string, espXmlmc *apiLib.XmlmcInstStruct, buffer *byte
 			//Get Analyst Info
 			espXmlmc.SetParam("userId", userID)
 
-			XMLAnalystSearch, xmlmcErr := espXmlmc.Invoke("admin", "userGetInfo")
+			XMLAnalystSearch, xmlmcErr := invokeXmlmc(espXmlmc, "admin", "userGetInfo")
 			if xmlmcErr != nil {
 				buffer.WriteString(loggerGen(4, "Unable to Search for User ["+userID+"]: "+xmlmcErr.Error()))
 			}
@@ -85,7 +87,7 @@ func doesContactExist(contactID string, espXmlmc *apiLib.XmlmcInstStruct, buffer
 		espXmlmc.SetParam("matchType", "exact")
 		espXmlmc.CloseElement("searchFilter")
 		espXmlmc.SetParam("maxResults", "1")
-		XMLCustomerSearch, xmlmcErr := espXmlmc.Invoke("data", "entityBrowseRecords2")
+		XMLCustomerSearch, xmlmcErr := invokeXmlmc(espXmlmc, "data", "entityBrowseRecords2")
 		if xmlmcErr != nil {
 			buffer.WriteString(loggerGen(4, "Unable to Search for Contact ["+contactID+"]: "+xmlmcErr.Error()))
 		}
@@ -128,7 +130,7 @@ func NewEspXmlmcSession() (*apiLib.XmlmcInstStruct, error) {
 	if swImportConf.HBConf.APIKey != "" {
 		espXmlmcLocal.SetAPIKey(swImportConf.HBConf.APIKey)
 	} else {
-		espXmlmcLocal.SetSessionID(espXmlmc.GetSessionID())
+		setInstanceSession(espXmlmcLocal)
 	}
 	return espXmlmcLocal, nil
 }
@@ -141,7 +143,7 @@ func login() bool {
 
 	espXmlmc.SetParam("userId", swImportConf.HBConf.UserName)
 	espXmlmc.SetParam("password", base64.StdEncoding.EncodeToString([]byte(swImportConf.HBConf.Password)))
-	XMLLogin, xmlmcErr := espXmlmc.Invoke("session", "userLogon")
+	XMLLogin, xmlmcErr := invokeXmlmc(espXmlmc, "session", "userLogon")
 	if xmlmcErr != nil {
 		logger(4, "Unable to Login: "+xmlmcErr.Error(), true)
 		return false
@@ -157,6 +159,7 @@ func login() bool {
 		logger(4, "Unable to Login: "+xmlRespon.State.ErrorRet, true)
 		return false
 	}
+	startSession(espXmlmc)
 	espLogger("---- Supportworks Call Import Utility V"+fmt.Sprintf("%v", version)+" ----", "debug")
 	espLogger("Logged In As: "+swImportConf.HBConf.UserName, "debug")
 	return true
@@ -172,5 +175,72 @@ func logout() {
 	espLogger("Time Taken: "+fmt.Sprintf("%v", endTime), "debug")
 	espLogger("---- Supportworks Call Import Complete ---- ", "debug")
 	logger(1, "Logout", true)
-	espXmlmc.Invoke("session", "userLogoff")
+	invokeXmlmc(espXmlmc, "session", "userLogoff")
+}
+
+//browseEntityColumnPages - pages through the Service Manager entity records matching the filter, returning the values
+//of a single column from every record
+func browseEntityColumnPages(entityName, filterColumn, filterValue, valueColumn string, espXmlmc *apiLib.XmlmcInstStruct) ([]string, error) {
+	columnValues := make([]string, 0)
+	for rowStart := 0; ; rowStart += entityBrowsePageSize {
+		pageValues, rowCount, err := browseEntityColumnPage(entityName, filterColumn, filterValue, valueColumn, entityBrowsePageSize, rowStart, espXmlmc)
+		if err != nil {
+			return columnValues, err
+		}
+		columnValues = append(columnValues, pageValues...)
+		if rowCount < entityBrowsePageSize {
+			//A short page is the last
+			return columnValues, nil
+		}
+	}
+}
+
+//browseEntityColumn - returns the values of a single column from the first maxResults Service Manager entity records
+//matching the filter
+func browseEntityColumn(entityName, filterColumn, filterValue, valueColumn string, maxResults int, espXmlmc *apiLib.XmlmcInstStruct) ([]string, error) {
+	columnValues, _, err := browseEntityColumnPage(entityName, filterColumn, filterValue, valueColumn, maxResults, 0, espXmlmc)
+	return columnValues, err
+}
+
+//browseEntityColumnPage - returns the values of a single column from a page of the Service Manager entity records
+//matching the filter, along with the number of records in the page. Records are ordered by the value column, so that
+//each rowStart continues from where the previous page ended
+func browseEntityColumnPage(entityName, filterColumn, filterValue, valueColumn string, maxResults, rowStart int, espXmlmc *apiLib.XmlmcInstStruct) ([]string, int, error) {
+	columnValues := make([]string, 0)
+	espXmlmc.SetParam("application", appServiceManager)
+	espXmlmc.SetParam("entity", entityName)
+	espXmlmc.SetParam("matchScope", "all")
+	espXmlmc.OpenElement("searchFilter")
+	espXmlmc.SetParam("column", filterColumn)
+	espXmlmc.SetParam("value", filterValue)
+	espXmlmc.SetParam("matchType", "exact")
+	espXmlmc.CloseElement("searchFilter")
+	espXmlmc.SetParam("maxResults", strconv.Itoa(maxResults))
+	if rowStart > 0 {
+		espXmlmc.SetParam("rowstart", strconv.Itoa(rowStart))
+	}
+	espXmlmc.OpenElement("orderBy")
+	espXmlmc.SetParam("column", valueColumn)
+	espXmlmc.SetParam("direction", "ascending")
+	espXmlmc.CloseElement("orderBy")
+	XMLBrowse, xmlmcErr := invokeXmlmc(espXmlmc, "data", "entityBrowseRecords2")
+	if xmlmcErr != nil {
+		return columnValues, 0, xmlmcErr
+	}
+	var xmlRespon xmlmcEntityRowsResponse
+	err := xml.Unmarshal([]byte(XMLBrowse), &xmlRespon)
+	if err != nil {
+		return columnValues, 0, err
+	}
+	if xmlRespon.MethodResult != "ok" {
+		return columnValues, 0, errors.New(xmlRespon.State.ErrorRet)
+	}
+	for _, row := range xmlRespon.Rows {
+		for _, column := range row.Columns {
+			if column.XMLName.Local == valueColumn && column.Value != "" {
+				columnValues = append(columnValues, column.Value)
+			}
+		}
+	}
+	return columnValues, len(xmlRespon.Rows), nil
 }
@@ -0,0 +1,326 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Ledger step names and statuses
+const (
+	stepCreate        = "create"
+	stepActivity      = "activity"
+	stepLogDate       = "logdate"
+	stepStatusHistory = "statushistory"
+	stepBPM           = "bpm"
+	stepHold          = "hold"
+	stepHistoric      = "historicupdates"
+	stepAttachments   = "attachments"
+
+	stepStatusOK         = "ok"
+	stepStatusFailed     = "failed"
+	stepStatusSkipped    = "skipped"
+	stepStatusPending    = "pending"
+	stepStatusRolledBack = "rolledback"
+)
+
+var (
+	ledgerEntries = make(map[string]*ledgerEntryStruct)
+	ledgerFile    *os.File
+	mutexLedger   = &sync.Mutex{}
+)
+
+// ledgerEntryStruct - one line of the on-disk ledger, recording the Supportworks to Hornbill mapping for a request.
+// RunID is the run that created (or adopted) the request
+type ledgerEntryStruct struct {
+	RunID        string
+	SwCallRef    string
+	SmCallRef    string
+	CallClass    string
+	Adopted      bool `json:",omitempty"`
+	Timestamp    string
+	Steps        map[string]string
+	StepData     *requestStepDataStruct `json:",omitempty"`
+	Associations []refStruct            `json:",omitempty"`
+	//Attachments are the outcomes of each file attached to the request, by attachment key
+	Attachments map[string]string `json:",omitempty"`
+}
+
+// requestStepDataStruct - the values needed to re-run the post-create steps of a request
+type requestStepDataStruct struct {
+	Status        string
+	LoggedDate    string
+	UpdateLogDate bool
+	ClosedDate    string
+	OnHold        bool
+	ServiceBPM    string
+	BPMID         string
+	//UpdateIndexes are the call diary udindexes imported as Historic Updates. Nil when not known
+	UpdateIndexes []int `json:",omitempty"`
+}
+
+// getLedgerPath - returns the full path to the ledger file in use
+func getLedgerPath() string {
+	cwd, _ := os.Getwd()
+	return cwd + "/ledger/" + configLedgerFile
+}
+
+// openLedger - loads any existing ledger entries, then opens the ledger file for appending.
+// In a dry run the ledger is loaded, but nothing is written to it
+func openLedger() bool {
+	cwd, _ := os.Getwd()
+	ledgerPath := cwd + "/ledger"
+	if _, err := os.Stat(ledgerPath); os.IsNotExist(err) {
+		err := os.Mkdir(ledgerPath, 0777)
+		if err != nil {
+			logger(4, "Error Creating Ledger Folder "+ledgerPath+": "+err.Error(), true)
+			return false
+		}
+	}
+	if !loadLedger() {
+		return false
+	}
+	if configDryRun {
+		return true
+	}
+	var err error
+	ledgerFile, err = os.OpenFile(getLedgerPath(), os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0777)
+	if err != nil {
+		logger(4, "Error Opening Ledger File "+getLedgerPath()+": "+err.Error(), true)
+		return false
+	}
+	return true
+}
+
+// closeLedger - closes the ledger file
+func closeLedger() {
+	mutexLedger.Lock()
+	defer mutexLedger.Unlock()
+	if ledgerFile != nil {
+		ledgerFile.Sync()
+		ledgerFile.Close()
+		ledgerFile = nil
+	}
+}
+
+// checkpointLedger - flushes the ledger to disk, so a later run can resume from it
+func checkpointLedger() {
+	mutexLedger.Lock()
+	defer mutexLedger.Unlock()
+	if ledgerFile == nil {
+		return
+	}
+	if err := ledgerFile.Sync(); err != nil {
+		logger(4, "Unable to flush ledger "+getLedgerPath()+": "+err.Error(), true)
+	}
+}
+
+// loadLedger - reads the ledger file in to memory. Later lines for the same Supportworks reference update earlier ones
+func loadLedger() bool {
+	file, err := os.Open(getLedgerPath())
+	if err != nil {
+		if os.IsNotExist(err) {
+			return true
+		}
+		logger(4, "Error Opening Ledger File "+getLedgerPath()+": "+err.Error(), true)
+		return false
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(make([]byte, 64*1024), 16*1024*1024)
+	lineCount := 0
+	for scanner.Scan() {
+		lineCount++
+		if len(scanner.Bytes()) == 0 {
+			continue
+		}
+		var entry ledgerEntryStruct
+		err := json.Unmarshal(scanner.Bytes(), &entry)
+		if err != nil {
+			logger(5, "Skipping unreadable ledger line "+strconv.Itoa(lineCount)+": "+err.Error(), false)
+			continue
+		}
+		mergeLedgerEntry(entry)
+	}
+	if err := scanner.Err(); err != nil {
+		logger(4, "Error Reading Ledger File "+getLedgerPath()+": "+err.Error(), true)
+		return false
+	}
+	logger(1, "Loaded "+strconv.Itoa(len(ledgerEntries))+" request(s) from ledger "+getLedgerPath(), true)
+	return true
+}
+
+// mergeLedgerEntry - merges an entry in to the in-memory ledger. Caller must hold mutexLedger if workers are running
+func mergeLedgerEntry(entry ledgerEntryStruct) *ledgerEntryStruct {
+	existing, ok := ledgerEntries[entry.SwCallRef]
+	if !ok {
+		if entry.Steps == nil {
+			entry.Steps = make(map[string]string)
+		}
+		entry.Associations = append([]refStruct(nil), entry.Associations...)
+		attachments := make(map[string]string)
+		for attachmentKey, status := range entry.Attachments {
+			attachments[attachmentKey] = status
+		}
+		entry.Attachments = attachments
+		ledgerEntries[entry.SwCallRef] = &entry
+		return &entry
+	}
+	if entry.SmCallRef != "" {
+		existing.RunID = entry.RunID
+		existing.SmCallRef = entry.SmCallRef
+	}
+	if entry.CallClass != "" {
+		existing.CallClass = entry.CallClass
+	}
+	if entry.Adopted {
+		existing.Adopted = true
+	}
+	if entry.Timestamp != "" {
+		existing.Timestamp = entry.Timestamp
+	}
+	for step, status := range entry.Steps {
+		existing.Steps[step] = status
+	}
+	if entry.StepData != nil {
+		existing.StepData = entry.StepData
+	}
+	existing.Associations = append(existing.Associations, entry.Associations...)
+	if existing.Attachments == nil {
+		existing.Attachments = make(map[string]string)
+	}
+	for attachmentKey, status := range entry.Attachments {
+		existing.Attachments[attachmentKey] = status
+	}
+	return existing
+}
+
+// writeLedgerEntry - merges the entry in to the in-memory ledger, and appends it to the ledger file
+func writeLedgerEntry(entry ledgerEntryStruct) {
+	entry.RunID = timeNow
+	entry.Timestamp = time.Now().UTC().Format(time.RFC3339)
+	mutexLedger.Lock()
+	defer mutexLedger.Unlock()
+	mergeLedgerEntry(entry)
+	if ledgerFile == nil {
+		return
+	}
+	ledgerLine, err := json.Marshal(entry)
+	if err != nil {
+		logger(4, "Unable to marshal ledger entry for ["+entry.SwCallRef+"]: "+err.Error(), false)
+		return
+	}
+	_, err = ledgerFile.Write(append(ledgerLine, '\n'))
+	if err != nil {
+		logger(4, "Unable to write ledger entry for ["+entry.SwCallRef+"]: "+err.Error(), false)
+	}
+}
+
+// recordLedgerStep - records the outcome of a single step against a request in the ledger
+func recordLedgerStep(swCallRef, step string, success bool) {
+	status := stepStatusOK
+	if !success {
+		status = stepStatusFailed
+	}
+	writeLedgerEntry(ledgerEntryStruct{SwCallRef: swCallRef, Steps: map[string]string{step: status}})
+}
+
+// recordLedgerAttachment - records the outcome of attaching a single file to a request in the ledger
+func recordLedgerAttachment(swCallRef, attachmentKey string, success bool) {
+	status := stepStatusOK
+	if !success {
+		status = stepStatusFailed
+	}
+	writeLedgerEntry(ledgerEntryStruct{SwCallRef: swCallRef, Attachments: map[string]string{attachmentKey: status}})
+}
+
+// ledgerAttachmentAdded - returns true if the file has already been attached to the request
+func ledgerAttachmentAdded(swCallRef, attachmentKey string) bool {
+	mutexLedger.Lock()
+	defer mutexLedger.Unlock()
+	entry, ok := ledgerEntries[swCallRef]
+	return ok && entry.Attachments[attachmentKey] == stepStatusOK
+}
+
+// ledgerStepStatus - returns the recorded status of a step for a request, and whether the request is in the ledger at all
+func ledgerStepStatus(swCallRef, step string) (string, bool) {
+	mutexLedger.Lock()
+	defer mutexLedger.Unlock()
+	entry, ok := ledgerEntries[swCallRef]
+	if !ok {
+		return "", false
+	}
+	return entry.Steps[step], true
+}
+
+// recordLedgerAssociation - records a request association created in the ledger, against both the master and the slave
+// request, so it is removed whichever of them is rolled back
+func recordLedgerAssociation(swMasterRef, swSlaveRef string, assoc refStruct) {
+	writeLedgerEntry(ledgerEntryStruct{SwCallRef: swMasterRef, Associations: []refStruct{assoc}})
+	writeLedgerEntry(ledgerEntryStruct{SwCallRef: swSlaveRef, Associations: []refStruct{assoc}})
+}
+
+// callInLedger - returns true if the Supportworks call has already been logged as a Hornbill request
+func callInLedger(swCallRef string) bool {
+	mutexLedger.Lock()
+	defer mutexLedger.Unlock()
+	entry, ok := ledgerEntries[swCallRef]
+	return ok && entry.SmCallRef != "" && entry.Steps[stepCreate] == stepStatusOK
+}
+
+// ledgerCallRef - returns the Hornbill request reference for a Supportworks call that has already been logged
+func ledgerCallRef(swCallRef string) (string, bool) {
+	mutexLedger.Lock()
+	defer mutexLedger.Unlock()
+	entry, ok := ledgerEntries[swCallRef]
+	if !ok || entry.SmCallRef == "" || entry.Steps[stepCreate] != stepStatusOK {
+		return "", false
+	}
+	return entry.SmCallRef, true
+}
+
+// associationInLedger - returns true if the request association has already been recorded against the master call
+func associationInLedger(swMasterRef string, assoc refStruct) bool {
+	mutexLedger.Lock()
+	defer mutexLedger.Unlock()
+	entry, ok := ledgerEntries[swMasterRef]
+	if !ok {
+		return false
+	}
+	for _, ledgerAssoc := range entry.Associations {
+		if ledgerAssoc == assoc {
+			return true
+		}
+	}
+	return false
+}
+
+// requestRolledBack - returns true if the Hornbill request has been deleted by a rollback. Only the entry of the call that
+// created the request is checked, as calls that adopted the same request as a duplicate never delete it
+func requestRolledBack(smCallRef string) bool {
+	mutexLedger.Lock()
+	defer mutexLedger.Unlock()
+	for _, entry := range ledgerEntries {
+		if entry.SmCallRef == smCallRef && !entry.Adopted && entry.Steps[stepCreate] == stepStatusRolledBack {
+			return true
+		}
+	}
+	return false
+}
+
+// loadLedgerCallsLogged - populates arrCallsLogged from the ledger, so associations and attachments can be processed
+func loadLedgerCallsLogged() {
+	mutexLedger.Lock()
+	defer mutexLedger.Unlock()
+	mutexArrCallsLogged.Lock()
+	defer mutexArrCallsLogged.Unlock()
+	for swRef, entry := range ledgerEntries {
+		if entry.SmCallRef != "" && entry.Steps[stepCreate] == stepStatusOK {
+			arrCallsLogged[swRef] = entry.SmCallRef
+		}
+	}
+}
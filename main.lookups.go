@@ -0,0 +1,56 @@
+package main
+
+import (
+	"sort"
+	"strings"
+)
+
+// loadLookupTables - adds the rows of the CSV file set against each lookup table in LookupTables to its Values.
+// Returns false if a file cannot be read, or maps a source value that is already in the table
+func loadLookupTables() bool {
+	tableNames := make([]string, 0, len(swImportConf.LookupTables))
+	for tableName := range swImportConf.LookupTables {
+		tableNames = append(tableNames, tableName)
+	}
+	sort.Strings(tableNames)
+	boolLoaded := true
+	for _, tableName := range tableNames {
+		lookupTable := swImportConf.LookupTables[tableName]
+		if lookupTable.Values == nil {
+			lookupTable.Values = make(map[string]string)
+			swImportConf.LookupTables[tableName] = lookupTable
+		}
+		if lookupTable.File == "" {
+			continue
+		}
+		tableFile := mappingFileStruct{File: lookupTable.File, SourceColumn: lookupTable.SourceColumn, TargetColumn: lookupTable.TargetColumn}
+		tableLoaded := readMappingFile("Lookup Table "+tableName, tableFile, func(sourceValue, targetValue, callClass, rowDesc string) bool {
+			if existingValue, ok := lookupTable.Values[sourceValue]; ok {
+				logger(4, rowDesc+": source value \""+sourceValue+"\" is already mapped to \""+existingValue+"\" in the Values of the lookup table", true)
+				return false
+			}
+			lookupTable.Values[sourceValue] = targetValue
+			return true
+		})
+		if !tableLoaded {
+			boolLoaded = false
+		}
+	}
+	return boolLoaded
+}
+
+// lookupValue - returns the value a lookup table maps a source value to, or the Default of the table if the source
+// value is not in it. A source value is matched as it is, then with surrounding whitespace removed
+func lookupValue(tableName, sourceValue string) string {
+	lookupTable, ok := swImportConf.LookupTables[tableName]
+	if !ok {
+		return ""
+	}
+	if targetValue, ok := lookupTable.Values[sourceValue]; ok {
+		return targetValue
+	}
+	if targetValue, ok := lookupTable.Values[strings.TrimSpace(sourceValue)]; ok {
+		return targetValue
+	}
+	return lookupTable.Default
+}
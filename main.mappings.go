@@ -0,0 +1,268 @@
+package main
+
+import (
+	"encoding/csv"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// mappingNames - the mappings in the configuration file that can be loaded from a CSV file
+var mappingNames = []string{"PriorityMapping", "TeamMapping", "CategoryMapping", "ResolutionCategoryMapping", "ServiceMapping", "StatusMapping"}
+
+// classMappings - mapping entries from CSV files that only apply to one request class, by mapping name then
+// Service Manager request class
+var classMappings = make(map[string]map[string]map[string]interface{})
+
+// getConfigMapping - returns the mapping of the given name from the configuration file
+func getConfigMapping(mappingName string) map[string]interface{} {
+	switch mappingName {
+	case "PriorityMapping":
+		return swImportConf.PriorityMapping
+	case "TeamMapping":
+		return swImportConf.TeamMapping
+	case "CategoryMapping":
+		return swImportConf.CategoryMapping
+	case "ResolutionCategoryMapping":
+		return swImportConf.ResolutionCategoryMapping
+	case "ServiceMapping":
+		return swImportConf.ServiceMapping
+	case "StatusMapping":
+		return swImportConf.StatusMapping
+	}
+	return nil
+}
+
+// setConfigMapping - replaces the mapping of the given name in the configuration
+func setConfigMapping(mappingName string, mapping map[string]interface{}) {
+	switch mappingName {
+	case "PriorityMapping":
+		swImportConf.PriorityMapping = mapping
+	case "TeamMapping":
+		swImportConf.TeamMapping = mapping
+	case "CategoryMapping":
+		swImportConf.CategoryMapping = mapping
+	case "ResolutionCategoryMapping":
+		swImportConf.ResolutionCategoryMapping = mapping
+	case "ServiceMapping":
+		swImportConf.ServiceMapping = mapping
+	case "StatusMapping":
+		swImportConf.StatusMapping = mapping
+	}
+}
+
+// getMappedValue - returns the target of a source value in a mapping, for a request class. An entry scoped to the
+// class is used before one that applies to every class. Returns nil if the value is not mapped
+func getMappedValue(mappingName, callClass, sourceValue string) interface{} {
+	if classMappings[mappingName] != nil && classMappings[mappingName][callClass] != nil {
+		if mappedValue, ok := classMappings[mappingName][callClass][sourceValue]; ok {
+			return mappedValue
+		}
+	}
+	return getConfigMapping(mappingName)[sourceValue]
+}
+
+// loadMappingFiles - loads the CSV file set against each mapping in MappingFiles. Entries without a class are added to
+// the mapping in the configuration, and those with a class are only used for requests of that class.
+// Returns false if a file cannot be read, or contains duplicate or conflicting source values
+func loadMappingFiles() bool {
+	boolLoaded := true
+	for mappingName := range swImportConf.MappingFiles {
+		if !isMappingName(mappingName) {
+			logger(4, "MappingFiles contains an unknown mapping: "+mappingName+". Mappings that can be loaded from a file are: "+strings.Join(mappingNames, ", "), true)
+			boolLoaded = false
+		}
+	}
+	for _, mappingName := range mappingNames {
+		mappingFile, ok := swImportConf.MappingFiles[mappingName]
+		if ok && !loadMappingFile(mappingName, mappingFile) {
+			boolLoaded = false
+		}
+	}
+	return boolLoaded
+}
+
+// isMappingName - returns true if the name is a mapping that can be loaded from a file
+func isMappingName(mappingName string) bool {
+	for _, name := range mappingNames {
+		if name == mappingName {
+			return true
+		}
+	}
+	return false
+}
+
+// loadMappingFile - loads the source and target columns of a mapping CSV file, reporting every duplicate source value
+func loadMappingFile(mappingName string, mappingFile mappingFileStruct) bool {
+	if mappingFile.File == "" {
+		logger(4, "No File set for "+mappingName+" in MappingFiles", true)
+		return false
+	}
+	configMapping := getConfigMapping(mappingName)
+	if configMapping == nil {
+		configMapping = make(map[string]interface{})
+		setConfigMapping(mappingName, configMapping)
+	}
+	return readMappingFile(mappingName, mappingFile, func(sourceValue, targetValue, callClass, rowDesc string) bool {
+		//Rows with no target have not been mapped yet, such as those left blank in a -discover file
+		if targetValue == "" {
+			return true
+		}
+		if callClass == "" {
+			if existingValue, ok := configMapping[sourceValue]; ok && fmt.Sprintf("%v", existingValue) != targetValue {
+				logger(4, rowDesc+": source value \""+sourceValue+"\" is already mapped to \""+fmt.Sprintf("%v", existingValue)+"\" in the configuration file", true)
+				return false
+			}
+			configMapping[sourceValue] = targetValue
+			return true
+		}
+		if !isImportedCallClass(callClass) {
+			logger(5, rowDesc+": "+callClass+" is not a CallClass in RequestTypesToImport, so this row will not be used", false)
+		}
+		if classMappings[mappingName] == nil {
+			classMappings[mappingName] = make(map[string]map[string]interface{})
+		}
+		if classMappings[mappingName][callClass] == nil {
+			classMappings[mappingName][callClass] = make(map[string]interface{})
+		}
+		classMappings[mappingName][callClass][sourceValue] = targetValue
+		return true
+	})
+}
+
+// readMappingFile - reads the source, target and optional class columns of each row of a CSV file, passing them to
+// addRow along with a description of the row for logging. The same source value can only appear once for each class.
+// Returns false if the file cannot be read, has duplicate source values, or addRow rejects a row
+func readMappingFile(mappingName string, mappingFile mappingFileStruct, addRow func(sourceValue, targetValue, callClass, rowDesc string) bool) bool {
+	sourceColumn := mappingFile.SourceColumn
+	if sourceColumn == "" {
+		sourceColumn = "Source"
+	}
+	targetColumn := mappingFile.TargetColumn
+	if targetColumn == "" {
+		targetColumn = "Target"
+	}
+	filePath := mappingFile.File
+	if !filepath.IsAbs(filePath) {
+		cwd, _ := os.Getwd()
+		filePath = filepath.Join(cwd, filePath)
+	}
+	logger(1, "Loading "+mappingName+" from "+filePath, false)
+	csvFile, err := os.Open(filePath)
+	if err != nil {
+		logger(4, "Error Opening "+mappingName+" File: "+err.Error(), true)
+		return false
+	}
+	defer csvFile.Close()
+	csvReader := csv.NewReader(csvFile)
+	csvReader.FieldsPerRecord = -1
+
+	//Find the columns from the header row
+	header, err := csvReader.Read()
+	if err != nil {
+		logger(4, "Error Reading "+mappingName+" File "+filePath+": "+err.Error(), true)
+		return false
+	}
+	sourceIndex, targetIndex, classIndex, mappingIndex := -1, -1, -1, -1
+	for i, columnName := range header {
+		columnName = strings.TrimSpace(strings.TrimPrefix(columnName, "\ufeff"))
+		switch {
+		case strings.EqualFold(columnName, sourceColumn):
+			sourceIndex = i
+		case strings.EqualFold(columnName, targetColumn):
+			targetIndex = i
+		case mappingFile.ClassColumn != "" && strings.EqualFold(columnName, mappingFile.ClassColumn):
+			classIndex = i
+		case mappingFile.MappingColumn != "" && strings.EqualFold(columnName, mappingFile.MappingColumn):
+			mappingIndex = i
+		}
+	}
+	if sourceIndex == -1 || targetIndex == -1 || (mappingFile.ClassColumn != "" && classIndex == -1) || (mappingFile.MappingColumn != "" && mappingIndex == -1) {
+		logger(4, mappingName+" File "+filePath+" must have a header row containing the columns "+sourceColumn+" and "+targetColumn+optionalColumnDesc(mappingFile.ClassColumn, mappingFile.MappingColumn), true)
+		return false
+	}
+
+	fileLines := make(map[string]int)
+	boolLoaded := true
+	rowCount := 0
+	for {
+		record, err := csvReader.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			logger(4, "Error Reading "+mappingName+" File "+filePath+": "+err.Error(), true)
+			boolLoaded = false
+			continue
+		}
+		//A file holding several mappings, such as one written by -discover, names the mapping of each row
+		if mappingIndex != -1 && !strings.EqualFold(strings.TrimSpace(getCSVColumn(record, mappingIndex)), mappingName) {
+			continue
+		}
+		lineNumber, _ := csvReader.FieldPos(0)
+		rowDesc := mappingName + " File " + filePath + " line " + strconv.Itoa(lineNumber)
+		sourceValue := strings.TrimSpace(getCSVColumn(record, sourceIndex))
+		if sourceValue == "" {
+			continue
+		}
+		targetValue := strings.TrimSpace(getCSVColumn(record, targetIndex))
+		callClass := ""
+		if classIndex != -1 {
+			callClass = strings.TrimSpace(getCSVColumn(record, classIndex))
+		}
+
+		//The same source value can only be mapped once for each class
+		if firstLine, ok := fileLines[callClass+"\x00"+sourceValue]; ok {
+			scopeDesc := "\"" + sourceValue + "\""
+			if callClass != "" {
+				scopeDesc += " for " + callClass
+			}
+			logger(4, rowDesc+": duplicate source value "+scopeDesc+", first mapped on line "+strconv.Itoa(firstLine), true)
+			boolLoaded = false
+			continue
+		}
+		fileLines[callClass+"\x00"+sourceValue] = lineNumber
+		if !addRow(sourceValue, targetValue, callClass, rowDesc) {
+			boolLoaded = false
+			continue
+		}
+		rowCount++
+	}
+	if boolLoaded {
+		logger(1, "Loaded "+strconv.Itoa(rowCount)+" "+mappingName+" row(s) from "+filePath, true)
+	}
+	return boolLoaded
+}
+
+// getCSVColumn - returns a column of a CSV record, or an empty string if the record is too short
+func getCSVColumn(record []string, columnIndex int) string {
+	if columnIndex < len(record) {
+		return record[columnIndex]
+	}
+	return ""
+}
+
+// optionalColumnDesc - describes the optional class and mapping columns of a mapping file, when they are set
+func optionalColumnDesc(classColumn, mappingColumn string) string {
+	columnDesc := ""
+	if classColumn != "" {
+		columnDesc += ", and the class column " + classColumn
+	}
+	if mappingColumn != "" {
+		columnDesc += ", and the mapping column " + mappingColumn
+	}
+	return columnDesc
+}
+
+// isImportedCallClass - returns true if a request type in RequestTypesToImport has the given Service Manager class
+func isImportedCallClass(callClass string) bool {
+	for _, callConf := range swImportConf.RequestTypesToImport {
+		if callConf.CallClass == callClass {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,65 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+const pausePollInterval = 5 * time.Second //How often the pause file is checked for while paused
+
+var (
+	pausedTotal      time.Duration
+	mutexPause       = &sync.Mutex{}
+	mutexPausedTotal = &sync.Mutex{}
+)
+
+// getPauseFilePath - returns the full path to the file that pauses the import while it exists
+func getPauseFilePath() string {
+	if filepath.IsAbs(configPauseFile) {
+		return configPauseFile
+	}
+	cwd, _ := os.Getwd()
+	return filepath.Join(cwd, configPauseFile)
+}
+
+// pauseFileExists - returns true if the pause file has been created
+func pauseFileExists() bool {
+	if configPauseFile == "" {
+		return false
+	}
+	_, err := os.Stat(getPauseFilePath())
+	return err == nil
+}
+
+// waitWhilePaused - blocks, at a point where no request is part processed, while the pause file exists.
+// Returns when the file is removed, or a shutdown signal is received
+func waitWhilePaused() {
+	if !pauseFileExists() {
+		return
+	}
+	//The first caller tracks the pause, any others wait here until it has ended
+	mutexPause.Lock()
+	defer mutexPause.Unlock()
+	if !pauseFileExists() {
+		return
+	}
+	logger(5, "Import paused - delete "+getPauseFilePath()+" to continue", true)
+	pauseStart := time.Now()
+	for pauseFileExists() && !shutdownRequested() {
+		time.Sleep(pausePollInterval)
+	}
+	pausedFor := time.Since(pauseStart)
+	mutexPausedTotal.Lock()
+	pausedTotal += pausedFor
+	mutexPausedTotal.Unlock()
+	logger(1, "Import continuing after being paused for "+pausedFor.Round(time.Second).String(), true)
+}
+
+// pausedDuration - returns the total time the import has been paused for
+func pausedDuration() time.Duration {
+	mutexPausedTotal.Lock()
+	defer mutexPausedTotal.Unlock()
+	return pausedTotal
+}
@@ -0,0 +1,184 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"sort"
+	"strconv"
+
+	apiLib "github.com/hornbill/goApiLib"
+)
+
+// preflightLookupStruct - a mapped field whose source values are resolved through an instance lookup when importing
+type preflightLookupStruct struct {
+	Name         string
+	Field        string
+	NeedsCallMap bool //The lookup reads the value from the call record itself, so a sample record is kept per value
+	Resolve      func(value string, callMap map[string]interface{}, callConf swCallConfStruct, espXmlmc *apiLib.XmlmcInstStruct, buffer *bytes.Buffer) bool
+	Default      func(callConf swCallConfStruct) string
+}
+
+// preflightValueStruct - a distinct source value of a mapped field, with the number of calls it appears in
+type preflightValueStruct struct {
+	Value   string
+	Count   int
+	CallMap map[string]interface{}
+}
+
+// preflightLookups - the mapped fields checked by a preflight, in report order
+var preflightLookups = []preflightLookupStruct{
+	{Name: "Owner", Field: "h_ownerid", Resolve: func(value string, callMap map[string]interface{}, callConf swCallConfStruct, espXmlmc *apiLib.XmlmcInstStruct, buffer *bytes.Buffer) bool {
+		return doesUserExist(value, espXmlmc, buffer)
+	}},
+	{Name: "Customer", Field: "h_fk_user_id", Resolve: func(value string, callMap map[string]interface{}, callConf swCallConfStruct, espXmlmc *apiLib.XmlmcInstStruct, buffer *bytes.Buffer) bool {
+		if swImportConf.CustomerType == "1" {
+			return doesContactExist(value, espXmlmc, buffer)
+		}
+		return doesUserExist(value, espXmlmc, buffer)
+	}},
+	{Name: "Team", Field: "h_fk_team_id", Resolve: func(value string, callMap map[string]interface{}, callConf swCallConfStruct, espXmlmc *apiLib.XmlmcInstStruct, buffer *bytes.Buffer) bool {
+		teamID, _ := getCallTeamID(value, callConf.CallClass, espXmlmc, buffer)
+		return teamID != ""
+	}, Default: func(callConf swCallConfStruct) string { return callConf.DefaultTeam }},
+	{Name: "Priority", Field: "h_fk_priorityid", Resolve: func(value string, callMap map[string]interface{}, callConf swCallConfStruct, espXmlmc *apiLib.XmlmcInstStruct, buffer *bytes.Buffer) bool {
+		priorityID, _ := getCallPriorityID(value, callConf.CallClass, espXmlmc, buffer)
+		return priorityID != ""
+	}, Default: func(callConf swCallConfStruct) string { return callConf.DefaultPriority }},
+	{Name: "Service", Field: "h_fk_serviceid", Resolve: func(value string, callMap map[string]interface{}, callConf swCallConfStruct, espXmlmc *apiLib.XmlmcInstStruct, buffer *bytes.Buffer) bool {
+		return getCallServiceID(value, callConf.CallClass, espXmlmc, buffer) != ""
+	}, Default: func(callConf swCallConfStruct) string { return callConf.DefaultService }},
+	{Name: "Category", Field: "h_category_id", NeedsCallMap: true, Resolve: func(value string, callMap map[string]interface{}, callConf swCallConfStruct, espXmlmc *apiLib.XmlmcInstStruct, buffer *bytes.Buffer) bool {
+		categoryID, _ := getCallCategoryID(callMap, callConf, "Request", espXmlmc, buffer)
+		return categoryID != ""
+	}},
+	{Name: "Closure Category", Field: "h_closure_category_id", NeedsCallMap: true, Resolve: func(value string, callMap map[string]interface{}, callConf swCallConfStruct, espXmlmc *apiLib.XmlmcInstStruct, buffer *bytes.Buffer) bool {
+		categoryID, _ := getCallCategoryID(callMap, callConf, "Closure", espXmlmc, buffer)
+		return categoryID != ""
+	}},
+	{Name: "Site", Field: "h_site", NeedsCallMap: true, Resolve: func(value string, callMap map[string]interface{}, callConf swCallConfStruct, espXmlmc *apiLib.XmlmcInstStruct, buffer *bytes.Buffer) bool {
+		siteID, _ := getSiteID(callMap, callConf, espXmlmc, buffer)
+		return siteID != ""
+	}},
+	{Name: "Status", Field: "h_status", Resolve: func(value string, callMap map[string]interface{}, callConf swCallConfStruct, espXmlmc *apiLib.XmlmcInstStruct, buffer *bytes.Buffer) bool {
+		return getMappedValue("StatusMapping", callConf.CallClass, value) != nil
+	}},
+}
+
+// processPreflight - reads the calls of every request class, and resolves the distinct source values of each mapped
+// lookup field against the instance, reporting any that would not resolve. No requests are created.
+// Returns the number of unresolved values, and false if the preflight could not be completed for every class
+func processPreflight(requestClasses []*requestClassStruct) (int, bool) {
+	espXmlmc, err := NewEspXmlmcSession()
+	if err != nil {
+		logger(4, "Could not connect to Hornbill Instance: "+err.Error(), true)
+		return 0, false
+	}
+	defer releaseInstanceSession(espXmlmc)
+	unresolvedTotal := 0
+	preflightComplete := true
+	for _, requestClass := range requestClasses {
+		unresolvedCount, classComplete := preflightRequestClass(requestClass.Conf, espXmlmc)
+		unresolvedTotal += unresolvedCount
+		if !classComplete {
+			preflightComplete = false
+		}
+	}
+	return unresolvedTotal, preflightComplete
+}
+
+// preflightRequestClass - runs the preflight checks for a single request class
+// Returns the number of unresolved values, and false if the calls of the class could not be read
+func preflightRequestClass(callConf swCallConfStruct, espXmlmc *apiLib.XmlmcInstStruct) (int, bool) {
+	var buffer bytes.Buffer
+	defer flushLogBuffer(&buffer)
+	classDesc := callConf.CallClass + " [" + callConf.SupportworksCallClass + "]"
+	logger(1, "[PREFLIGHT] Reading "+classDesc+" calls", true)
+
+	//Gather the distinct source values of each mapped lookup field
+	fieldValues := make(map[string]map[string]*preflightValueStruct)
+	callCount := 0
+	callsLoaded := loadCallDetails(callConf, func(callMap map[string]interface{}) bool {
+		callCount++
+		for _, lookup := range preflightLookups {
+			if callConf.CoreFieldMapping[lookup.Field] == nil {
+				continue
+			}
+			fieldMapping := fmt.Sprintf("%v", callConf.CoreFieldMapping[lookup.Field])
+			if fieldMapping == "" {
+				continue
+			}
+			fieldValue := getFieldValue(fieldMapping, callMap)
+			if fieldValue == "" {
+				continue
+			}
+			if fieldValues[lookup.Field] == nil {
+				fieldValues[lookup.Field] = make(map[string]*preflightValueStruct)
+			}
+			distinctValue, ok := fieldValues[lookup.Field][fieldValue]
+			if !ok {
+				distinctValue = &preflightValueStruct{Value: fieldValue}
+				if lookup.NeedsCallMap {
+					distinctValue.CallMap = callMap
+				}
+				fieldValues[lookup.Field][fieldValue] = distinctValue
+			}
+			distinctValue.Count++
+		}
+		return !importStopped()
+	})
+	if !callsLoaded {
+		logger(4, "[PREFLIGHT] Call Search Failed for Call Class: "+classDesc, true)
+		return 0, false
+	}
+	logger(1, "[PREFLIGHT] "+classDesc+": "+strconv.Itoa(callCount)+" calls checked", true)
+
+	//Resolve each distinct value, and report those that would not resolve
+	unresolvedTotal := 0
+	for _, lookup := range preflightLookups {
+		distinctValues := fieldValues[lookup.Field]
+		if len(distinctValues) == 0 {
+			continue
+		}
+		unresolved := make([]*preflightValueStruct, 0)
+		for _, distinctValue := range distinctValues {
+			if !lookup.Resolve(distinctValue.Value, distinctValue.CallMap, callConf, espXmlmc, &buffer) {
+				unresolved = append(unresolved, distinctValue)
+			}
+		}
+		lookupDesc := "[PREFLIGHT]   " + lookup.Name + " (" + lookup.Field + "): " + strconv.Itoa(len(distinctValues)) + " distinct value(s), "
+		if len(unresolved) == 0 {
+			logger(1, lookupDesc+"all resolved", true)
+			continue
+		}
+		unresolvedTotal += len(unresolved)
+		defaultDesc := ""
+		if lookup.Default != nil && lookup.Default(callConf) != "" {
+			defaultDesc = " - the default of \"" + lookup.Default(callConf) + "\" will be used for these"
+		}
+		logger(5, lookupDesc+strconv.Itoa(len(unresolved))+" unresolved"+defaultDesc, true)
+		sort.Slice(unresolved, func(i, j int) bool {
+			if unresolved[i].Count != unresolved[j].Count {
+				return unresolved[i].Count > unresolved[j].Count
+			}
+			return unresolved[i].Value < unresolved[j].Value
+		})
+		for _, unresolvedValue := range unresolved {
+			logger(5, "[PREFLIGHT]     \""+unresolvedValue.Value+"\" ("+strconv.Itoa(unresolvedValue.Count)+" call(s))", true)
+		}
+	}
+
+	//Check the defaults used when a value doesn't resolve
+	if callConf.DefaultTeam != "" && getTeamID(callConf.DefaultTeam, espXmlmc, &buffer) == "" {
+		unresolvedTotal++
+		logger(5, "[PREFLIGHT]   DefaultTeam \""+callConf.DefaultTeam+"\" could not be found on the instance", true)
+	}
+	if callConf.DefaultPriority != "" && getPriorityID(callConf.DefaultPriority, espXmlmc, &buffer) == "" {
+		unresolvedTotal++
+		logger(5, "[PREFLIGHT]   DefaultPriority \""+callConf.DefaultPriority+"\" could not be found on the instance", true)
+	}
+	if callConf.DefaultService != "" && getServiceID(callConf.DefaultService, espXmlmc, &buffer) == "" {
+		unresolvedTotal++
+		logger(5, "[PREFLIGHT]   DefaultService \""+callConf.DefaultService+"\" could not be found on the instance", true)
+	}
+	return unresolvedTotal, true
+}
@@ -11,10 +11,10 @@ import (
 )
 
 //getCallPriorityID takes the Call Record and returns a correct Priority ID if one exists on the Instance
-func getCallPriorityID(strPriorityName string, espXmlmc *apiLib.XmlmcInstStruct, buffer *bytes.Buffer) (string, string) {
+func getCallPriorityID(strPriorityName, callClass string, espXmlmc *apiLib.XmlmcInstStruct, buffer *bytes.Buffer) (string, string) {
 	priorityID := ""
-	if swImportConf.PriorityMapping[strPriorityName] != nil {
-		strPriorityName = fmt.Sprintf("%s", swImportConf.PriorityMapping[strPriorityName])
+	if mappedPriority := getMappedValue("PriorityMapping", callClass, strPriorityName); mappedPriority != nil {
+		strPriorityName = fmt.Sprintf("%s", mappedPriority)
 		if strPriorityName != "" {
 			priorityID = getPriorityID(strPriorityName, espXmlmc, buffer)
 		}
@@ -55,7 +55,7 @@ func searchPriority(priorityName string, espXmlmc *apiLib.XmlmcInstStruct, buffe
 	espXmlmc.CloseElement("searchFilter")
 	espXmlmc.SetParam("maxResults", "1")
 
-	XMLPrioritySearch, xmlmcErr := espXmlmc.Invoke("data", "entityBrowseRecords")
+	XMLPrioritySearch, xmlmcErr := invokeXmlmc(espXmlmc, "data", "entityBrowseRecords")
 	if xmlmcErr != nil {
 		buffer.WriteString(loggerGen(4, "Unable to Search for Priority: "+xmlmcErr.Error()))
 		return boolReturn, intReturn
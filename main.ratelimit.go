@@ -0,0 +1,84 @@
+package main
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/hornbill/pb"
+)
+
+// rateLimiterStruct - a token bucket shared by every XMLMC call made to the instance, so the API pressure
+// is set by the requests per second budget rather than by the number of workers
+type rateLimiterStruct struct {
+	mutex      sync.Mutex
+	rate       float64
+	tokens     float64
+	capacity   float64
+	lastRefill time.Time
+	started    time.Time
+	callCount  int64
+}
+
+var rateLimiter = &rateLimiterStruct{}
+
+// startRateLimiter - sets the requests per second budget. A rate of 0 leaves the calls unlimited
+func startRateLimiter(requestsPerSecond float64) {
+	rateLimiter.mutex.Lock()
+	defer rateLimiter.mutex.Unlock()
+	rateLimiter.rate = requestsPerSecond
+	//Allow up to a second of calls to burst, so idle workers don't waste the budget
+	rateLimiter.capacity = requestsPerSecond
+	if rateLimiter.capacity < 1 {
+		rateLimiter.capacity = 1
+	}
+	rateLimiter.tokens = rateLimiter.capacity
+	rateLimiter.lastRefill = time.Now()
+	rateLimiter.started = time.Now()
+	rateLimiter.callCount = 0
+}
+
+// wait - blocks until the budget allows another call to be made
+func (limiter *rateLimiterStruct) wait() {
+	limiter.mutex.Lock()
+	limiter.callCount++
+	if limiter.rate <= 0 {
+		limiter.mutex.Unlock()
+		return
+	}
+	now := time.Now()
+	limiter.tokens += now.Sub(limiter.lastRefill).Seconds() * limiter.rate
+	if limiter.tokens > limiter.capacity {
+		limiter.tokens = limiter.capacity
+	}
+	limiter.lastRefill = now
+	//The token is taken now, so callers queue in order. A negative balance is the wait for this caller
+	limiter.tokens--
+	var waitFor time.Duration
+	if limiter.tokens < 0 {
+		waitFor = time.Duration(-limiter.tokens / limiter.rate * float64(time.Second))
+	}
+	limiter.mutex.Unlock()
+	if waitFor > 0 {
+		time.Sleep(waitFor)
+	}
+}
+
+// effectiveRate - returns the average number of XMLMC calls made per second since the limiter was started,
+// not counting any time the import was paused
+func (limiter *rateLimiterStruct) effectiveRate() float64 {
+	pausedFor := pausedDuration()
+	limiter.mutex.Lock()
+	defer limiter.mutex.Unlock()
+	elapsed := (time.Since(limiter.started) - pausedFor).Seconds()
+	if elapsed <= 0 {
+		return 0
+	}
+	return float64(limiter.callCount) / elapsed
+}
+
+// incrementBar - moves a progress bar on by one, showing the effective API call rate alongside it
+func incrementBar(bar *pb.ProgressBar) {
+	bar.Postfix(fmt.Sprintf(" %.1f api/s", rateLimiter.effectiveRate()))
+	bar.Increment()
+}
@@ -7,31 +7,15 @@ import (
 //processCallAssociations - Get all records from swdata.cmn_rel_opencall_oc, process accordingly
 func processCallAssociations() {
 	logger(1, "Processing Request Associations, please wait...", true)
-	//Check connection is open
-	err := dbapp.Ping()
-	if err != nil {
-		logger(4, " [DATABASE] [PING] Database Connection Error for Request Associations: "+err.Error(), false)
+	requestAssociations, assocOK := getRequestAssociations()
+	if !assocOK {
 		return
 	}
-	logger(3, "[DATABASE] Connection Successful", false)
-	logger(3, "[DATABASE] Running query for Request Associations. Please wait...", false)
 
-	//build query
-	sqlDiaryQuery := swImportConf.RelatedRequestQuery
-	logger(3, "[DATABASE] Request Association Query: "+sqlDiaryQuery, false)
-	//Run Query
-	rows, err := dbapp.Queryx(sqlDiaryQuery)
-	if err != nil {
-		logger(4, " Database Query Error: "+err.Error(), false)
-		return
-	}
-
-	for rows.Next() {
-		var requestRels reqRelStruct
-
-		errDataMap := rows.StructScan(&requestRels)
-		if errDataMap != nil {
-			logger(4, " Data Mapping Error: "+errDataMap.Error(), false)
+	for _, requestRels := range requestAssociations {
+		waitWhilePaused()
+		if shutdownRequested() {
+			logger(5, "Request Association Processing stopped by a shutdown signal", true)
 			return
 		}
 		smMasterRef, mrOK := arrCallsLogged[requestRels.MasterRef]
@@ -40,7 +24,12 @@ func processCallAssociations() {
 		if mrOK && smMasterRef != "" && srOK && smSlaveRef != "" {
 			//We have Master and Slave calls matched in the SM database
 			jobs := refStruct{MasterRef: smMasterRef, SlaveRef: smSlaveRef}
-			addAssocRecord(jobs)
+			if (configResume || configDelta) && associationInLedger(requestRels.MasterRef, jobs) {
+				continue
+			}
+			if addAssocRecord(jobs) && !configDryRun {
+				recordLedgerAssociation(requestRels.MasterRef, requestRels.SlaveRef, jobs)
+			}
 		}
 	}
 
@@ -48,14 +37,14 @@ func processCallAssociations() {
 }
 
 //addAssocRecord - given a Master Reference and a Slave Refernce, adds a call association record to Service Manager
-func addAssocRecord(assoc refStruct) {
+func addAssocRecord(assoc refStruct) bool {
 
 	espXmlmc, err := NewEspXmlmcSession()
 	if err != nil {
 		logger(4, "Could not connect to Hornbill Instance", false)
-		return
-
+		return false
 	}
+	defer releaseInstanceSession(espXmlmc)
 
 	espXmlmc.SetParam("entityId", assoc.MasterRef)
 	espXmlmc.SetParam("entityName", "Requests")
@@ -63,21 +52,66 @@ func addAssocRecord(assoc refStruct) {
 	espXmlmc.SetParam("linkedEntityName", "Requests")
 	espXmlmc.SetParam("updateTimeline", "true")
 	espXmlmc.SetParam("visibility", "trustedGuest")
-	XMLUpdate, xmlmcErr := espXmlmc.Invoke("apps/com.hornbill.servicemanager/RelationshipEntities", "add")
+	XMLUpdate, xmlmcErr := invokeXmlmc(espXmlmc, "apps/com.hornbill.servicemanager/RelationshipEntities", "add")
 	if xmlmcErr != nil {
 		//		log.Fatal(xmlmcErr)
 		logger(4, "Unable to create Request Association between ["+assoc.MasterRef+"] and ["+assoc.SlaveRef+"] :"+xmlmcErr.Error(), false)
-		return
+		return false
 	}
 	var xmlRespon xmlmcResponse
 	errXMLMC := xml.Unmarshal([]byte(XMLUpdate), &xmlRespon)
 	if errXMLMC != nil {
 		logger(4, "Unable to read response from Hornbill instance for Request Association between ["+assoc.MasterRef+"] and ["+assoc.SlaveRef+"] :"+errXMLMC.Error(), false)
-		return
+		return false
 	}
 	if xmlRespon.MethodResult != "ok" {
 		logger(5, "Unable to add Request Association between ["+assoc.MasterRef+"] and ["+assoc.SlaveRef+"] : "+xmlRespon.State.ErrorRet, false)
-		return
+		return false
 	}
 	logger(1, "Request Association Success between ["+assoc.MasterRef+"] and ["+assoc.SlaveRef+"]", false)
+	return true
+}
+
+//getRequestAssociations - returns the call associations, from the import archive or the Supportworks database
+func getRequestAssociations() ([]reqRelStruct, bool) {
+	if configImportArchive != "" {
+		return archiveAssociations, true
+	}
+	return queryRequestAssociations()
+}
+
+//queryRequestAssociations - runs the RelatedRequestQuery, returning the call associations
+func queryRequestAssociations() ([]reqRelStruct, bool) {
+	requestAssociations := make([]reqRelStruct, 0)
+	//Check connection is open
+	err := dbapp.Ping()
+	if err != nil {
+		logger(4, " [DATABASE] [PING] Database Connection Error for Request Associations: "+err.Error(), false)
+		return requestAssociations, false
+	}
+	logger(3, "[DATABASE] Connection Successful", false)
+	logger(3, "[DATABASE] Running query for Request Associations. Please wait...", false)
+
+	//build query
+	sqlDiaryQuery := swImportConf.RelatedRequestQuery
+	logger(3, "[DATABASE] Request Association Query: "+sqlDiaryQuery, false)
+	//Run Query
+	rows, err := dbapp.Queryx(sqlDiaryQuery)
+	if err != nil {
+		logger(4, " Database Query Error: "+err.Error(), false)
+		return requestAssociations, false
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var requestRels reqRelStruct
+
+		errDataMap := rows.StructScan(&requestRels)
+		if errDataMap != nil {
+			logger(4, " Data Mapping Error: "+errDataMap.Error(), false)
+			return requestAssociations, false
+		}
+		requestAssociations = append(requestAssociations, requestRels)
+	}
+	return requestAssociations, true
 }
@@ -8,6 +8,7 @@ import (
 	"strconv"
 	"strings"
 	"sync"
+	"time"
 
 	/* non core libraries */
 
@@ -15,85 +16,297 @@ import (
 	"github.com/hornbill/pb"
 )
 
-//processCallData - Query Supportworks call data, process accordingly
-func processCallData() {
-	if queryDBCallDetails(mapGenericConf.CallClass, mapGenericConf.SupportworksCallClass, connStrAppDB) {
-		bar := pb.StartNew(len(arrCallDetailsMaps))
+const classProgressInterval = time.Minute //How often the progress of each request class is output during the import
 
-		var wg sync.WaitGroup
+//processCallData - Query Supportworks call data for every request class, process accordingly.
+//Calls are passed to a single pool of workers as they are read, so only the calls being processed are held in memory
+func processCallData(requestClasses []*requestClassStruct) {
+	callCount := 0
+	for _, requestClass := range requestClasses {
+		requestClass.CallCount = countCallDetails(requestClass.Conf)
+		callCount += requestClass.CallCount
+	}
+	bar := pb.StartNew(callCount)
+	//The bar shows the calls read for all classes together, so the progress of each is also output as it runs
+	stopProgress := make(chan struct{})
+	if len(requestClasses) > 1 {
+		go reportClassProgress(requestClasses, stopProgress)
+	}
 
-		jobs := make(chan RequestDetails, maxGoroutines)
+	var wg sync.WaitGroup
 
-		for w := 1; w <= maxGoroutines; w++ {
-			wg.Add(1)
-			espXmlmc, err := NewEspXmlmcSession()
-			if err != nil {
-				logger(4, "Could not connect to Hornbill Instance: "+err.Error(), true)
-				os.Exit(1)
-			}
-			go logNewCall(jobs, &wg, espXmlmc)
+	jobs := make(chan RequestDetails, maxGoroutines)
+
+	adaptiveWorkers.start(minGoroutines, maxGoroutines)
+	for w := 1; w <= maxGoroutines; w++ {
+		wg.Add(1)
+		espXmlmc, err := NewEspXmlmcSession()
+		if err != nil {
+			logger(4, "Could not connect to Hornbill Instance: "+err.Error(), true)
+			os.Exit(1)
 		}
+		go logNewCall(w, jobs, &wg, espXmlmc)
+	}
 
-		for _, callRecord := range arrCallDetailsMaps {
-			callRecordArr := callRecord
-			callRecordCallref := callRecord["callref"]
+	//Each class is read from the source at the same time, feeding the shared worker pool
+	var wgClasses sync.WaitGroup
+	for _, requestClass := range requestClasses {
+		wgClasses.Add(1)
+		go func(requestClass *requestClassStruct) {
+			defer wgClasses.Done()
+			callConf := requestClass.Conf
+			//While calls are read in callref order, only the last callref read is kept. When the query is run again
+			//after a pause, the calls up to skipUpToCallRef have already been read, and are skipped
+			lastCallRef := int64(0)
+			callsInOrder := true
+			skipUpToCallRef := int64(0)
+			var pendingJob *RequestDetails
+			pausedReading := false
+			readCall := func(callRecord map[string]interface{}) bool {
+				//No more calls are read once the import has been stopped by the circuit breaker or a shutdown signal
+				if importStopped() {
+					return false
+				}
+				callID := getCallID(callRecord)
+				callRef, callRefErr := strconv.ParseInt(callID, 10, 64)
+				if skipUpToCallRef > 0 && callRefErr == nil && callRef <= skipUpToCallRef {
+					return true
+				}
+				if pauseFileExists() {
+					if callsInOrder {
+						//The result set is not held open while paused, reading stops and the query is run again on resume
+						pausedReading = true
+						return false
+					}
+					//Calls not read in callref order could not be skipped by a new query, so the result set is held open
+					waitWhilePaused()
+					if importStopped() {
+						return false
+					}
+				}
+				if callRefErr != nil || callRef <= lastCallRef {
+					callsInOrder = false
+				} else {
+					lastCallRef = callRef
+				}
+				mutexBar.Lock()
+				incrementBar(bar)
+				mutexBar.Unlock()
 
-			mutexBar.Lock()
-			bar.Increment()
-			mutexBar.Unlock()
+				mutexCounters.Lock()
+				requestClass.Counters.callsReturned++
+				mutexCounters.Unlock()
+				//In delta mode, skip calls that have not changed since the last successful run
+				if configDelta && !callChangedSinceWatermark(callRecord) {
+					return true
+				}
 
-			callID := ""
-			if callInt, ok := callRecordCallref.(int64); ok {
-				callID = strconv.FormatInt(callInt, 10)
+				smCallID := ""
+				if configDelta {
+					//Calls already imported are updated rather than logged again
+					smCallID, _ = ledgerCallRef(callID)
+				} else if configResume && callInLedger(callID) {
+					mutexCounters.Lock()
+					requestClass.Counters.resumedSkipped++
+					mutexCounters.Unlock()
+					return true
+				}
+				//Waits until a worker is free, so rows are only read from the source as fast as they are imported
+				job := RequestDetails{Class: requestClass, CallMap: callRecord, SwCallID: callID, SmCallID: smCallID}
+				if !queueJob(jobs, job) {
+					if callsInOrder {
+						pendingJob = &job
+						pausedReading = true
+						return false
+					}
+					waitWhilePaused()
+					jobs <- job
+				}
+				return true
+			}
+			callsLoaded := loadCallDetails(callConf, readCall)
+			for pausedReading && !importStopped() {
+				pausedReading = false
+				skipUpToCallRef = lastCallRef
+				waitWhilePaused()
+				if pendingJob != nil {
+					jobs <- *pendingJob
+					pendingJob = nil
+				}
+				logger(1, "Reading "+callConf.CallClass+" calls from source ["+callConf.SupportworksCallClass+"] again after the pause, skipping the calls up to callref "+strconv.FormatInt(skipUpToCallRef, 10)+" already read", false)
+				callsLoaded = loadCallDetails(callConf, readCall)
+			}
+			if importStopped() {
+				setSourceReadFailed()
+				logger(5, "Stopped reading "+callConf.CallClass+" calls from source ["+callConf.SupportworksCallClass+"] as the import has been stopped", false)
+			} else if callsLoaded {
+				logger(1, "All "+callConf.CallClass+" calls read from source ["+callConf.SupportworksCallClass+"]", false)
 			} else {
-				callID = fmt.Sprintf("%s", callRecordCallref)
+				setSourceReadFailed()
+				logger(4, "Call Search Failed for Call Class: "+callConf.CallClass+"["+callConf.SupportworksCallClass+"]", false)
+			}
+		}(requestClass)
+	}
+	wgClasses.Wait()
+
+	close(jobs)
+	adaptiveWorkers.finish()
+	wg.Wait()
+	close(stopProgress)
+	bar.FinishPrint("Call Import Complete")
+
+	for _, requestClass := range requestClasses {
+		logClassCounters(requestClass)
+		addClassCounters(requestClass)
+	}
+}
+
+// queueJob - passes a call to the workers, waiting until one is free. Returns false, without queueing the call, if the
+// import is paused while waiting, as the workers do not take any more calls until it continues
+func queueJob(jobs chan RequestDetails, job RequestDetails) bool {
+	for {
+		select {
+		case jobs <- job:
+			return true
+		case <-time.After(pausePollInterval):
+			if pauseFileExists() {
+				return false
 			}
-			jobs <- RequestDetails{CallClass: mapGenericConf.CallClass, CallMap: callRecordArr, SwCallID: callID}
 		}
+	}
+}
+
+// reportClassProgress - outputs the progress of each request class every classProgressInterval, until stopped
+func reportClassProgress(requestClasses []*requestClassStruct, stop chan struct{}) {
+	ticker := time.NewTicker(classProgressInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			for _, requestClass := range requestClasses {
+				logger(1, getClassProgress(requestClass), true)
+			}
+		case <-stop:
+			return
+		}
+	}
+}
 
-		close(jobs)
-		wg.Wait()
+// getClassProgress - returns the calls read, logged and skipped so far for a request class
+func getClassProgress(requestClass *requestClassStruct) string {
+	classCounters := &requestClass.Counters
+	mutexCounters.Lock()
+	callsRead := strconv.Itoa(classCounters.callsReturned)
+	callsLogged := classCounters.created
+	callsSkipped := classCounters.createdSkipped + classCounters.resumedSkipped + classCounters.duplicatesSkipped
+	mutexCounters.Unlock()
+	if requestClass.CallCount > 0 {
+		callsRead += " of " + strconv.Itoa(requestClass.CallCount)
+	}
+	return "Progress - " + requestClass.Conf.CallClass + " [" + requestClass.Conf.SupportworksCallClass + "] - Read: " + callsRead +
+		", Logged: " + strconv.Itoa(callsLogged) + ", Skipped: " + strconv.Itoa(callsSkipped)
+}
 
-		bar.FinishPrint(mapGenericConf.CallClass + " Call Import Complete")
-	} else {
-		logger(4, "Call Search Failed for Call Class: "+mapGenericConf.CallClass+"["+mapGenericConf.SupportworksCallClass+"]", true)
+// logClassCounters - outputs the counters for a single request class
+func logClassCounters(requestClass *requestClassStruct) {
+	classCounters := &requestClass.Counters
+	classSummary := requestClass.Conf.CallClass + " [" + requestClass.Conf.SupportworksCallClass + "] - Returned: " + strconv.Itoa(classCounters.callsReturned) +
+		", Logged: " + strconv.Itoa(classCounters.created) +
+		", Skipped: " + strconv.Itoa(classCounters.createdSkipped)
+	if classCounters.resumedSkipped > 0 {
+		classSummary += ", Already in Ledger: " + strconv.Itoa(classCounters.resumedSkipped)
+	}
+	if classCounters.notProcessed > 0 {
+		classSummary += ", Not Processed (Import Stopped): " + strconv.Itoa(classCounters.notProcessed)
+	}
+	if classCounters.duplicatesSkipped > 0 || classCounters.duplicatesAdopted > 0 {
+		classSummary += ", Duplicates Skipped: " + strconv.Itoa(classCounters.duplicatesSkipped) + ", Duplicates Adopted: " + strconv.Itoa(classCounters.duplicatesAdopted)
+	}
+	if configDelta {
+		classSummary += ", Updated: " + strconv.Itoa(classCounters.updated) + ", Failed To Update: " + strconv.Itoa(classCounters.updateFailed)
+	}
+	if classCounters.existingRequests > 0 {
+		classSummary += ", Existing: " + strconv.Itoa(classCounters.existingRequests)
 	}
+	logger(1, classSummary, true)
+}
+
+// addClassCounters - adds the counters for a request class to the totals for the run
+func addClassCounters(requestClass *requestClassStruct) {
+	mutexCounters.Lock()
+	defer mutexCounters.Unlock()
+	counters.callsReturned += requestClass.Counters.callsReturned
+	counters.created += requestClass.Counters.created
+	counters.createdSkipped += requestClass.Counters.createdSkipped
+	counters.resumedSkipped += requestClass.Counters.resumedSkipped
+	counters.notProcessed += requestClass.Counters.notProcessed
+	counters.duplicatesSkipped += requestClass.Counters.duplicatesSkipped
+	counters.duplicatesAdopted += requestClass.Counters.duplicatesAdopted
+	counters.existingRequests += requestClass.Counters.existingRequests
+	counters.updated += requestClass.Counters.updated
+	counters.updateFailed += requestClass.Counters.updateFailed
 }
 
 //logNewCall - Function takes Supportworks call data in a map, and logs to Hornbill
-func logNewCall(jobs chan RequestDetails, wg *sync.WaitGroup, espXmlmc *apiLib.XmlmcInstStruct) {
+func logNewCall(workerID int, jobs chan RequestDetails, wg *sync.WaitGroup, espXmlmc *apiLib.XmlmcInstStruct) {
 	defer wg.Done()
-	for requestRecord := range jobs {
-
-		var buffer bytes.Buffer
+	defer releaseInstanceSession(espXmlmc)
+	var buffer bytes.Buffer
+	for {
+		//The log for the previous call is written out, whichever way its processing ended
+		flushLogBuffer(&buffer)
+		//Workers above the active limit wait for the instance to recover before taking another call
+		adaptiveWorkers.waitForSlot(workerID)
+		//Calls are only taken between requests, so pausing never leaves a request part processed
+		waitWhilePaused()
+		requestRecord, ok := <-jobs
+		if !ok {
+			return
+		}
+		//Calls still queued when the import is stopped are not processed, and are left for -resume
+		if importStopped() {
+			buffer.WriteString(loggerGen(5, "Supportworks Ref: "+requestRecord.SwCallID+" not processed as the import has been stopped"))
+			mutexCounters.Lock()
+			requestRecord.Class.Counters.notProcessed++
+			mutexCounters.Unlock()
+			continue
+		}
 
-		callClass := requestRecord.CallClass
+		requestClass := requestRecord.Class
+		callConf := requestClass.Conf
+		callClass := callConf.CallClass
 		callMap := requestRecord.CallMap
 		swCallID := requestRecord.SwCallID
+		smDeltaRef := requestRecord.SmCallID
 		buffer.WriteString(loggerGen(3, "   "))
 		buffer.WriteString(loggerGen(1, "Buffer For Supportworks Ref: "+swCallID))
 
 		if smMappedRef, ok := swImportConf.ExistingRequestMappings[swCallID]; ok {
 			request := RequestReferences{SwCallID: swCallID, SmCallID: smMappedRef}
-			applyHistoricalUpdates(request, espXmlmc, &buffer)
+			applyHistoricalUpdates(request, nil, espXmlmc, &buffer)
 			mutexArrCallsLogged.Lock()
 			arrCallsLogged[swCallID] = smMappedRef
 			mutexArrCallsLogged.Unlock()
 			mutexCounters.Lock()
-			counters.existingRequests++
+			requestClass.Counters.existingRequests++
 			mutexCounters.Unlock()
 			continue
 		}
 
+		//Check for an existing request with the same external reference
+		if smDeltaRef == "" && checkDuplicateRequest(swCallID, requestClass, callMap, espXmlmc, &buffer) {
+			continue
+		}
+
 		strNewCallRef := ""
 		strStatus := ""
 		boolOnHoldRequest := false
 
 		//Get request status from request & map
-		statusMapping := fmt.Sprintf("%v", mapGenericConf.CoreFieldMapping["h_status"])
+		statusMapping := fmt.Sprintf("%v", callConf.CoreFieldMapping["h_status"])
 		strStatusID := getFieldValue(statusMapping, callMap)
-		if swImportConf.StatusMapping[strStatusID] != nil {
-			strStatus = strings.ToLower(fmt.Sprintf("%v", swImportConf.StatusMapping[strStatusID]))
+		if mappedStatus := getMappedValue("StatusMapping", callConf.CallClass, strStatusID); mappedStatus != nil {
+			strStatus = strings.ToLower(fmt.Sprintf("%v", mappedStatus))
 		}
 
 		coreFields := make(map[string]string)
@@ -104,12 +317,11 @@ func logNewCall(jobs chan RequestDetails, wg *sync.WaitGroup, espXmlmc *apiLib.X
 		boolUpdateLogDate := false
 		strLoggedDate := ""
 		//Sort out logged date
-		if logDateInterface, ok := mapGenericConf.CoreFieldMapping["h_datelogged"]; ok {
+		if logDateInterface, ok := callConf.CoreFieldMapping["h_datelogged"]; ok {
 			if logDateInterface != "" {
-				logDateMapping := fmt.Sprint(mapGenericConf.CoreFieldMapping["h_datelogged"])
-				loggedEPOCH := getFieldValue(logDateMapping, callMap)
-				if loggedEPOCH != "" && loggedEPOCH != "0" {
-					strLoggedDate = epochToDateTime(loggedEPOCH)
+				logDateMapping := fmt.Sprint(callConf.CoreFieldMapping["h_datelogged"])
+				strLoggedDate = getMappedFieldValue("h_datelogged", logDateMapping, callMap)
+				if strLoggedDate != "" {
 					boolUpdateLogDate = true
 				}
 			}
@@ -117,17 +329,14 @@ func logNewCall(jobs chan RequestDetails, wg *sync.WaitGroup, espXmlmc *apiLib.X
 
 		//Sort out closed date
 		strClosedDate := ""
-		if closeDateInterface, ok := mapGenericConf.CoreFieldMapping["h_dateclosed"]; ok {
+		if closeDateInterface, ok := callConf.CoreFieldMapping["h_dateclosed"]; ok {
 			if closeDateInterface != "" {
-				closeDateMapping := fmt.Sprint(mapGenericConf.CoreFieldMapping["h_dateclosed"])
-				closedEPOCH := getFieldValue(closeDateMapping, callMap)
-				if closedEPOCH != "" && closedEPOCH != "0" {
-					strClosedDate = epochToDateTime(closedEPOCH)
-				}
+				closeDateMapping := fmt.Sprint(callConf.CoreFieldMapping["h_dateclosed"])
+				strClosedDate = getMappedFieldValue("h_dateclosed", closeDateMapping, callMap)
 			}
 		}
 		//Loop through core fields from config, add to XMLMC Params
-		for k, v := range mapGenericConf.CoreFieldMapping {
+		for k, v := range callConf.CoreFieldMapping {
 			boolAutoProcess := true
 			strAttribute = fmt.Sprintf("%v", k)
 			strMapping = fmt.Sprintf("%v", v)
@@ -204,10 +413,10 @@ func logNewCall(jobs chan RequestDetails, wg *sync.WaitGroup, espXmlmc *apiLib.X
 			//-- Get Priority ID
 			if strAttribute == "h_fk_priorityid" {
 				strPriorityID := getFieldValue(strMapping, callMap)
-				strPriorityMapped, strPriorityName := getCallPriorityID(strPriorityID, espXmlmc, &buffer)
-				if strPriorityMapped == "" && mapGenericConf.DefaultPriority != "" {
-					strPriorityMapped = getPriorityID(mapGenericConf.DefaultPriority, espXmlmc, &buffer)
-					strPriorityName = mapGenericConf.DefaultPriority
+				strPriorityMapped, strPriorityName := getCallPriorityID(strPriorityID, callConf.CallClass, espXmlmc, &buffer)
+				if strPriorityMapped == "" && callConf.DefaultPriority != "" {
+					strPriorityMapped = getPriorityID(callConf.DefaultPriority, espXmlmc, &buffer)
+					strPriorityName = callConf.DefaultPriority
 				}
 				coreFields[strAttribute] = strPriorityMapped
 				coreFields["h_fk_priorityname"] = strPriorityName
@@ -217,7 +426,7 @@ func logNewCall(jobs chan RequestDetails, wg *sync.WaitGroup, espXmlmc *apiLib.X
 			// Category ID & Name
 			if strAttribute == "h_category_id" && strMapping != "" {
 				//-- Get Call Category ID
-				strCategoryID, strCategoryName := getCallCategoryID(callMap, "Request", espXmlmc, &buffer)
+				strCategoryID, strCategoryName := getCallCategoryID(callMap, callConf, "Request", espXmlmc, &buffer)
 				if strCategoryID != "" && strCategoryName != "" {
 					coreFields[strAttribute] = strCategoryID
 					coreFields["h_category"] = strCategoryName
@@ -227,7 +436,7 @@ func logNewCall(jobs chan RequestDetails, wg *sync.WaitGroup, espXmlmc *apiLib.X
 
 			// Closure Category ID & Name
 			if strAttribute == "h_closure_category_id" && strMapping != "" {
-				strClosureCategoryID, strClosureCategoryName := getCallCategoryID(callMap, "Closure", espXmlmc, &buffer)
+				strClosureCategoryID, strClosureCategoryName := getCallCategoryID(callMap, callConf, "Closure", espXmlmc, &buffer)
 				if strClosureCategoryID != "" {
 					coreFields[strAttribute] = strClosureCategoryID
 					coreFields["h_closure_category"] = strClosureCategoryName
@@ -239,9 +448,9 @@ func logNewCall(jobs chan RequestDetails, wg *sync.WaitGroup, espXmlmc *apiLib.X
 			if strAttribute == "h_fk_serviceid" {
 				//-- Get Service ID
 				swServiceID := getFieldValue(strMapping, callMap)
-				strServiceID := getCallServiceID(swServiceID, espXmlmc, &buffer)
-				if strServiceID == "" && mapGenericConf.DefaultService != "" {
-					strServiceID = getServiceID(mapGenericConf.DefaultService, espXmlmc, &buffer)
+				strServiceID := getCallServiceID(swServiceID, callConf.CallClass, espXmlmc, &buffer)
+				if strServiceID == "" && callConf.DefaultService != "" {
+					strServiceID = getServiceID(callConf.DefaultService, espXmlmc, &buffer)
 				}
 				if strServiceID != "" {
 					//-- Get record from Service Cache
@@ -280,9 +489,9 @@ func logNewCall(jobs chan RequestDetails, wg *sync.WaitGroup, espXmlmc *apiLib.X
 			if strAttribute == "h_fk_team_id" {
 				//-- Get Team ID
 				swTeamID := getFieldValue(strMapping, callMap)
-				strTeamID, strTeamName := getCallTeamID(swTeamID, espXmlmc, &buffer)
-				if strTeamID == "" && mapGenericConf.DefaultTeam != "" {
-					strTeamName = mapGenericConf.DefaultTeam
+				strTeamID, strTeamName := getCallTeamID(swTeamID, callConf.CallClass, espXmlmc, &buffer)
+				if strTeamID == "" && callConf.DefaultTeam != "" {
+					strTeamName = callConf.DefaultTeam
 					strTeamID = getTeamID(strTeamName, espXmlmc, &buffer)
 				}
 				if strTeamID != "" && strTeamName != "" {
@@ -295,7 +504,7 @@ func logNewCall(jobs chan RequestDetails, wg *sync.WaitGroup, espXmlmc *apiLib.X
 			// Site ID and Name
 			if strAttribute == "h_site" {
 				//-- Get site ID
-				siteID, siteName := getSiteID(callMap, espXmlmc, &buffer)
+				siteID, siteName := getSiteID(callMap, callConf, espXmlmc, &buffer)
 				if siteID != "" && siteName != "" {
 					coreFields["h_site_id"] = siteID
 					coreFields[strAttribute] = siteName
@@ -305,12 +514,9 @@ func logNewCall(jobs chan RequestDetails, wg *sync.WaitGroup, espXmlmc *apiLib.X
 
 			// Resolved Date/Time
 			if strAttribute == "h_dateresolved" && strMapping != "" && (strStatus == "status.resolved" || strStatus == "status.closed") {
-				resolvedEPOCH := getFieldValue(strMapping, callMap)
-				if resolvedEPOCH != "" && resolvedEPOCH != "0" {
-					strResolvedDate := epochToDateTime(resolvedEPOCH)
-					if strResolvedDate != "" {
-						coreFields[strAttribute] = strResolvedDate
-					}
+				strResolvedDate := getMappedFieldValue(strAttribute, strMapping, callMap)
+				if strResolvedDate != "" {
+					coreFields[strAttribute] = strResolvedDate
 				}
 			}
 
@@ -349,8 +555,8 @@ func logNewCall(jobs chan RequestDetails, wg *sync.WaitGroup, espXmlmc *apiLib.X
 				strAttribute != "h_dateresolved" &&
 				strAttribute != "h_dateclosed" {
 
-				if strMapping != "" && getFieldValue(strMapping, callMap) != "" {
-					coreFields[strAttribute] = getFieldValue(strMapping, callMap)
+				if strMapping != "" && getMappedFieldValue(strAttribute, strMapping, callMap) != "" {
+					coreFields[strAttribute] = getMappedFieldValue(strAttribute, strMapping, callMap)
 				}
 			}
 
@@ -366,25 +572,35 @@ func logNewCall(jobs chan RequestDetails, wg *sync.WaitGroup, espXmlmc *apiLib.X
 			espXmlmc.SetParam(k, v)
 		}
 
-		//Add request class & prefix
-		espXmlmc.SetParam("h_requesttype", callClass)
-		espXmlmc.SetParam("h_request_prefix", reqPrefix)
+		if smDeltaRef != "" {
+			//Updating a request imported by a previous run
+			espXmlmc.SetParam("h_pk_reference", smDeltaRef)
+		} else {
+			//Add request class & prefix
+			espXmlmc.SetParam("h_requesttype", callClass)
+			espXmlmc.SetParam("h_request_prefix", requestClass.Prefix)
+		}
 		espXmlmc.CloseElement("record")
 		espXmlmc.CloseElement("primaryEntityData")
 
+		relatedEntityAction := "insert"
+		if smDeltaRef != "" {
+			relatedEntityAction = "update"
+		}
+
 		//Class Specific Data Insert
 		espXmlmc.OpenElement("relatedEntityData")
 		espXmlmc.SetParam("relationshipName", "Call Type")
-		espXmlmc.SetParam("entityAction", "insert")
+		espXmlmc.SetParam("entityAction", relatedEntityAction)
 		espXmlmc.OpenElement("record")
 		strAttribute = ""
 		strMapping = ""
 		//Loop through AdditionalFieldMapping fields from config, add to XMLMC Params if not empty
-		for k, v := range mapGenericConf.AdditionalFieldMapping {
+		for k, v := range callConf.AdditionalFieldMapping {
 			strAttribute = fmt.Sprintf("%v", k)
 			strMapping = fmt.Sprintf("%v", v)
-			if strMapping != "" && getFieldValue(strMapping, callMap) != "" {
-				espXmlmc.SetParam(strAttribute, getFieldValue(strMapping, callMap))
+			if strMapping != "" && getMappedFieldValue(strAttribute, strMapping, callMap) != "" {
+				espXmlmc.SetParam(strAttribute, getMappedFieldValue(strAttribute, strMapping, callMap))
 			}
 		}
 
@@ -394,20 +610,20 @@ func logNewCall(jobs chan RequestDetails, wg *sync.WaitGroup, espXmlmc *apiLib.X
 		//Extended Data Insert
 		espXmlmc.OpenElement("relatedEntityData")
 		espXmlmc.SetParam("relationshipName", "Extended Information")
-		espXmlmc.SetParam("entityAction", "insert")
+		espXmlmc.SetParam("entityAction", relatedEntityAction)
 		espXmlmc.OpenElement("record")
 		espXmlmc.SetParam("h_request_type", callClass)
 		strAttribute = ""
 		strMapping = ""
 		//Loop through AdditionalFieldMapping fields from config, add to XMLMC Params if not empty
-		for k, v := range mapGenericConf.AdditionalFieldMapping {
+		for k, v := range callConf.AdditionalFieldMapping {
 			strAttribute = fmt.Sprintf("%v", k)
 			strSubString := "h_custom_"
 			if strings.Contains(strAttribute, strSubString) {
 				strAttribute = convExtendedColName(strAttribute)
 				strMapping = fmt.Sprintf("%v", v)
-				if strMapping != "" && getFieldValue(strMapping, callMap) != "" {
-					espXmlmc.SetParam(strAttribute, getFieldValue(strMapping, callMap))
+				if strMapping != "" && getMappedFieldValue(fmt.Sprintf("%v", k), strMapping, callMap) != "" {
+					espXmlmc.SetParam(strAttribute, getMappedFieldValue(fmt.Sprintf("%v", k), strMapping, callMap))
 				}
 			}
 		}
@@ -416,214 +632,105 @@ func logNewCall(jobs chan RequestDetails, wg *sync.WaitGroup, espXmlmc *apiLib.X
 		espXmlmc.CloseElement("relatedEntityData")
 
 		//-- Check for Dry Run
-		if !configDryRun {
+		if !configDryRun && smDeltaRef != "" {
+			updateDeltaRequest(swCallID, smDeltaRef, requestClass, espXmlmc, &buffer)
+		} else if !configDryRun {
 			XMLRequest := espXmlmc.GetParam()
 			if configDebug {
 				buffer.WriteString(loggerGen(1, "entityAddRecord::Requests:"+XMLRequest))
 			}
-			XMLCreate, xmlmcErr := espXmlmc.Invoke("data", "entityAddRecord")
-			if xmlmcErr != nil {
-				buffer.WriteString(loggerGen(4, xmlmcErr.Error()))
-				if configSplitLogs {
-					uploadLogger(xmlmcErr.Error())
-					uploadLogger(XMLRequest)
-				}
-				continue
-			}
-			var xmlRespon xmlmcRequestResponseStruct
-
-			err := xml.Unmarshal([]byte(XMLCreate), &xmlRespon)
-			if err != nil {
-				mutexCounters.Lock()
-				counters.createdSkipped++
-				mutexCounters.Unlock()
-				buffer.WriteString(loggerGen(4, err.Error()))
-				if configSplitLogs {
-					uploadLogger(err.Error())
-					uploadLogger(XMLRequest)
+			//If the outcome of the create is unknown, such as after a timeout, the request is searched for by its external
+			//reference before the create is retried, so a request the instance did create is not created twice
+			var createApplied func() (bool, error)
+			if externalRef := getExternalRef(callConf, callMap); externalRef != "" {
+				createApplied = func() (bool, error) {
+					existingRef, err := searchRequestByExternalRef(externalRef, espXmlmc)
+					strNewCallRef = existingRef
+					return existingRef != "", err
 				}
-				continue
 			}
-			if xmlRespon.MethodResult != "ok" {
-				mutexCounters.Lock()
-				counters.createdSkipped++
-				mutexCounters.Unlock()
-				buffer.WriteString(loggerGen(4, "Log Request Failed ["+xmlRespon.State.ErrorRet+"]"))
-				if configSplitLogs {
-					uploadLogger(xmlRespon.State.ErrorRet)
-					uploadLogger(XMLRequest)
-				}
+			XMLCreate, xmlmcErr := invokeXmlmcWrite(espXmlmc, "data", "entityAddRecord", createApplied)
+			if xmlmcErr == errXmlmcWriteApplied {
+				buffer.WriteString(loggerGen(5, "The request create failed, but request ["+strNewCallRef+"] was found with the External Reference of the call, so has not been created again"))
 			} else {
-				strNewCallRef = xmlRespon.RequestID
-				buffer.WriteString(loggerGen(1, "Log Request Successful ["+strNewCallRef+"]"))
-				mutexArrCallsLogged.Lock()
-				arrCallsLogged[swCallID] = strNewCallRef
-				mutexArrCallsLogged.Unlock()
-
-				mutexCounters.Lock()
-				counters.created++
-				mutexCounters.Unlock()
-
-				//Now update the request to create the activity stream
-				espXmlmc.SetParam("socialObjectRef", "urn:sys:entity:"+appServiceManager+":Requests:"+strNewCallRef)
-				espXmlmc.SetParam("content", "Request imported from Supportworks")
-				espXmlmc.SetParam("visibility", "public")
-				espXmlmc.SetParam("type", "Logged")
-				if configDebug {
-					buffer.WriteString(loggerGen(1, "activity::postMessage:"+espXmlmc.GetParam()))
-				}
-				fixed, err := espXmlmc.Invoke("activity", "postMessage")
-				if err != nil {
-					buffer.WriteString(loggerGen(5, "Activity Stream Creation failed for Request ["+strNewCallRef+"]"))
-				} else {
-					var xmlRespon xmlmcResponse
-					err = xml.Unmarshal([]byte(fixed), &xmlRespon)
-					if err != nil {
-						buffer.WriteString(loggerGen(5, "Activity Stream Creation unmarshall failed for Request ["+strNewCallRef+"]"))
-					} else {
-						if xmlRespon.MethodResult != "ok" {
-							buffer.WriteString(loggerGen(5, "Activity Stream Creation was unsuccessful for ["+strNewCallRef+"]: "+xmlRespon.MethodResult))
-						} else {
-							buffer.WriteString(loggerGen(1, "Activity Stream Creation successful"))
-						}
+				if xmlmcErr != nil {
+					mutexCounters.Lock()
+					requestClass.Counters.createdSkipped++
+					mutexCounters.Unlock()
+					circuitBreaker.recordFailure(xmlmcErr.Error())
+					buffer.WriteString(loggerGen(4, xmlmcErr.Error()))
+					if configSplitLogs {
+						uploadLogger(xmlmcErr.Error())
+						uploadLogger(XMLRequest)
 					}
+					continue
 				}
+				var xmlRespon xmlmcRequestResponseStruct
 
-				//Now update Logdate
-				if boolUpdateLogDate {
-					espXmlmc.SetParam("application", appServiceManager)
-					espXmlmc.SetParam("entity", "Requests")
-					espXmlmc.OpenElement("primaryEntityData")
-					espXmlmc.OpenElement("record")
-					espXmlmc.SetParam("h_pk_reference", strNewCallRef)
-					espXmlmc.SetParam("h_datelogged", strLoggedDate)
-					espXmlmc.CloseElement("record")
-					espXmlmc.CloseElement("primaryEntityData")
-					if configDebug {
-						buffer.WriteString(loggerGen(1, "entityUpdateRecord::Requests::logDate:"+espXmlmc.GetParam()))
-					}
-					XMLLogDate, xmlmcErr := espXmlmc.Invoke("data", "entityUpdateRecord")
-					if xmlmcErr != nil {
-						buffer.WriteString(loggerGen(4, "Unable to update Log Date of request ["+strNewCallRef+"] : "+xmlmcErr.Error()))
-					}
-					var xmlRespon xmlmcResponse
-
-					errLogDate := xml.Unmarshal([]byte(XMLLogDate), &xmlRespon)
-					if errLogDate != nil {
-						buffer.WriteString(loggerGen(4, "Unable to update Log Date of request ["+strNewCallRef+"] : "+errLogDate.Error()))
-					}
-					if xmlRespon.MethodResult != "ok" {
-						buffer.WriteString(loggerGen(4, "Unable to update Log Date of request ["+strNewCallRef+"] : "+xmlRespon.State.ErrorRet))
+				err := xml.Unmarshal([]byte(XMLCreate), &xmlRespon)
+				if err != nil {
+					mutexCounters.Lock()
+					requestClass.Counters.createdSkipped++
+					mutexCounters.Unlock()
+					circuitBreaker.recordFailure(err.Error())
+					buffer.WriteString(loggerGen(4, err.Error()))
+					if configSplitLogs {
+						uploadLogger(err.Error())
+						uploadLogger(XMLRequest)
 					}
+					continue
 				}
-
-				//Now add status history
-				addStatusHistory(strNewCallRef, strStatus, strLoggedDate, espXmlmc, &buffer)
-
-				//Now do BPM Processing
-				if strStatus != "status.resolved" &&
-					strStatus != "status.closed" &&
-					strStatus != "status.cancelled" {
-
-					if strNewCallRef != "" && strServiceBPM != "" {
-						espXmlmc.SetParam("application", appServiceManager)
-						espXmlmc.SetParam("name", strServiceBPM)
-						espXmlmc.SetParam("reference", strNewCallRef)
-						espXmlmc.OpenElement("inputParam")
-						espXmlmc.SetParam("name", "objectRefUrn")
-						espXmlmc.SetParam("value", "urn:sys:entity:"+appServiceManager+":Requests:"+strNewCallRef)
-						espXmlmc.CloseElement("inputParam")
-						espXmlmc.OpenElement("inputParam")
-						espXmlmc.SetParam("name", "requestId")
-						espXmlmc.SetParam("value", strNewCallRef)
-						espXmlmc.CloseElement("inputParam")
-						XMLBPM, xmlmcErr := espXmlmc.Invoke("bpm", "processSpawn2")
-						if xmlmcErr != nil {
-							buffer.WriteString(loggerGen(4, "Unable to invoke BPM for request ["+strNewCallRef+"]: "+xmlmcErr.Error()))
-						}
-						var xmlRespon xmlmcBPMSpawnedStruct
-
-						errBPM := xml.Unmarshal([]byte(XMLBPM), &xmlRespon)
-						if errBPM != nil {
-							buffer.WriteString(loggerGen(4, "Unable to read response when invoking BPM for request ["+strNewCallRef+"]:"+errBPM.Error()))
-						}
-						if xmlRespon.MethodResult != "ok" {
-							buffer.WriteString(loggerGen(4, "Unable to invoke BPM for request ["+strNewCallRef+"]: "+xmlRespon.State.ErrorRet))
-						} else {
-							//Now, associate spawned BPM to the new Request
-							espXmlmc.SetParam("application", appServiceManager)
-							espXmlmc.SetParam("entity", "Requests")
-							espXmlmc.OpenElement("primaryEntityData")
-							espXmlmc.OpenElement("record")
-							espXmlmc.SetParam("h_pk_reference", strNewCallRef)
-							espXmlmc.SetParam("h_bpm_id", xmlRespon.Identifier)
-							espXmlmc.CloseElement("record")
-							espXmlmc.CloseElement("primaryEntityData")
-							if configDebug {
-								buffer.WriteString(loggerGen(1, "entityUpdateRecord::Requests::bpmId:"+espXmlmc.GetParam()))
-							}
-							XMLBPMUpdate, xmlmcErr := espXmlmc.Invoke("data", "entityUpdateRecord")
-							if xmlmcErr != nil {
-								buffer.WriteString(loggerGen(4, "Unable to associated spawned BPM to request ["+strNewCallRef+"]: "+xmlmcErr.Error()))
-							}
-							var xmlRespon xmlmcResponse
-
-							errBPMSpawn := xml.Unmarshal([]byte(XMLBPMUpdate), &xmlRespon)
-							if errBPMSpawn != nil {
-								buffer.WriteString(loggerGen(4, "Unable to read response from Hornbill instance when updating BPM on ["+strNewCallRef+"]:"+errBPMSpawn.Error()))
-							}
-							if xmlRespon.MethodResult != "ok" {
-								buffer.WriteString(loggerGen(4, "Unable to associate BPM to Request ["+strNewCallRef+"]: "+xmlRespon.State.ErrorRet))
-							}
-						}
+				if xmlRespon.MethodResult != "ok" {
+					mutexCounters.Lock()
+					requestClass.Counters.createdSkipped++
+					mutexCounters.Unlock()
+					circuitBreaker.recordFailure(xmlRespon.State.ErrorRet)
+					buffer.WriteString(loggerGen(4, "Log Request Failed ["+xmlRespon.State.ErrorRet+"]"))
+					if configSplitLogs {
+						uploadLogger(xmlRespon.State.ErrorRet)
+						uploadLogger(XMLRequest)
 					}
+					continue
 				}
+				strNewCallRef = xmlRespon.RequestID
+			}
+			circuitBreaker.recordSuccess()
+			buffer.WriteString(loggerGen(1, "Log Request Successful ["+strNewCallRef+"]"))
+			mutexArrCallsLogged.Lock()
+			arrCallsLogged[swCallID] = strNewCallRef
+			mutexArrCallsLogged.Unlock()
+			stepData := &requestStepDataStruct{
+				Status:        strStatus,
+				LoggedDate:    strLoggedDate,
+				UpdateLogDate: boolUpdateLogDate,
+				ClosedDate:    strClosedDate,
+				OnHold:        boolOnHoldRequest,
+				ServiceBPM:    strServiceBPM,
+				UpdateIndexes: make([]int, 0),
+			}
+			writeLedgerEntry(ledgerEntryStruct{SwCallRef: swCallID, SmCallRef: strNewCallRef, CallClass: callClass, StepData: stepData, Steps: getPendingSteps()})
 
-				// Now handle calls in an On Hold status
-				if boolOnHoldRequest {
-					espXmlmc.SetParam("requestId", strNewCallRef)
-					espXmlmc.SetParam("onHoldUntil", strClosedDate)
-					espXmlmc.SetParam("strReason", "Request imported from Supportworks in an On Hold status. See Historical Request Updates for further information.")
-					if configDebug {
-						buffer.WriteString(loggerGen(1, "OnHoldXMLMC: "+espXmlmc.GetParam()))
-					}
-					XMLBPM, xmlmcErr := espXmlmc.Invoke("apps/"+appServiceManager+"/Requests", "holdRequest")
-					if xmlmcErr != nil {
-						//log.Fatal(xmlmcErr)
-						buffer.WriteString(loggerGen(4, "Unable to place request on hold ["+strNewCallRef+"] : "+xmlmcErr.Error()))
-					}
-					var xmlRespon xmlmcResponse
-
-					errLogDate := xml.Unmarshal([]byte(XMLBPM), &xmlRespon)
-					if errLogDate != nil {
-						buffer.WriteString(loggerGen(4, "Unable to place request on hold ["+strNewCallRef+"] : "+errLogDate.Error()))
-					}
-					if xmlRespon.MethodResult != "ok" {
-						buffer.WriteString(loggerGen(4, "Unable to place request on hold ["+strNewCallRef+"] : "+xmlRespon.State.ErrorRet))
-					}
-				}
+			mutexCounters.Lock()
+			requestClass.Counters.created++
+			mutexCounters.Unlock()
 
-				//Now apply historic updates
-				request := RequestReferences{SwCallID: swCallID, SmCallID: strNewCallRef}
-				applyHistoricalUpdates(request, espXmlmc, &buffer)
-			}
+			//Now run the activity stream, log date, status history, BPM, on hold & historic update steps
+			request := RequestReferences{SwCallID: swCallID, SmCallID: strNewCallRef}
+			runRequestSteps(request, stepData, requestSteps, espXmlmc, &buffer)
 		} else {
 			//-- DEBUG XML TO LOG FILE
 			var XMLSTRING = espXmlmc.GetParam()
 			buffer.WriteString(loggerGen(1, "Request Log XML "+XMLSTRING))
 			mutexCounters.Lock()
-			counters.createdSkipped++
+			requestClass.Counters.createdSkipped++
 			mutexCounters.Unlock()
 			espXmlmc.ClearParam()
 		}
-		bufferMutex.Lock()
-		loggerWriteBuffer(buffer.String())
-		bufferMutex.Unlock()
-		buffer.Reset()
 	}
 }
 
-func addStatusHistory(requestRef, requestStatus, dateLogged string, espXmlmc *apiLib.XmlmcInstStruct, buffer *bytes.Buffer) {
+//addStatusHistory - adds the initial status history record for an imported request
+func addStatusHistory(requestRef, requestStatus, dateLogged string, espXmlmc *apiLib.XmlmcInstStruct, buffer *bytes.Buffer) bool {
 	espXmlmc.SetParam("application", "com.hornbill.servicemanager")
 	espXmlmc.SetParam("entity", "RequestStatusHistory")
 	espXmlmc.OpenElement("primaryEntityData")
@@ -634,23 +741,24 @@ func addStatusHistory(requestRef, requestStatus, dateLogged string, espXmlmc *ap
 	espXmlmc.CloseElement("record")
 	espXmlmc.CloseElement("primaryEntityData")
 	XMLPub := espXmlmc.GetParam()
-	XMLPublish, xmlmcErr := espXmlmc.Invoke("data", "entityAddRecord")
+	XMLPublish, xmlmcErr := invokeXmlmc(espXmlmc, "data", "entityAddRecord")
 	if xmlmcErr != nil {
 		buffer.WriteString(loggerGen(4, "XMLMC error: Unable to add status history record for ["+requestRef+"] : "+xmlmcErr.Error()))
 		buffer.WriteString(loggerGen(1, XMLPub))
-		return
+		return false
 	}
 	var xmlRespon xmlmcResponse
 	errLogDate := xml.Unmarshal([]byte(XMLPublish), &xmlRespon)
 	if errLogDate != nil {
 		buffer.WriteString(loggerGen(4, "Unmarshal error: Unable to add status history record for ["+requestRef+"] : "+errLogDate.Error()))
 		buffer.WriteString(loggerGen(1, XMLPub))
-		return
+		return false
 	}
 	if xmlRespon.MethodResult != "ok" {
 		buffer.WriteString(loggerGen(4, "MethodResult not OK: Unable to add status history record for ["+requestRef+"] : "+xmlRespon.State.ErrorRet))
 		buffer.WriteString(loggerGen(1, XMLPub))
-		return
+		return false
 	}
 	buffer.WriteString(loggerGen(1, "Request Status History record success: ["+requestRef+"]"))
+	return true
 }
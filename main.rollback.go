@@ -0,0 +1,223 @@
+package main
+
+import (
+	"encoding/xml"
+	"sort"
+	"strconv"
+	"strings"
+
+	apiLib "github.com/hornbill/goApiLib"
+	"github.com/hornbill/pb"
+)
+
+// rollbackEntityStruct - an entity holding records that relate to an imported request
+type rollbackEntityStruct struct {
+	Entity       string
+	FilterColumn string
+	KeyColumn    string
+}
+
+// rollbackEntities - the request-related records removed by a rollback, in the order they are removed
+var rollbackEntities = []rollbackEntityStruct{
+	{Entity: "RequestHistoricUpdateAttachments", FilterColumn: "h_callref", KeyColumn: "h_pk_fileid"},
+	{Entity: "RequestHistoricUpdates", FilterColumn: "h_fk_reference", KeyColumn: "h_pk_updateid"},
+	{Entity: "RequestAttachments", FilterColumn: "h_request_id", KeyColumn: "h_pk_id"},
+	{Entity: "RequestStatusHistory", FilterColumn: "h_request_id", KeyColumn: "h_pk_id"},
+}
+
+// processRollback - deletes every request created by the given import run, as recorded in the ledger
+func processRollback(runID, callClass string) {
+	mutexLedger.Lock()
+	rollbackEntries := make([]ledgerEntryStruct, 0)
+	knownRuns := make(map[string]bool)
+	for _, entry := range ledgerEntries {
+		if entry.SmCallRef == "" || entry.Steps[stepCreate] != stepStatusOK {
+			continue
+		}
+		knownRuns[entry.RunID] = true
+		if entry.RunID != runID || entry.Adopted {
+			continue
+		}
+		if callClass != "" && !strings.EqualFold(entry.CallClass, callClass) {
+			continue
+		}
+		rollbackEntries = append(rollbackEntries, *entry)
+	}
+	mutexLedger.Unlock()
+	sort.Slice(rollbackEntries, func(i, j int) bool {
+		return rollbackEntries[i].SwCallRef < rollbackEntries[j].SwCallRef
+	})
+
+	if len(rollbackEntries) == 0 {
+		logger(5, "No requests found in the ledger to roll back for run ["+runID+"]", true)
+		runList := make([]string, 0)
+		for knownRun := range knownRuns {
+			runList = append(runList, knownRun)
+		}
+		sort.Strings(runList)
+		if len(runList) > 0 {
+			logger(1, "Runs held in the ledger: "+strings.Join(runList, ", "), true)
+		}
+		return
+	}
+
+	if configDryRun {
+		logger(1, "Dry Run - the following "+strconv.Itoa(len(rollbackEntries))+" request(s) would be deleted:", true)
+		for _, entry := range rollbackEntries {
+			logger(1, entry.SmCallRef+" ["+entry.CallClass+"] imported from Supportworks call "+entry.SwCallRef, true)
+			for _, assoc := range entry.Associations {
+				logger(1, "    Association between ["+assoc.MasterRef+"] and ["+assoc.SlaveRef+"] would be removed", true)
+			}
+		}
+		return
+	}
+
+	espXmlmc, err := NewEspXmlmcSession()
+	if err != nil {
+		logger(4, "Could not connect to Hornbill Instance: "+err.Error(), true)
+		return
+	}
+	defer releaseInstanceSession(espXmlmc)
+	logger(1, "Rolling back "+strconv.Itoa(len(rollbackEntries))+" request(s) created by run ["+runID+"]", true)
+	bar := pb.StartNew(len(rollbackEntries))
+	for _, entry := range rollbackEntries {
+		waitWhilePaused()
+		if shutdownRequested() {
+			break
+		}
+		if rollbackRequest(entry, espXmlmc) {
+			writeLedgerEntry(ledgerEntryStruct{SwCallRef: entry.SwCallRef, Steps: map[string]string{stepCreate: stepStatusRolledBack}})
+			mutexArrCallsLogged.Lock()
+			delete(arrCallsLogged, entry.SwCallRef)
+			mutexArrCallsLogged.Unlock()
+			counters.rolledBack++
+		} else {
+			counters.rollbackFailed++
+		}
+		incrementBar(bar)
+	}
+	if shutdownRequested() {
+		bar.Finish()
+		logger(5, "Rollback stopped by a shutdown signal", true)
+	} else {
+		bar.FinishPrint("Rollback Complete")
+	}
+	logger(1, "Requests Rolled Back: "+strconv.Itoa(counters.rolledBack), true)
+	logger(1, "Requests Failed To Roll Back: "+strconv.Itoa(counters.rollbackFailed), true)
+}
+
+// rollbackRequest - removes the associations, related records and the request itself for a single ledger entry
+func rollbackRequest(entry ledgerEntryStruct, espXmlmc *apiLib.XmlmcInstStruct) bool {
+	rollbackOK := true
+	for _, assoc := range entry.Associations {
+		//Associations are recorded against both requests, and went with the other request if it has been rolled back
+		linkedRef := assoc.MasterRef
+		if linkedRef == entry.SmCallRef {
+			linkedRef = assoc.SlaveRef
+		}
+		if requestRolledBack(linkedRef) {
+			continue
+		}
+		if !removeAssocRecord(assoc, espXmlmc) {
+			rollbackOK = false
+		}
+	}
+	for _, relatedEntity := range rollbackEntities {
+		if !deleteRelatedRecords(entry.SmCallRef, relatedEntity, espXmlmc) {
+			rollbackOK = false
+		}
+	}
+	if !rollbackOK {
+		logger(4, "Not deleting request ["+entry.SmCallRef+"] as its related records could not all be removed", false)
+		return false
+	}
+	if !deleteEntityRecord("Requests", entry.SmCallRef, espXmlmc) {
+		return false
+	}
+	logger(1, "Request ["+entry.SmCallRef+"] imported from Supportworks call ["+entry.SwCallRef+"] rolled back", false)
+	return true
+}
+
+// removeAssocRecord - removes a request association created by the import
+func removeAssocRecord(assoc refStruct, espXmlmc *apiLib.XmlmcInstStruct) bool {
+	espXmlmc.SetParam("entityId", assoc.MasterRef)
+	espXmlmc.SetParam("entityName", "Requests")
+	espXmlmc.SetParam("linkedEntityId", assoc.SlaveRef)
+	espXmlmc.SetParam("linkedEntityName", "Requests")
+	XMLRemove, xmlmcErr := invokeXmlmc(espXmlmc, "apps/"+appServiceManager+"/RelationshipEntities", "remove")
+	if xmlmcErr != nil {
+		logger(4, "Unable to remove Request Association between ["+assoc.MasterRef+"] and ["+assoc.SlaveRef+"] :"+xmlmcErr.Error(), false)
+		return false
+	}
+	var xmlRespon xmlmcResponse
+	err := xml.Unmarshal([]byte(XMLRemove), &xmlRespon)
+	if err != nil {
+		logger(4, "Unable to read response from Hornbill instance for Request Association between ["+assoc.MasterRef+"] and ["+assoc.SlaveRef+"] :"+err.Error(), false)
+		return false
+	}
+	if xmlRespon.MethodResult != "ok" {
+		logger(4, "Unable to remove Request Association between ["+assoc.MasterRef+"] and ["+assoc.SlaveRef+"] : "+xmlRespon.State.ErrorRet, false)
+		return false
+	}
+	return true
+}
+
+// deleteRelatedRecords - deletes every record in the given entity that relates to the request
+func deleteRelatedRecords(requestRef string, relatedEntity rollbackEntityStruct, espXmlmc *apiLib.XmlmcInstStruct) bool {
+	for {
+		recordKeys, browseOK := browseRelatedRecordKeys(requestRef, relatedEntity, espXmlmc)
+		if !browseOK {
+			return false
+		}
+		if len(recordKeys) == 0 {
+			return true
+		}
+		deletedCount := 0
+		for _, recordKey := range recordKeys {
+			if deleteEntityRecord(relatedEntity.Entity, recordKey, espXmlmc) {
+				deletedCount++
+			}
+		}
+		if deletedCount < len(recordKeys) {
+			//Records could not be deleted, so would be returned by the next browse
+			return false
+		}
+	}
+}
+
+// browseRelatedRecordKeys - returns the primary keys of a page of records in the given entity that relate to the request
+func browseRelatedRecordKeys(requestRef string, relatedEntity rollbackEntityStruct, espXmlmc *apiLib.XmlmcInstStruct) ([]string, bool) {
+	recordKeys, err := browseEntityColumn(relatedEntity.Entity, relatedEntity.FilterColumn, requestRef, relatedEntity.KeyColumn, entityBrowsePageSize, espXmlmc)
+	if err != nil {
+		logger(4, "Unable to search "+relatedEntity.Entity+" for ["+requestRef+"]: "+err.Error(), false)
+		return recordKeys, false
+	}
+	return recordKeys, true
+}
+
+// deleteEntityRecord - deletes a single record from a Service Manager entity
+func deleteEntityRecord(entityName, recordKey string, espXmlmc *apiLib.XmlmcInstStruct) bool {
+	espXmlmc.SetParam("application", appServiceManager)
+	espXmlmc.SetParam("entity", entityName)
+	espXmlmc.SetParam("keyValue", recordKey)
+	if entityName == "Requests" {
+		espXmlmc.SetParam("preserveOneToOneData", "false")
+		espXmlmc.SetParam("preserveOneToManyData", "false")
+	}
+	XMLDelete, xmlmcErr := invokeXmlmc(espXmlmc, "data", "entityDeleteRecord")
+	if xmlmcErr != nil {
+		logger(4, "Unable to delete "+entityName+" record ["+recordKey+"]: "+xmlmcErr.Error(), false)
+		return false
+	}
+	var xmlRespon xmlmcResponse
+	err := xml.Unmarshal([]byte(XMLDelete), &xmlRespon)
+	if err != nil {
+		logger(4, "Unable to read response from Hornbill instance when deleting "+entityName+" record ["+recordKey+"]: "+err.Error(), false)
+		return false
+	}
+	if xmlRespon.MethodResult != "ok" {
+		logger(4, "Unable to delete "+entityName+" record ["+recordKey+"]: "+xmlRespon.State.ErrorRet, false)
+		return false
+	}
+	return true
+}
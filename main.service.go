@@ -11,11 +11,11 @@ import (
 )
 
 //getCallServiceID takes the Call Record and returns a correct Service ID if one exists on the Instance
-func getCallServiceID(swService string, espXmlmc *apiLib.XmlmcInstStruct, buffer *bytes.Buffer) string {
+func getCallServiceID(swService, callClass string, espXmlmc *apiLib.XmlmcInstStruct, buffer *bytes.Buffer) string {
 	serviceID := ""
 	serviceName := ""
-	if swImportConf.ServiceMapping[swService] != nil {
-		serviceName = fmt.Sprintf("%s", swImportConf.ServiceMapping[swService])
+	if mappedService := getMappedValue("ServiceMapping", callClass, swService); mappedService != nil {
+		serviceName = fmt.Sprintf("%s", mappedService)
 
 		if serviceName != "" {
 			serviceID = getServiceID(serviceName, espXmlmc, buffer)
@@ -58,7 +58,7 @@ func searchService(serviceName string, espXmlmc *apiLib.XmlmcInstStruct, buffer
 	espXmlmc.CloseElement("searchFilter")
 	espXmlmc.SetParam("maxResults", "1")
 
-	XMLServiceSearch, xmlmcErr := espXmlmc.Invoke("data", "entityBrowseRecords2")
+	XMLServiceSearch, xmlmcErr := invokeXmlmc(espXmlmc, "data", "entityBrowseRecords2")
 	if xmlmcErr != nil {
 		buffer.WriteString(loggerGen(4, "Unable to Search for Service: "+xmlmcErr.Error()))
 		//log.Fatal(xmlmcErr)
@@ -115,7 +115,7 @@ func getReleaseBPM(serviceID int, espXmlmc *apiLib.XmlmcInstStruct, buffer *byte
 	espXmlmc.SetParam("queryType", "logRequestBPM")
 	espXmlmc.CloseElement("queryOptions")
 
-	XMLServiceSearch, xmlmcErr := espXmlmc.Invoke("data", "queryExec")
+	XMLServiceSearch, xmlmcErr := invokeXmlmc(espXmlmc, "data", "queryExec")
 	if xmlmcErr != nil {
 		buffer.WriteString(loggerGen(4, "Unable to Search for Release BPM: "+xmlmcErr.Error()))
 		return
@@ -0,0 +1,118 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/xml"
+	"strings"
+	"sync"
+
+	apiLib "github.com/hornbill/goApiLib"
+)
+
+// The Hornbill session used by every XMLMC instance when logged in with a username and password.
+// The generation goes up each time the session is renewed, so instances still holding an older session
+// pick up the new one before their next call. Instances are released once they are no longer used, so only
+// those in use are tracked
+var (
+	sessionID          string
+	sessionGeneration  int
+	sessionInstanceGen = make(map[*apiLib.XmlmcInstStruct]int)
+	mutexSession       = &sync.Mutex{}
+)
+
+// sessionExpiredErrors - State.ErrorRet text that means the session has expired or is no longer valid
+var sessionExpiredErrors = []string{
+	"session expired",
+	"session has expired",
+	"invalid session",
+	"session is invalid",
+	"session is not valid",
+	"session does not exist",
+	"not logged in",
+}
+
+// startSession - records the session created by login, which is shared with every XMLMC instance
+func startSession(espXmlmc *apiLib.XmlmcInstStruct) {
+	mutexSession.Lock()
+	defer mutexSession.Unlock()
+	sessionID = espXmlmc.GetSessionID()
+	sessionGeneration = 1
+	sessionInstanceGen[espXmlmc] = sessionGeneration
+}
+
+// setInstanceSession - sets the current session against an XMLMC instance if it holds an older one, and returns
+// the generation of the session it holds. Returns 0 if the instance is not using a username and password session
+func setInstanceSession(espXmlmc *apiLib.XmlmcInstStruct) int {
+	mutexSession.Lock()
+	defer mutexSession.Unlock()
+	if swImportConf.HBConf.APIKey != "" || sessionGeneration == 0 {
+		return 0
+	}
+	if sessionInstanceGen[espXmlmc] != sessionGeneration {
+		espXmlmc.SetSessionID(sessionID)
+		sessionInstanceGen[espXmlmc] = sessionGeneration
+	}
+	return sessionGeneration
+}
+
+// releaseInstanceSession - forgets the session generation held by an XMLMC instance that is no longer used
+func releaseInstanceSession(espXmlmc *apiLib.XmlmcInstStruct) {
+	mutexSession.Lock()
+	defer mutexSession.Unlock()
+	delete(sessionInstanceGen, espXmlmc)
+}
+
+// sessionExpired - returns true if the response to an XMLMC call shows the session has expired
+func sessionExpired(response string, err error) bool {
+	if err != nil {
+		return err.Error() == "Invalid HTTP Response: 401"
+	}
+	var xmlRespon xmlmcResponse
+	if xml.Unmarshal([]byte(response), &xmlRespon) != nil || xmlRespon.MethodResult == "ok" {
+		return false
+	}
+	errorRet := strings.ToLower(xmlRespon.State.ErrorRet)
+	for _, expiredText := range sessionExpiredErrors {
+		if strings.Contains(errorRet, expiredText) {
+			return true
+		}
+	}
+	return false
+}
+
+// renewSession - logs on again after the session of the given generation expired. If another worker has already
+// renewed it, the new session is used without logging on again
+func renewSession(expiredGeneration int) bool {
+	mutexSession.Lock()
+	defer mutexSession.Unlock()
+	if sessionGeneration != expiredGeneration {
+		return true
+	}
+	logger(5, "Hornbill session has expired, logging in again as "+swImportConf.HBConf.UserName, false)
+	espXmlmcLogin := apiLib.NewXmlmcInstance(swImportConf.HBConf.InstanceID)
+	espXmlmcLogin.SetParam("userId", swImportConf.HBConf.UserName)
+	espXmlmcLogin.SetParam("password", base64.StdEncoding.EncodeToString([]byte(swImportConf.HBConf.Password)))
+	rateLimiter.wait()
+	XMLLogin, xmlmcErr := espXmlmcLogin.Invoke("session", "userLogon")
+	if xmlmcErr != nil {
+		logger(4, "Unable to renew Hornbill session: "+xmlmcErr.Error(), true)
+		return false
+	}
+	var xmlRespon xmlmcResponse
+	err := xml.Unmarshal([]byte(XMLLogin), &xmlRespon)
+	if err != nil {
+		logger(4, "Unable to renew Hornbill session: "+err.Error(), true)
+		return false
+	}
+	if xmlRespon.MethodResult != "ok" {
+		logger(4, "Unable to renew Hornbill session: "+xmlRespon.State.ErrorRet, true)
+		return false
+	}
+	sessionID = espXmlmcLogin.GetSessionID()
+	sessionGeneration++
+	mutexCounters.Lock()
+	counters.sessionRenewals++
+	mutexCounters.Unlock()
+	logger(1, "Hornbill session renewed", false)
+	return true
+}
@@ -0,0 +1,56 @@
+package main
+
+import (
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+)
+
+var (
+	shutdownSignalled bool
+	mutexShutdown     = &sync.Mutex{}
+)
+
+// watchForShutdown - on SIGINT or SIGTERM, stops the import once the requests in progress have finished.
+// A second signal stops the import straight away
+func watchForShutdown() {
+	signals := make(chan os.Signal, 2)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		receivedSignal := <-signals
+		mutexShutdown.Lock()
+		shutdownSignalled = true
+		mutexShutdown.Unlock()
+		logger(5, "Received "+receivedSignal.String()+" - the import will stop once the requests in progress have finished. Send the signal again to stop immediately", true)
+		receivedSignal = <-signals
+		logger(4, "Received "+receivedSignal.String()+" again - stopping immediately", true)
+		checkpointLedger()
+		os.Exit(1)
+	}()
+}
+
+// shutdownRequested - returns true once a shutdown signal has been received
+func shutdownRequested() bool {
+	mutexShutdown.Lock()
+	defer mutexShutdown.Unlock()
+	return shutdownSignalled
+}
+
+// importStopped - returns true if the import has been stopped by the circuit breaker or a shutdown signal
+func importStopped() bool {
+	return shutdownRequested() || circuitBreaker.isTripped()
+}
+
+// processShutdownStop - checkpoints the ledger after the import was stopped by a shutdown signal, and explains how to continue
+func processShutdownStop() {
+	checkpointLedger()
+	logger(5, "Import stopped by a shutdown signal", true)
+	if configRetryFailedSteps {
+		logger(5, "Run again with -retry-failed-steps to retry the steps that are still failing.", true)
+	} else if configDelta {
+		logger(5, "The delta watermark has not been moved on. Run the delta import again to continue.", true)
+	} else {
+		logger(5, "Every request created so far is recorded in the ledger "+getLedgerPath()+". Run again with -resume to continue.", true)
+	}
+}
@@ -11,9 +11,9 @@ import (
 )
 
 //getSiteID takes the Call Record and returns a correct Site ID if one exists on the Instance
-func getSiteID(callMap map[string]interface{}, espXmlmc *apiLib.XmlmcInstStruct, buffer *bytes.Buffer) (string, string) {
+func getSiteID(callMap map[string]interface{}, callConf swCallConfStruct, espXmlmc *apiLib.XmlmcInstStruct, buffer *bytes.Buffer) (string, string) {
 	siteID := ""
-	siteNameMapping := fmt.Sprintf("%v", mapGenericConf.CoreFieldMapping["h_site"])
+	siteNameMapping := fmt.Sprintf("%v", callConf.CoreFieldMapping["h_site"])
 	siteName := getFieldValue(siteNameMapping, callMap)
 	if siteName != "" {
 		siteIsInCache, SiteIDCache := recordInCache(siteName, "Site")
@@ -44,7 +44,7 @@ func searchSite(siteName string, espXmlmc *apiLib.XmlmcInstStruct, buffer *bytes
 	espXmlmc.CloseElement("searchFilter")
 	espXmlmc.SetParam("maxResults", "1")
 
-	XMLSiteSearch, xmlmcErr := espXmlmc.Invoke("data", "entityBrowseRecords")
+	XMLSiteSearch, xmlmcErr := invokeXmlmc(espXmlmc, "data", "entityBrowseRecords")
 	if xmlmcErr != nil {
 		buffer.WriteString(loggerGen(4, "Unable to Search for Site: "+xmlmcErr.Error()))
 		return boolReturn, intReturn
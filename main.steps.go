@@ -0,0 +1,326 @@
+package main
+
+import (
+	"bytes"
+	"encoding/xml"
+	"sort"
+	"strconv"
+
+	apiLib "github.com/hornbill/goApiLib"
+	"github.com/hornbill/pb"
+)
+
+// requestSteps - the steps run against each newly created request, in order
+var requestSteps = []string{stepActivity, stepLogDate, stepStatusHistory, stepBPM, stepHold, stepHistoric}
+
+// runRequestSteps - runs the given post-create steps against a request, recording each outcome in the ledger as the
+// step finishes, so a run that stops part way through leaves the remaining steps pending
+func runRequestSteps(request RequestReferences, stepData *requestStepDataStruct, steps []string, espXmlmc *apiLib.XmlmcInstStruct, buffer *bytes.Buffer) map[string]string {
+	stepResults := make(map[string]string)
+	for _, step := range steps {
+		stepResults[step] = runRequestStep(request, stepData, step, espXmlmc, buffer)
+		if !configDryRun {
+			writeLedgerEntry(ledgerEntryStruct{SwCallRef: request.SwCallID, StepData: stepData, Steps: map[string]string{step: stepResults[step]}})
+		}
+	}
+	return stepResults
+}
+
+// getPendingSteps - returns the step statuses recorded when a request is created, before any of its steps have run
+func getPendingSteps() map[string]string {
+	pendingSteps := map[string]string{stepCreate: stepStatusOK, stepAttachments: stepStatusPending}
+	for _, step := range requestSteps {
+		pendingSteps[step] = stepStatusPending
+	}
+	return pendingSteps
+}
+
+// stepNeedsRetry - returns true if a step of a request failed, or has no outcome because the run stopped before the
+// step finished. Only the attachments step is run against adopted requests
+func stepNeedsRetry(entry ledgerEntryStruct, step string) bool {
+	switch entry.Steps[step] {
+	case stepStatusFailed, stepStatusPending:
+		return true
+	case "":
+		return !entry.Adopted || step == stepAttachments
+	}
+	return false
+}
+
+// runRequestStep - runs a single post-create step against a request, returning the step status
+func runRequestStep(request RequestReferences, stepData *requestStepDataStruct, step string, espXmlmc *apiLib.XmlmcInstStruct, buffer *bytes.Buffer) string {
+	stepOK := true
+	switch step {
+	case stepActivity:
+		stepOK = addActivityStream(request.SmCallID, espXmlmc, buffer)
+	case stepLogDate:
+		if !stepData.UpdateLogDate {
+			return stepStatusSkipped
+		}
+		stepOK = updateLogDate(request.SmCallID, stepData.LoggedDate, espXmlmc, buffer)
+	case stepStatusHistory:
+		stepOK = addStatusHistory(request.SmCallID, stepData.Status, stepData.LoggedDate, espXmlmc, buffer)
+	case stepBPM:
+		if stepData.Status == "status.resolved" ||
+			stepData.Status == "status.closed" ||
+			stepData.Status == "status.cancelled" ||
+			stepData.ServiceBPM == "" {
+			return stepStatusSkipped
+		}
+		stepOK = spawnRequestBPM(request.SmCallID, stepData, espXmlmc, buffer)
+	case stepHold:
+		if !stepData.OnHold {
+			return stepStatusSkipped
+		}
+		stepOK = holdRequest(request.SmCallID, stepData.ClosedDate, espXmlmc, buffer)
+	case stepHistoric:
+		stepOK = applyHistoricalUpdates(request, stepData, espXmlmc, buffer)
+	}
+	if !stepOK {
+		return stepStatusFailed
+	}
+	return stepStatusOK
+}
+
+// addActivityStream - posts the initial activity stream message for an imported request
+func addActivityStream(requestRef string, espXmlmc *apiLib.XmlmcInstStruct, buffer *bytes.Buffer) bool {
+	espXmlmc.SetParam("socialObjectRef", "urn:sys:entity:"+appServiceManager+":Requests:"+requestRef)
+	espXmlmc.SetParam("content", "Request imported from Supportworks")
+	espXmlmc.SetParam("visibility", "public")
+	espXmlmc.SetParam("type", "Logged")
+	if configDebug {
+		buffer.WriteString(loggerGen(1, "activity::postMessage:"+espXmlmc.GetParam()))
+	}
+	fixed, err := invokeXmlmc(espXmlmc, "activity", "postMessage")
+	if err != nil {
+		buffer.WriteString(loggerGen(5, "Activity Stream Creation failed for Request ["+requestRef+"]"))
+		return false
+	}
+	var xmlRespon xmlmcResponse
+	err = xml.Unmarshal([]byte(fixed), &xmlRespon)
+	if err != nil {
+		buffer.WriteString(loggerGen(5, "Activity Stream Creation unmarshall failed for Request ["+requestRef+"]"))
+		return false
+	}
+	if xmlRespon.MethodResult != "ok" {
+		buffer.WriteString(loggerGen(5, "Activity Stream Creation was unsuccessful for ["+requestRef+"]: "+xmlRespon.MethodResult))
+		return false
+	}
+	buffer.WriteString(loggerGen(1, "Activity Stream Creation successful"))
+	return true
+}
+
+// updateLogDate - sets the logged date of an imported request to that of the Supportworks call
+func updateLogDate(requestRef, loggedDate string, espXmlmc *apiLib.XmlmcInstStruct, buffer *bytes.Buffer) bool {
+	espXmlmc.SetParam("application", appServiceManager)
+	espXmlmc.SetParam("entity", "Requests")
+	espXmlmc.OpenElement("primaryEntityData")
+	espXmlmc.OpenElement("record")
+	espXmlmc.SetParam("h_pk_reference", requestRef)
+	espXmlmc.SetParam("h_datelogged", loggedDate)
+	espXmlmc.CloseElement("record")
+	espXmlmc.CloseElement("primaryEntityData")
+	if configDebug {
+		buffer.WriteString(loggerGen(1, "entityUpdateRecord::Requests::logDate:"+espXmlmc.GetParam()))
+	}
+	XMLLogDate, xmlmcErr := invokeXmlmc(espXmlmc, "data", "entityUpdateRecord")
+	if xmlmcErr != nil {
+		buffer.WriteString(loggerGen(4, "Unable to update Log Date of request ["+requestRef+"] : "+xmlmcErr.Error()))
+		return false
+	}
+	var xmlRespon xmlmcResponse
+
+	errLogDate := xml.Unmarshal([]byte(XMLLogDate), &xmlRespon)
+	if errLogDate != nil {
+		buffer.WriteString(loggerGen(4, "Unable to update Log Date of request ["+requestRef+"] : "+errLogDate.Error()))
+		return false
+	}
+	if xmlRespon.MethodResult != "ok" {
+		buffer.WriteString(loggerGen(4, "Unable to update Log Date of request ["+requestRef+"] : "+xmlRespon.State.ErrorRet))
+		return false
+	}
+	return true
+}
+
+// spawnRequestBPM - spawns the service BPM workflow for an imported request, and associates it to the request.
+// If a previous run spawned the workflow but failed to associate it, only the association is retried
+func spawnRequestBPM(requestRef string, stepData *requestStepDataStruct, espXmlmc *apiLib.XmlmcInstStruct, buffer *bytes.Buffer) bool {
+	if stepData.BPMID == "" {
+		espXmlmc.SetParam("application", appServiceManager)
+		espXmlmc.SetParam("name", stepData.ServiceBPM)
+		espXmlmc.SetParam("reference", requestRef)
+		espXmlmc.OpenElement("inputParam")
+		espXmlmc.SetParam("name", "objectRefUrn")
+		espXmlmc.SetParam("value", "urn:sys:entity:"+appServiceManager+":Requests:"+requestRef)
+		espXmlmc.CloseElement("inputParam")
+		espXmlmc.OpenElement("inputParam")
+		espXmlmc.SetParam("name", "requestId")
+		espXmlmc.SetParam("value", requestRef)
+		espXmlmc.CloseElement("inputParam")
+		XMLBPM, xmlmcErr := invokeXmlmc(espXmlmc, "bpm", "processSpawn2")
+		if xmlmcErr != nil {
+			buffer.WriteString(loggerGen(4, "Unable to invoke BPM for request ["+requestRef+"]: "+xmlmcErr.Error()))
+			return false
+		}
+		var xmlRespon xmlmcBPMSpawnedStruct
+
+		errBPM := xml.Unmarshal([]byte(XMLBPM), &xmlRespon)
+		if errBPM != nil {
+			buffer.WriteString(loggerGen(4, "Unable to read response when invoking BPM for request ["+requestRef+"]:"+errBPM.Error()))
+			return false
+		}
+		if xmlRespon.MethodResult != "ok" {
+			buffer.WriteString(loggerGen(4, "Unable to invoke BPM for request ["+requestRef+"]: "+xmlRespon.State.ErrorRet))
+			return false
+		}
+		stepData.BPMID = xmlRespon.Identifier
+	}
+
+	//Now, associate spawned BPM to the new Request
+	espXmlmc.SetParam("application", appServiceManager)
+	espXmlmc.SetParam("entity", "Requests")
+	espXmlmc.OpenElement("primaryEntityData")
+	espXmlmc.OpenElement("record")
+	espXmlmc.SetParam("h_pk_reference", requestRef)
+	espXmlmc.SetParam("h_bpm_id", stepData.BPMID)
+	espXmlmc.CloseElement("record")
+	espXmlmc.CloseElement("primaryEntityData")
+	if configDebug {
+		buffer.WriteString(loggerGen(1, "entityUpdateRecord::Requests::bpmId:"+espXmlmc.GetParam()))
+	}
+	XMLBPMUpdate, xmlmcErr := invokeXmlmc(espXmlmc, "data", "entityUpdateRecord")
+	if xmlmcErr != nil {
+		buffer.WriteString(loggerGen(4, "Unable to associated spawned BPM to request ["+requestRef+"]: "+xmlmcErr.Error()))
+		return false
+	}
+	var xmlRespon xmlmcResponse
+
+	errBPMSpawn := xml.Unmarshal([]byte(XMLBPMUpdate), &xmlRespon)
+	if errBPMSpawn != nil {
+		buffer.WriteString(loggerGen(4, "Unable to read response from Hornbill instance when updating BPM on ["+requestRef+"]:"+errBPMSpawn.Error()))
+		return false
+	}
+	if xmlRespon.MethodResult != "ok" {
+		buffer.WriteString(loggerGen(4, "Unable to associate BPM to Request ["+requestRef+"]: "+xmlRespon.State.ErrorRet))
+		return false
+	}
+	return true
+}
+
+// holdRequest - places an imported request on hold, until the closed date of the Supportworks call
+func holdRequest(requestRef, holdUntil string, espXmlmc *apiLib.XmlmcInstStruct, buffer *bytes.Buffer) bool {
+	espXmlmc.SetParam("requestId", requestRef)
+	espXmlmc.SetParam("onHoldUntil", holdUntil)
+	espXmlmc.SetParam("strReason", "Request imported from Supportworks in an On Hold status. See Historical Request Updates for further information.")
+	if configDebug {
+		buffer.WriteString(loggerGen(1, "OnHoldXMLMC: "+espXmlmc.GetParam()))
+	}
+	XMLBPM, xmlmcErr := invokeXmlmc(espXmlmc, "apps/"+appServiceManager+"/Requests", "holdRequest")
+	if xmlmcErr != nil {
+		buffer.WriteString(loggerGen(4, "Unable to place request on hold ["+requestRef+"] : "+xmlmcErr.Error()))
+		return false
+	}
+	var xmlRespon xmlmcResponse
+
+	errLogDate := xml.Unmarshal([]byte(XMLBPM), &xmlRespon)
+	if errLogDate != nil {
+		buffer.WriteString(loggerGen(4, "Unable to place request on hold ["+requestRef+"] : "+errLogDate.Error()))
+		return false
+	}
+	if xmlRespon.MethodResult != "ok" {
+		buffer.WriteString(loggerGen(4, "Unable to place request on hold ["+requestRef+"] : "+xmlRespon.State.ErrorRet))
+		return false
+	}
+	return true
+}
+
+// processRetryFailedSteps - re-runs only the failed and unfinished steps recorded in the ledger, without recreating
+// any requests
+func processRetryFailedSteps() {
+	mutexLedger.Lock()
+	retryEntries := make([]ledgerEntryStruct, 0)
+	for _, entry := range ledgerEntries {
+		if entry.SmCallRef == "" || entry.Steps[stepCreate] != stepStatusOK {
+			continue
+		}
+		for _, step := range append([]string{stepAttachments}, requestSteps...) {
+			if stepNeedsRetry(*entry, step) {
+				retryEntries = append(retryEntries, *entry)
+				break
+			}
+		}
+	}
+	mutexLedger.Unlock()
+	sort.Slice(retryEntries, func(i, j int) bool {
+		return retryEntries[i].SwCallRef < retryEntries[j].SwCallRef
+	})
+
+	logger(1, "Retrying failed steps for "+strconv.Itoa(len(retryEntries))+" request(s) from the ledger.", true)
+	if len(retryEntries) == 0 {
+		return
+	}
+	espXmlmc, err := NewEspXmlmcSession()
+	if err != nil {
+		logger(4, "Could not connect to Hornbill Instance: "+err.Error(), true)
+		return
+	}
+	defer releaseInstanceSession(espXmlmc)
+	bar := pb.StartNew(len(retryEntries))
+	for _, entry := range retryEntries {
+		waitWhilePaused()
+		if shutdownRequested() {
+			bar.Finish()
+			logger(5, "Failed Step Retry stopped by a shutdown signal", true)
+			return
+		}
+		var buffer bytes.Buffer
+		buffer.WriteString(loggerGen(3, "   "))
+		buffer.WriteString(loggerGen(1, "Retrying failed steps for Supportworks Ref: "+entry.SwCallRef+" ["+entry.SmCallRef+"]"))
+
+		retrySteps := make([]string, 0)
+		for _, step := range requestSteps {
+			if stepNeedsRetry(entry, step) {
+				retrySteps = append(retrySteps, step)
+			}
+		}
+		if len(retrySteps) > 0 {
+			if entry.StepData == nil {
+				buffer.WriteString(loggerGen(5, "No step data held in the ledger for ["+entry.SmCallRef+"], unable to retry steps"))
+			} else {
+				request := RequestReferences{SwCallID: entry.SwCallRef, SmCallID: entry.SmCallRef}
+				stepResults := runRequestSteps(request, entry.StepData, retrySteps, espXmlmc, &buffer)
+				for step, status := range stepResults {
+					buffer.WriteString(loggerGen(1, "Step ["+step+"] retried: "+status))
+					mutexCounters.Lock()
+					if status == stepStatusOK {
+						counters.stepsRetried++
+					} else {
+						counters.stepsFailed++
+					}
+					mutexCounters.Unlock()
+				}
+			}
+		}
+		//Only the files not already attached are attached again
+		if stepNeedsRetry(entry, stepAttachments) {
+			attachmentsOK := processFileAttachments(entry.SwCallRef, entry.SmCallRef, espXmlmc)
+			if !configDryRun {
+				recordLedgerStep(entry.SwCallRef, stepAttachments, attachmentsOK)
+			}
+			mutexCounters.Lock()
+			if attachmentsOK {
+				buffer.WriteString(loggerGen(1, "Step ["+stepAttachments+"] retried: "+stepStatusOK))
+				counters.stepsRetried++
+			} else {
+				buffer.WriteString(loggerGen(1, "Step ["+stepAttachments+"] retried: "+stepStatusFailed))
+				counters.stepsFailed++
+			}
+			mutexCounters.Unlock()
+		}
+		bufferMutex.Lock()
+		loggerWriteBuffer(buffer.String())
+		bufferMutex.Unlock()
+		incrementBar(bar)
+	}
+	bar.FinishPrint("Failed Step Retry Complete")
+}
@@ -1,6 +1,7 @@
 package main
 
 import (
+	"encoding/xml"
 	"sync"
 	"time"
 
@@ -15,13 +16,14 @@ const (
 	version           = "1.22.1"
 	repo              = "goSWRequestImport"
 	appServiceManager = "com.hornbill.servicemanager"
+	//entityBrowsePageSize - the number of records requested from each entityBrowseRecords2 call
+	entityBrowsePageSize = 100
 )
 
 var (
 	appDBDriver            string
 	cacheDBDriver          string
 	arrCallsLogged         = make(map[string]string)
-	arrCallDetailsMaps     = make([]map[string]interface{}, 0)
 	boolConfLoaded         bool
 	bufferMutex            = &sync.Mutex{}
 	configFileName         string
@@ -29,13 +31,21 @@ var (
 	configDebug            bool
 	configCustomerOrg      bool
 	configMaxRoutines      string
+	configMinRoutines      string
 	configVersion          bool
 	configSplitLogs        bool
+	configLedgerFile       string
+	configResume           bool
+	configRetryFailedSteps bool
+	configRollback         string
+	configRollbackClass    string
+	configDelta            bool
+	configExport           string
+	configImportArchive    string
 	connStrSysDB           string
 	connStrAppDB           string
 	espXmlmc               *apiLib.XmlmcInstStruct
 	counters               counterTypeStruct
-	mapGenericConf         swCallConfStruct
 	users                  []userListStruct
 	categories             []categoryListStruct
 	closeCategories        []categoryListStruct
@@ -46,7 +56,6 @@ var (
 	services               []serviceListStruct
 	sites                  []siteListStruct
 	teams                  []groupListStruct
-	sqlCallQuery           string
 	swImportConf           swImportConfStruct
 	timeNow                string
 	startTime              time.Time
@@ -64,8 +73,18 @@ var (
 	mutexServices          = &sync.Mutex{}
 	mutexSites             = &sync.Mutex{}
 	mutexTeams             = &sync.Mutex{}
-	reqPrefix              string
 	maxGoroutines          = 1
+	minGoroutines          = 1
+	configRequestRate      float64
+	configRetries          int
+	configRetryBackoff     int
+	configBreakerWindow    int
+	configBreakerRatio     float64
+	configBreakerStreak    int
+	configPauseFile        string
+	configPreflight        bool
+	configDiscoverFile     string
+	configValidateConf     bool
 	boolProcessAttachments bool
 	dbapp                  *sqlx.DB
 	dbsys                  *sqlx.DB
@@ -74,11 +93,26 @@ var (
 // ----- Structures -----
 type counterTypeStruct struct {
 	sync.Mutex
-	created          int
-	createdSkipped   int
-	existingRequests int
-	callsReturned    int
-	filesAttached    int
+	created           int
+	createdSkipped    int
+	existingRequests  int
+	resumedSkipped    int
+	notProcessed      int
+	stepsRetried      int
+	stepsFailed       int
+	duplicatesSkipped int
+	duplicatesAdopted int
+	rolledBack        int
+	rollbackFailed    int
+	updated           int
+	updateFailed      int
+	callsReturned     int
+	filesAttached     int
+	xmlmcRetries      int
+	xmlmcRecovered    int
+	xmlmcRetryFailed  int
+	sessionRenewals   int
+	fieldsSanitised   int
 }
 
 // ----- Config Data Structs
@@ -99,7 +133,37 @@ type swImportConfStruct struct {
 	ResolutionCategoryMapping map[string]interface{}
 	ServiceMapping            map[string]interface{}
 	StatusMapping             map[string]interface{}
+	MappingFiles              map[string]mappingFileStruct
+	LookupTables              map[string]lookupTableStruct
+	HistoricUpdateMapping     map[string]interface{}
+	FieldFormats              map[string]fieldFormatStruct
+	SourceTimeZone            string
 	ExistingRequestMappings   map[string]string
+	DuplicateRequestCheck     string
+	DeltaWatermarkColumn      string
+}
+type mappingFileStruct struct {
+	File          string
+	SourceColumn  string
+	TargetColumn  string
+	ClassColumn   string
+	MappingColumn string
+}
+type lookupTableStruct struct {
+	Values       map[string]string
+	Default      string
+	File         string
+	SourceColumn string
+	TargetColumn string
+}
+type fieldFormatStruct struct {
+	Type           string
+	NumberFormat   string
+	DateFormat     string
+	TrueValue      string
+	FalseValue     string
+	SourceFormat   string
+	SourceTimeZone string
 }
 type hbConfStruct struct {
 	InstanceID string
@@ -115,6 +179,7 @@ type sysDBConfStruct struct {
 	Driver   string
 	UserName string
 	Password string
+	Encoding string
 }
 type appDBConfStruct struct {
 	Driver           string
@@ -125,8 +190,10 @@ type appDBConfStruct struct {
 	Port             int
 	Database         string
 	Encrypt          bool
+	Encoding         string
 }
 type swCallConfStruct struct {
+	Description            string
 	Import                 bool
 	CallClass              string
 	SupportworksCallClass  string
@@ -134,6 +201,7 @@ type swCallConfStruct struct {
 	DefaultPriority        string
 	DefaultService         string
 	SQLStatement           string
+	SQLCountStatement      string
 	CoreFieldMapping       map[string]interface{}
 	AdditionalFieldMapping map[string]interface{}
 }
@@ -165,6 +233,11 @@ type xmlmcRequestResponseStruct struct {
 	Diags        []string    `xml:"diagnostic>log"`
 	State        stateStruct `xml:"state"`
 }
+type xmlmcRequestSearchResponse struct {
+	MethodResult string      `xml:"status,attr"`
+	RequestID    string      `xml:"params>rowData>row>h_pk_reference"`
+	State        stateStruct `xml:"state"`
+}
 type xmlmcBPMSpawnedStruct struct {
 	MethodResult string      `xml:"status,attr"`
 	Identifier   string      `xml:"params>identifier"`
@@ -297,6 +370,20 @@ type xmlmcContactListResponse struct {
 	State              stateStruct `xml:"state"`
 }
 
+// ----- Generic Entity Row Structs
+type xmlmcEntityRowsResponse struct {
+	MethodResult string                 `xml:"status,attr"`
+	Rows         []xmlmcEntityRowStruct `xml:"params>rowData>row"`
+	State        stateStruct            `xml:"state"`
+}
+type xmlmcEntityRowStruct struct {
+	Columns []xmlmcEntityColumnStruct `xml:",any"`
+}
+type xmlmcEntityColumnStruct struct {
+	XMLName xml.Name
+	Value   string `xml:",chardata"`
+}
+
 // ----- Associated Record Struct
 type reqRelStruct struct {
 	MasterRef string `db:"parentRequest"`
@@ -367,9 +454,18 @@ type fileAssocStruct struct {
 
 // RequestDetails struct for chan
 type RequestDetails struct {
-	CallClass string
-	CallMap   map[string]interface{}
-	SwCallID  string
+	Class    *requestClassStruct
+	CallMap  map[string]interface{}
+	SwCallID string
+	SmCallID string //Set in delta mode when the call has already been imported, so the request is updated
+}
+
+// requestClassStruct - a request class being imported, with its configuration, request prefix & counters
+type requestClassStruct struct {
+	Conf      swCallConfStruct
+	Prefix    string
+	Counters  counterTypeStruct
+	CallCount int //The number of calls that will be read, or 0 if this is not known
 }
 
 // RequestReferences struct for chan
@@ -10,11 +10,11 @@ import (
 )
 
 //getCallTeamID takes the Call Record and returns a correct Team ID if one exists on the Instance
-func getCallTeamID(swTeamID string, espXmlmc *apiLib.XmlmcInstStruct, buffer *bytes.Buffer) (string, string) {
+func getCallTeamID(swTeamID, callClass string, espXmlmc *apiLib.XmlmcInstStruct, buffer *bytes.Buffer) (string, string) {
 	teamID := ""
 	teamName := ""
-	if swImportConf.TeamMapping[swTeamID] != nil {
-		teamName = fmt.Sprintf("%s", swImportConf.TeamMapping[swTeamID])
+	if mappedTeam := getMappedValue("TeamMapping", callClass, swTeamID); mappedTeam != nil {
+		teamName = fmt.Sprintf("%s", mappedTeam)
 		if teamName != "" {
 			teamID = getTeamID(teamName, espXmlmc, buffer)
 		}
@@ -61,7 +61,7 @@ func searchTeam(teamName string, espXmlmc *apiLib.XmlmcInstStruct, buffer *bytes
 	espXmlmc.CloseElement("searchFilter")
 	espXmlmc.SetParam("maxResults", "1")
 
-	XMLTeamSearch, xmlmcErr := espXmlmc.Invoke("data", "entityBrowseRecords2")
+	XMLTeamSearch, xmlmcErr := invokeXmlmc(espXmlmc, "data", "entityBrowseRecords2")
 	if xmlmcErr != nil {
 		buffer.WriteString(loggerGen(4, "Unable to Search for Team: "+xmlmcErr.Error()))
 		//log.Fatal(xmlmcErr)
@@ -0,0 +1,447 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+)
+
+// configProblemStruct - a problem found in the configuration file. Errors stop the configuration from loading,
+// warnings are reported but the import can still run
+type configProblemStruct struct {
+	Path    string
+	Message string
+	Warning bool
+}
+
+var (
+	reFieldReference = regexp.MustCompile(`\[(.*?)\]`)
+	reColumnAlias    = regexp.MustCompile(`(?i)\s+as\s+(\S+)$`)
+	reSelectPrefix   = regexp.MustCompile(`(?i)^(distinct\s+|top\s+\d+\s+)+`)
+	reNumberFormat   = regexp.MustCompile(`^0(\.0+)?$`)
+)
+
+// validateConfig - checks the configuration file strictly against swImportConfStruct, reporting unknown keys and
+// values of the wrong type, then checks the SQL and field mappings of each enabled request type
+func validateConfig(configBytes []byte) []configProblemStruct {
+	problems := make([]configProblemStruct, 0)
+	var rawConf interface{}
+	err := json.Unmarshal(configBytes, &rawConf)
+	if err != nil {
+		if syntaxErr, ok := err.(*json.SyntaxError); ok {
+			line := strings.Count(string(configBytes[:syntaxErr.Offset]), "\n") + 1
+			return append(problems, configProblemStruct{Message: fmt.Sprintf("invalid JSON on line %d: %s", line, err.Error())})
+		}
+		return append(problems, configProblemStruct{Message: "invalid JSON: " + err.Error()})
+	}
+	//The $schema key lets editors find conf.schema.json, and is not part of the configuration
+	if rootObject, ok := rawConf.(map[string]interface{}); ok {
+		delete(rootObject, "$schema")
+	}
+	validateConfigValue(rawConf, reflect.TypeOf(swImportConfStruct{}), "", &problems)
+	for _, problem := range problems {
+		if !problem.Warning {
+			return problems
+		}
+	}
+
+	var importConf swImportConfStruct
+	err = json.Unmarshal(configBytes, &importConf)
+	if err != nil {
+		return append(problems, configProblemStruct{Message: err.Error()})
+	}
+	for i, callConf := range importConf.RequestTypesToImport {
+		if !callConf.Import {
+			continue
+		}
+		path := fmt.Sprintf("RequestTypesToImport[%d]", i)
+		if callConf.CallClass != "" {
+			path += " (" + callConf.CallClass + ")"
+		}
+		validateRequestType(callConf, path, importConf.LookupTables, &problems)
+	}
+
+	//Historic Updates are mapped from the columns of the CallDiaryQuery
+	for _, fieldName := range []string{"h_fk_reference", "h_updateindex"} {
+		if importConf.HistoricUpdateMapping[fieldName] != nil {
+			problems = append(problems, configProblemStruct{Path: "HistoricUpdateMapping." + fieldName, Message: "is set by the tool, and cannot be mapped"})
+		}
+	}
+	diaryColumns, columnsKnown := getSelectedColumns(importConf.CallDiaryQuery)
+	if !columnsKnown {
+		diaryColumns = nil
+	}
+	validateFieldMapping("HistoricUpdateMapping", importConf.HistoricUpdateMapping, diaryColumns, "CallDiaryQuery", importConf.LookupTables, &problems)
+	validateFieldFormats(importConf.FieldFormats, &problems)
+	validateTimeZone("SourceTimeZone", importConf.SourceTimeZone, &problems)
+	validateEncoding("SWSystemDBConf.Encoding", importConf.SWSystemDBConf.Encoding, &problems)
+	validateEncoding("SWAppDBConf.Encoding", importConf.SWAppDBConf.Encoding, &problems)
+	return problems
+}
+
+// validateFieldFormats - checks the type, number and date formats, and source time zone of each field in FieldFormats
+func validateFieldFormats(fieldFormats map[string]fieldFormatStruct, problems *[]configProblemStruct) {
+	fieldNames := make([]string, 0, len(fieldFormats))
+	for fieldName := range fieldFormats {
+		fieldNames = append(fieldNames, fieldName)
+	}
+	sort.Strings(fieldNames)
+	for _, fieldName := range fieldNames {
+		fieldFormat := fieldFormats[fieldName]
+		path := "FieldFormats." + fieldName
+		if fieldFormat.Type != "" && fieldFormat.Type != "date" && fieldFormat.Type != "text" {
+			*problems = append(*problems, configProblemStruct{Path: path + ".Type", Message: "must be date or text"})
+		}
+		if fieldFormat.NumberFormat != "" && !reNumberFormat.MatchString(fieldFormat.NumberFormat) {
+			*problems = append(*problems, configProblemStruct{Path: path + ".NumberFormat", Message: "must be 0, or 0 followed by a decimal point and one 0 for each decimal place, such as 0.00"})
+		}
+		if fieldFormat.DateFormat != "rfc3339" && !isDateLayout(fieldFormat.DateFormat) {
+			*problems = append(*problems, configProblemStruct{Path: path + ".DateFormat", Message: "must be epoch, epochms, rfc3339, or a layout using YYYY, MM, DD, HH, mm and ss"})
+		}
+		if !isDateLayout(fieldFormat.SourceFormat) {
+			*problems = append(*problems, configProblemStruct{Path: path + ".SourceFormat", Message: "must be epoch, epochms, or a layout using YYYY, MM, DD, HH, mm and ss"})
+		}
+		if fieldFormat.SourceFormat != "" && fieldFormat.Type != "date" && !dateFieldNames[fieldName] {
+			*problems = append(*problems, configProblemStruct{Path: path + ".SourceFormat", Message: "is only used by date fields, set Type to date", Warning: true})
+		}
+		validateTimeZone(path+".SourceTimeZone", fieldFormat.SourceTimeZone, problems)
+	}
+}
+
+// isDateLayout - returns true if a date format is empty, epoch, epochms, or a layout containing at least one token
+func isDateLayout(dateFormat string) bool {
+	switch dateFormat {
+	case "", "epoch", "epochms":
+		return true
+	}
+	return dateFormatTokens.Replace(dateFormat) != dateFormat
+}
+
+// validateEncoding - checks that the Encoding of a database connection is one that text can be read from
+func validateEncoding(path, encoding string, problems *[]configProblemStruct) {
+	if !isSourceEncoding(encoding) {
+		*problems = append(*problems, configProblemStruct{Path: path, Message: "must be one of " + strings.Join(sourceEncodings, ", ")})
+	}
+}
+
+// validateTimeZone - checks that a time zone is a name from the time zone database, such as Europe/London
+func validateTimeZone(path, zoneName string, problems *[]configProblemStruct) {
+	if zoneName == "" {
+		return
+	}
+	if _, err := time.LoadLocation(zoneName); err != nil {
+		*problems = append(*problems, configProblemStruct{Path: path, Message: "is not a known time zone, such as Europe/London: " + err.Error()})
+	}
+}
+
+// validateConfigValue - checks a decoded JSON value against the Go type it will be loaded in to
+func validateConfigValue(value interface{}, fieldType reflect.Type, path string, problems *[]configProblemStruct) {
+	switch fieldType.Kind() {
+	case reflect.Struct:
+		object, ok := value.(map[string]interface{})
+		if !ok {
+			addTypeProblem(value, "an object", path, problems)
+			return
+		}
+		keys := make([]string, 0, len(object))
+		for key := range object {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		for _, key := range keys {
+			field, ok := findConfigField(key, fieldType)
+			if !ok {
+				*problems = append(*problems, configProblemStruct{Path: joinConfigPath(path, key), Message: "unknown key" + suggestConfigKey(key, fieldType)})
+				continue
+			}
+			if field.Name != key {
+				*problems = append(*problems, configProblemStruct{Path: joinConfigPath(path, key), Message: "is loaded as " + field.Name + " as keys are matched without regard to case, but should be written " + field.Name, Warning: true})
+			}
+			validateConfigValue(object[key], field.Type, joinConfigPath(path, key), problems)
+		}
+	case reflect.Map:
+		object, ok := value.(map[string]interface{})
+		if !ok {
+			addTypeProblem(value, "an object", path, problems)
+			return
+		}
+		for key, mapValue := range object {
+			validateConfigValue(mapValue, fieldType.Elem(), joinConfigPath(path, key), problems)
+		}
+	case reflect.Slice:
+		array, ok := value.([]interface{})
+		if !ok {
+			addTypeProblem(value, "an array", path, problems)
+			return
+		}
+		for i, arrayValue := range array {
+			validateConfigValue(arrayValue, fieldType.Elem(), fmt.Sprintf("%s[%d]", path, i), problems)
+		}
+	case reflect.String:
+		if _, ok := value.(string); !ok {
+			addTypeProblem(value, "a string", path, problems)
+		}
+	case reflect.Bool:
+		if _, ok := value.(bool); !ok {
+			addTypeProblem(value, "true or false", path, problems)
+		}
+	case reflect.Int:
+		if number, ok := value.(float64); !ok || number != float64(int(number)) {
+			addTypeProblem(value, "a whole number", path, problems)
+		}
+	}
+}
+
+// addTypeProblem - records a value that is not of the type expected
+func addTypeProblem(value interface{}, expected string, path string, problems *[]configProblemStruct) {
+	if value == nil {
+		return
+	}
+	*problems = append(*problems, configProblemStruct{Path: path, Message: "should be " + expected + ", not " + describeJSONValue(value)})
+}
+
+// describeJSONValue - returns the JSON type of a decoded value
+func describeJSONValue(value interface{}) string {
+	switch value.(type) {
+	case map[string]interface{}:
+		return "an object"
+	case []interface{}:
+		return "an array"
+	case string:
+		return "a string"
+	case bool:
+		return "true or false"
+	case float64:
+		return "a number"
+	}
+	return "null"
+}
+
+// joinConfigPath - returns the path of a key within a configuration object
+func joinConfigPath(path, key string) string {
+	if path == "" {
+		return key
+	}
+	return path + "." + key
+}
+
+// findConfigField - returns the exported field a key is loaded in to. As with encoding/json, an exact match is
+// preferred, and otherwise the first field whose name differs only by case is used
+func findConfigField(key string, fieldType reflect.Type) (reflect.StructField, bool) {
+	if field, ok := fieldType.FieldByName(key); ok && field.IsExported() {
+		return field, true
+	}
+	for i := 0; i < fieldType.NumField(); i++ {
+		field := fieldType.Field(i)
+		if field.IsExported() && strings.EqualFold(field.Name, key) {
+			return field, true
+		}
+	}
+	return reflect.StructField{}, false
+}
+
+// suggestConfigKey - suggests the key that was probably meant, when an unknown key differs from one by a couple of
+// characters
+func suggestConfigKey(key string, fieldType reflect.Type) string {
+	bestKey := ""
+	bestDistance := 3
+	for i := 0; i < fieldType.NumField(); i++ {
+		fieldName := fieldType.Field(i).Name
+		distance := editDistance(strings.ToLower(key), strings.ToLower(fieldName))
+		if distance < bestDistance {
+			bestKey = fieldName
+			bestDistance = distance
+		}
+	}
+	if bestKey == "" {
+		return ""
+	}
+	return " - did you mean " + bestKey + "?"
+}
+
+// editDistance - returns the number of single character edits needed to turn one string in to another
+func editDistance(a, b string) int {
+	previous := make([]int, len(b)+1)
+	current := make([]int, len(b)+1)
+	for j := range previous {
+		previous[j] = j
+	}
+	for i := 1; i <= len(a); i++ {
+		current[0] = i
+		for j := 1; j <= len(b); j++ {
+			cost := 1
+			if a[i-1] == b[j-1] {
+				cost = 0
+			}
+			current[j] = minInt(minInt(previous[j]+1, current[j-1]+1), previous[j-1]+cost)
+		}
+		previous, current = current, previous
+	}
+	return previous[len(b)]
+}
+
+// minInt - returns the smaller of two ints
+func minInt(a, b int) int {
+	if a < b {
+		return a
+	}
+	return b
+}
+
+// validateRequestType - checks that an enabled request type has an SQLStatement, and that its field mappings are valid
+func validateRequestType(callConf swCallConfStruct, path string, lookupTables map[string]lookupTableStruct, problems *[]configProblemStruct) {
+	if strings.TrimSpace(callConf.SQLStatement) == "" {
+		*problems = append(*problems, configProblemStruct{Path: path + ".SQLStatement", Message: "must be set when Import is true"})
+		return
+	}
+	//The columns can't be worked out when, for example, the SQLStatement selects *
+	selectedColumns, columnsKnown := getSelectedColumns(callConf.SQLStatement)
+	if !columnsKnown {
+		selectedColumns = nil
+	}
+	validateFieldMapping(path+".CoreFieldMapping", callConf.CoreFieldMapping, selectedColumns, "SQLStatement", lookupTables, problems)
+	validateFieldMapping(path+".AdditionalFieldMapping", callConf.AdditionalFieldMapping, selectedColumns, "SQLStatement", lookupTables, problems)
+}
+
+// validateFieldMapping - checks that the expressions in a field mapping parse, that the lookup tables they use exist,
+// and that the mapping only refers to columns selected by its query. Columns aren't checked if selectedColumns is nil
+func validateFieldMapping(path string, fieldMapping map[string]interface{}, selectedColumns map[string]bool, queryName string, lookupTables map[string]lookupTableStruct, problems *[]configProblemStruct) {
+	fieldNames := make([]string, 0, len(fieldMapping))
+	for fieldName := range fieldMapping {
+		fieldNames = append(fieldNames, fieldName)
+	}
+	sort.Strings(fieldNames)
+	for _, fieldName := range fieldNames {
+		fieldPath := path + "." + fieldName
+		fieldTemplate := parseFieldTemplate(fmt.Sprintf("%v", fieldMapping[fieldName]))
+		if fieldTemplate.err != nil {
+			*problems = append(*problems, configProblemStruct{Path: fieldPath, Message: fieldTemplate.err.Error()})
+			continue
+		}
+		for _, tableName := range fieldTemplate.lookups {
+			if _, ok := lookupTables[tableName]; !ok {
+				*problems = append(*problems, configProblemStruct{Path: fieldPath, Message: "uses the lookup table " + tableName + ", which is not in LookupTables"})
+			}
+		}
+		if selectedColumns == nil {
+			continue
+		}
+		for _, columnName := range fieldTemplate.columns {
+			if columnName == "oldCallRef" || selectedColumns[strings.ToLower(columnName)] {
+				continue
+			}
+			*problems = append(*problems, configProblemStruct{Path: fieldPath, Message: "refers to [" + columnName + "], which is not selected by the " + queryName, Warning: true})
+		}
+	}
+}
+
+// getSelectedColumns - returns the lower case names of the columns returned by a SELECT statement.
+// Returns false if the columns cannot be worked out
+func getSelectedColumns(sqlStatement string) (map[string]bool, bool) {
+	selectList, ok := getSelectList(sqlStatement)
+	if !ok {
+		return nil, false
+	}
+	selectedColumns := make(map[string]bool)
+	for _, selectItem := range splitTopLevel(selectList) {
+		selectItem = strings.TrimSpace(reSelectPrefix.ReplaceAllString(strings.TrimSpace(selectItem), ""))
+		if selectItem == "*" || strings.HasSuffix(selectItem, ".*") {
+			return nil, false
+		}
+		columnName := selectItem
+		if alias := reColumnAlias.FindStringSubmatch(selectItem); alias != nil {
+			columnName = alias[1]
+		} else if lastSpace := strings.LastIndexAny(selectItem, " \t\r\n"); lastSpace != -1 && !strings.HasSuffix(selectItem, ")") {
+			columnName = selectItem[lastSpace+1:]
+		} else if lastDot := strings.LastIndex(selectItem, "."); lastDot != -1 {
+			columnName = selectItem[lastDot+1:]
+		}
+		columnName = strings.Trim(columnName, "`\"'[]")
+		selectedColumns[strings.ToLower(columnName)] = true
+	}
+	return selectedColumns, true
+}
+
+// getSelectList - returns the part of a SELECT statement between SELECT and its top level FROM
+func getSelectList(sqlStatement string) (string, bool) {
+	lowerStatement := strings.ToLower(sqlStatement)
+	selectPos := strings.Index(lowerStatement, "select")
+	if selectPos == -1 {
+		return "", false
+	}
+	depth := 0
+	var quote byte
+	for i := selectPos + len("select"); i < len(lowerStatement); i++ {
+		char := lowerStatement[i]
+		switch {
+		case quote != 0:
+			if char == quote {
+				quote = 0
+			}
+		case char == '\'' || char == '"' || char == '`':
+			quote = char
+		case char == '(':
+			depth++
+		case char == ')':
+			depth--
+		case depth == 0 && strings.HasPrefix(lowerStatement[i:], "from") && isSQLSpace(lowerStatement[i-1]) &&
+			(i+4 == len(lowerStatement) || isSQLSpace(lowerStatement[i+4])):
+			return sqlStatement[selectPos+len("select") : i], true
+		}
+	}
+	return "", false
+}
+
+// splitTopLevel - splits a select list on the commas that are not within brackets or quotes
+func splitTopLevel(selectList string) []string {
+	selectItems := make([]string, 0)
+	depth := 0
+	var quote byte
+	itemStart := 0
+	for i := 0; i < len(selectList); i++ {
+		char := selectList[i]
+		switch {
+		case quote != 0:
+			if char == quote {
+				quote = 0
+			}
+		case char == '\'' || char == '"' || char == '`':
+			quote = char
+		case char == '(':
+			depth++
+		case char == ')':
+			depth--
+		case char == ',' && depth == 0:
+			selectItems = append(selectItems, selectList[itemStart:i])
+			itemStart = i + 1
+		}
+	}
+	return append(selectItems, selectList[itemStart:])
+}
+
+// isSQLSpace - returns true if the character separates SQL keywords
+func isSQLSpace(char byte) bool {
+	return char == ' ' || char == '\t' || char == '\r' || char == '\n'
+}
+
+// logConfigProblems - writes each configuration problem to the log and console. Returns true if any are errors
+func logConfigProblems(problems []configProblemStruct) bool {
+	hasErrors := false
+	for _, problem := range problems {
+		problemDesc := problem.Message
+		if problem.Path != "" {
+			problemDesc = problem.Path + ": " + problem.Message
+		}
+		if problem.Warning {
+			logger(5, "Configuration: "+problemDesc, true)
+		} else {
+			hasErrors = true
+			logger(4, "Configuration: "+problemDesc, true)
+		}
+	}
+	return hasErrors
+}
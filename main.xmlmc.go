@@ -0,0 +1,307 @@
+package main
+
+import (
+	"encoding/xml"
+	"errors"
+	"io"
+	"math/rand"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	apiLib "github.com/hornbill/goApiLib"
+)
+
+// XMLMC retry tuning
+const (
+	xmlmcRetryMaxDelay = 30 * time.Second //Longest wait before any single retry
+)
+
+var (
+	retryRandom      = rand.New(rand.NewSource(time.Now().UnixNano()))
+	mutexRetryRandom = &sync.Mutex{}
+)
+
+// xmlmcTransientHTTPCodes - HTTP responses that mean the instance is busy or briefly unavailable, rather than the call being wrong
+var xmlmcTransientHTTPCodes = []string{"408", "429", "500", "502", "503", "504"}
+
+// xmlmcWriteMethods - methods that add to the instance, so replaying one the instance has already applied would add
+// a second request, record, file or post
+var xmlmcWriteMethods = map[string]bool{
+	"entityAddRecord":  true,
+	"entityAttachFile": true,
+	"postMessage":      true,
+	"processSpawn2":    true,
+	"holdRequest":      true,
+	"add":              true,
+	"logMessage":       true,
+}
+
+// xmlmcUnprocessedHTTPCodes - HTTP responses that mean the instance turned the call away without processing it
+var xmlmcUnprocessedHTTPCodes = []string{"429", "503"}
+
+// errXmlmcWriteApplied - returned in place of the error of a failed write, when the instance is found to have applied it
+var errXmlmcWriteApplied = errors.New("the call failed, but was applied by the instance")
+
+// xmlmcTransientErrors - State.ErrorRet text that means the instance is throttling or briefly unable to process the call,
+// rather than the call being rejected
+var xmlmcTransientErrors = []string{
+	"too many requests",
+	"rate limit",
+	"throttl",
+	"server is busy",
+	"server too busy",
+	"temporarily unavailable",
+	"service unavailable",
+	"try again",
+	"deadlock",
+	"lock wait timeout",
+}
+
+// invokeXmlmc - makes an XMLMC call to the instance, within the requests per second budget.
+// Transport errors and throttling are retried with a jittered exponential backoff. Business errors returned in
+// State.ErrorRet are not retried, and are passed back in the response for the caller to handle.
+// If the session has expired, the call is retried once after logging on again.
+// The response time and outcome of each attempt are recorded, so the number of active workers can follow the health of the instance
+func invokeXmlmc(espXmlmc *apiLib.XmlmcInstStruct, service, method string) (string, error) {
+	return invokeXmlmcWrite(espXmlmc, service, method, nil)
+}
+
+// invokeXmlmcWrite - makes an XMLMC call as invokeXmlmc. Methods that add to the instance are only retried when the call
+// failed before it reached the instance, or was turned away unprocessed. When the outcome of such a call is unknown,
+// such as after a timeout, writeApplied is used to find out whether the instance applied it: if it did,
+// errXmlmcWriteApplied is returned, and if not the call is retried. Without writeApplied the call is not retried
+func invokeXmlmcWrite(espXmlmc *apiLib.XmlmcInstStruct, service, method string, writeApplied func() (bool, error)) (string, error) {
+	//The params are cleared by a successful call, so are kept to be replayed if the call needs to be retried
+	paramsXML := espXmlmc.GetParam()
+	sessionRenewed := false
+	attempt := 0
+	for {
+		callSession := setInstanceSession(espXmlmc)
+		rateLimiter.wait()
+		callStart := time.Now()
+		response, err := espXmlmc.Invoke(service, method)
+		transientErr := xmlmcTransientError(response, err)
+		//Every failed call counts towards the error rate, not only those that will be retried
+		adaptiveWorkers.recordCall(time.Since(callStart), xmlmcCallFailed(response, err))
+
+		if callSession > 0 && !sessionRenewed && sessionExpired(response, err) {
+			sessionRenewed = true
+			if !renewSession(callSession) {
+				return response, err
+			}
+			if replayErr := replayXmlmcParams(espXmlmc, paramsXML); replayErr != nil {
+				return "", errors.New("unable to restore the params to retry " + service + "::" + method + ": " + replayErr.Error())
+			}
+			continue
+		}
+
+		if transientErr == nil {
+			if attempt > 0 {
+				mutexCounters.Lock()
+				counters.xmlmcRecovered++
+				mutexCounters.Unlock()
+			}
+			return response, err
+		}
+		//A write that may have reached the instance is only replayed once it is known not to have been applied
+		unknownOutcome := xmlmcWriteMethods[method] && !xmlmcFailedUnprocessed(err)
+		if unknownOutcome && writeApplied == nil {
+			logger(4, service+"::"+method+" failed and has not been retried, as the instance may have applied it: "+transientErr.Error(), false)
+			return response, err
+		}
+		if attempt >= configRetries {
+			if unknownOutcome {
+				if applied, _ := xmlmcWriteWasApplied(espXmlmc, service, method, writeApplied); applied {
+					return "", errXmlmcWriteApplied
+				}
+			}
+			if configRetries > 0 {
+				mutexCounters.Lock()
+				counters.xmlmcRetryFailed++
+				mutexCounters.Unlock()
+				logger(4, service+"::"+method+" failed after "+strconv.Itoa(configRetries)+" retries: "+transientErr.Error(), false)
+			}
+			return response, err
+		}
+		retryDelay := xmlmcRetryDelay(attempt)
+		attempt++
+		logger(5, service+"::"+method+" attempt "+strconv.Itoa(attempt)+" failed: "+transientErr.Error()+". Retrying in "+retryDelay.Round(time.Millisecond).String(), false)
+		time.Sleep(retryDelay)
+		if unknownOutcome {
+			applied, known := xmlmcWriteWasApplied(espXmlmc, service, method, writeApplied)
+			if applied {
+				return "", errXmlmcWriteApplied
+			}
+			if !known {
+				return response, err
+			}
+		}
+		mutexCounters.Lock()
+		counters.xmlmcRetries++
+		mutexCounters.Unlock()
+		if replayErr := replayXmlmcParams(espXmlmc, paramsXML); replayErr != nil {
+			return "", errors.New("unable to restore the params to retry " + service + "::" + method + ": " + replayErr.Error())
+		}
+	}
+}
+
+// xmlmcFailedUnprocessed - returns true if a failed call is known not to have been processed by the instance: the
+// connection could not be made, the instance turned the call away, or the instance returned an error response
+func xmlmcFailedUnprocessed(err error) bool {
+	if err == nil {
+		return true
+	}
+	var dnsErr *net.DNSError
+	if errors.As(err, &dnsErr) {
+		return true
+	}
+	var opErr *net.OpError
+	if errors.As(err, &opErr) && opErr.Op == "dial" {
+		return true
+	}
+	errText := err.Error()
+	if strings.HasPrefix(errText, "Invalid HTTP Response: ") {
+		for _, httpCode := range xmlmcUnprocessedHTTPCodes {
+			if strings.HasSuffix(errText, httpCode) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// xmlmcWriteWasApplied - clears the params of a failed write, and uses writeApplied to find out whether the instance
+// applied it. Returns false for known if this could not be found out
+func xmlmcWriteWasApplied(espXmlmc *apiLib.XmlmcInstStruct, service, method string, writeApplied func() (bool, error)) (applied bool, known bool) {
+	espXmlmc.ClearParam()
+	applied, err := writeApplied()
+	if err != nil {
+		logger(4, "Unable to find out whether the failed "+service+"::"+method+" call was applied by the instance, so it has not been retried: "+err.Error(), false)
+		return false, false
+	}
+	if applied {
+		logger(5, "The failed "+service+"::"+method+" call was applied by the instance, so has not been retried", false)
+		mutexCounters.Lock()
+		counters.xmlmcRecovered++
+		mutexCounters.Unlock()
+	}
+	return applied, true
+}
+
+// xmlmcCallFailed - returns the error of an XMLMC call that did not succeed, whether it failed to reach the instance,
+// returned an HTTP error, or was rejected by the instance. Returns nil for a call that succeeded
+func xmlmcCallFailed(response string, err error) error {
+	if err != nil {
+		return err
+	}
+	var xmlRespon xmlmcResponse
+	if unmarshalErr := xml.Unmarshal([]byte(response), &xmlRespon); unmarshalErr != nil {
+		return unmarshalErr
+	}
+	if xmlRespon.MethodResult != "ok" {
+		return errors.New(xmlRespon.State.ErrorRet)
+	}
+	return nil
+}
+
+// xmlmcTransientError - returns the error if the call failed in a way that is worth retrying, or nil if the call
+// succeeded or was rejected by the instance
+func xmlmcTransientError(response string, err error) error {
+	if err != nil {
+		var netErr net.Error
+		if errors.As(err, &netErr) {
+			return err
+		}
+		errText := err.Error()
+		if strings.HasPrefix(errText, "Invalid HTTP Response: ") {
+			for _, httpCode := range xmlmcTransientHTTPCodes {
+				if strings.HasSuffix(errText, httpCode) {
+					return err
+				}
+			}
+			return nil
+		}
+		//Anything else failed before a response was read from the instance, such as a dropped connection
+		return err
+	}
+	var xmlRespon xmlmcResponse
+	if xml.Unmarshal([]byte(response), &xmlRespon) != nil || xmlRespon.MethodResult == "ok" {
+		return nil
+	}
+	errorRet := strings.ToLower(xmlRespon.State.ErrorRet)
+	for _, transientText := range xmlmcTransientErrors {
+		if strings.Contains(errorRet, transientText) {
+			return errors.New(xmlRespon.State.ErrorRet)
+		}
+	}
+	return nil
+}
+
+// xmlmcRetryDelay - returns a random wait of up to the backoff for the attempt, which doubles each attempt.
+// The jitter spreads the retries from concurrent workers, so they don't all hit the instance together
+func xmlmcRetryDelay(attempt int) time.Duration {
+	backoff := time.Duration(configRetryBackoff) * time.Millisecond << uint(attempt)
+	if backoff > xmlmcRetryMaxDelay || backoff <= 0 {
+		backoff = xmlmcRetryMaxDelay
+	}
+	mutexRetryRandom.Lock()
+	defer mutexRetryRandom.Unlock()
+	return backoff/2 + time.Duration(retryRandom.Int63n(int64(backoff/2)+1))
+}
+
+// replayXmlmcParams - replaces any params left against the XMLMC instance with the params of a call being retried
+func replayXmlmcParams(espXmlmc *apiLib.XmlmcInstStruct, paramsXML string) error {
+	espXmlmc.ClearParam()
+	return restoreXmlmcParams(espXmlmc, paramsXML)
+}
+
+// restoreXmlmcParams - sets the params held in the XML string, as returned by GetParam, back against the XMLMC
+// instance, using the same SetParam, OpenElement & CloseElement calls that built them
+func restoreXmlmcParams(espXmlmc *apiLib.XmlmcInstStruct, paramsXML string) error {
+	decoder := xml.NewDecoder(strings.NewReader(paramsXML))
+	var pendingElement string
+	var pendingValue strings.Builder
+	hasPending := false
+	depth := 0
+	for {
+		token, err := decoder.Token()
+		if err != nil {
+			if err == io.EOF {
+				return nil
+			}
+			return err
+		}
+		switch element := token.(type) {
+		case xml.StartElement:
+			depth++
+			if depth == 1 {
+				continue
+			}
+			//An element that contains another element is a parent opened with OpenElement
+			if hasPending {
+				espXmlmc.OpenElement(pendingElement)
+			}
+			pendingElement = element.Name.Local
+			pendingValue.Reset()
+			hasPending = true
+		case xml.CharData:
+			if hasPending {
+				pendingValue.Write(element)
+			}
+		case xml.EndElement:
+			depth--
+			if depth == 0 {
+				continue
+			}
+			if hasPending && pendingElement == element.Name.Local {
+				espXmlmc.SetParam(pendingElement, pendingValue.String())
+				hasPending = false
+				continue
+			}
+			espXmlmc.CloseElement(element.Name.Local)
+		}
+	}
+}
@@ -0,0 +1,156 @@
+package main
+
+import (
+	"math"
+	"testing"
+	"time"
+)
+
+func TestFormatColumnValue(t *testing.T) {
+	tests := []struct {
+		name        string
+		value       interface{}
+		fieldFormat fieldFormatStruct
+		want        string
+	}{
+		{"nil", nil, fieldFormatStruct{}, ""},
+		{"string", "text", fieldFormatStruct{}, "text"},
+		{"bytes as text", []byte("text"), fieldFormatStruct{}, "text"},
+		{"bytes decimal kept as it is", []byte("12.50"), fieldFormatStruct{}, "12.50"},
+		{"bytes decimal with number format", []byte("12.56"), fieldFormatStruct{NumberFormat: "0.0"}, "12.6"},
+		{"bytes decimal to whole number", []byte(" 12.7 "), fieldFormatStruct{NumberFormat: "0"}, "13"},
+		{"bytes text with number format", []byte("N/A"), fieldFormatStruct{NumberFormat: "0.00"}, "N/A"},
+		{"bytes large decimal", []byte("12345678901234567890.12"), fieldFormatStruct{}, "12345678901234567890.12"},
+		{"int64", int64(42), fieldFormatStruct{}, "42"},
+		{"int64 with decimals", int64(42), fieldFormatStruct{NumberFormat: "0.00"}, "42.00"},
+		{"int32 negative", int32(-7), fieldFormatStruct{}, "-7"},
+		{"uint64 largest", uint64(math.MaxUint64), fieldFormatStruct{}, "18446744073709551615"},
+		{"float64 fewest digits", float64(1.5), fieldFormatStruct{}, "1.5"},
+		{"float64 whole", float64(3), fieldFormatStruct{}, "3"},
+		{"float64 no exponent", float64(1e21), fieldFormatStruct{}, "1000000000000000000000"},
+		{"float64 small no exponent", float64(0.000001), fieldFormatStruct{}, "0.000001"},
+		{"float64 with decimals", float64(3), fieldFormatStruct{NumberFormat: "0.00"}, "3.00"},
+		{"float64 rounded", float64(2.345), fieldFormatStruct{NumberFormat: "0.0"}, "2.3"},
+		{"float64 invalid number format", float64(2.5), fieldFormatStruct{NumberFormat: "#.##"}, "2.5"},
+		{"float64 NaN", math.NaN(), fieldFormatStruct{}, ""},
+		{"float64 infinity", math.Inf(1), fieldFormatStruct{}, ""},
+		{"float32", float32(0.25), fieldFormatStruct{}, "0.25"},
+		{"bool true", true, fieldFormatStruct{}, "1"},
+		{"bool false", false, fieldFormatStruct{}, "0"},
+		{"bool true value", true, fieldFormatStruct{TrueValue: "Yes", FalseValue: "No"}, "Yes"},
+		{"bool false value", false, fieldFormatStruct{TrueValue: "Yes", FalseValue: "No"}, "No"},
+		{"time", time.Date(2024, 3, 1, 9, 30, 15, 0, time.UTC), fieldFormatStruct{}, "2024-03-01 09:30:15"},
+		{"time converted to UTC", time.Date(2024, 3, 1, 9, 30, 0, 0, time.FixedZone("UTC+2", 2*60*60)), fieldFormatStruct{}, "2024-03-01 07:30:00"},
+		{"time in source time zone", time.Date(2024, 7, 1, 9, 30, 0, 0, time.UTC), fieldFormatStruct{SourceTimeZone: "Europe/London"}, "2024-07-01 08:30:00"},
+		{"time in source time zone in winter", time.Date(2024, 1, 1, 9, 30, 0, 0, time.UTC), fieldFormatStruct{SourceTimeZone: "Europe/London"}, "2024-01-01 09:30:00"},
+		{"time epoch", time.Date(2023, 11, 14, 22, 13, 20, 0, time.UTC), fieldFormatStruct{DateFormat: "epoch"}, "1700000000"},
+		{"time epochms", time.Date(2023, 11, 14, 22, 13, 20, 123000000, time.UTC), fieldFormatStruct{DateFormat: "epochms"}, "1700000000123"},
+		{"time layout", time.Date(2024, 3, 1, 9, 5, 0, 0, time.UTC), fieldFormatStruct{DateFormat: "DD/MM/YYYY HH:mm"}, "01/03/2024 09:05"},
+		{"time rfc3339 keeps time zone", time.Date(2024, 3, 1, 9, 30, 0, 0, time.UTC), fieldFormatStruct{DateFormat: "rfc3339", SourceTimeZone: "America/New_York"}, "2024-03-01T09:30:00-05:00"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if got := formatColumnValue(test.value, test.fieldFormat); got != test.want {
+				t.Errorf("formatColumnValue(%#v) = %q, want %q", test.value, got, test.want)
+			}
+		})
+	}
+}
+
+func TestParseSourceDate(t *testing.T) {
+	tests := []struct {
+		name        string
+		value       string
+		fieldFormat fieldFormatStruct
+		want        time.Time
+	}{
+		{"epoch by default", "1700000000", fieldFormatStruct{}, time.Date(2023, 11, 14, 22, 13, 20, 0, time.UTC)},
+		{"epoch seconds", "1700000000", fieldFormatStruct{SourceFormat: "epoch"}, time.Date(2023, 11, 14, 22, 13, 20, 0, time.UTC)},
+		{"epoch decimal seconds", "1700000000.5", fieldFormatStruct{SourceFormat: "epoch"}, time.Date(2023, 11, 14, 22, 13, 20, 500000000, time.UTC)},
+		{"epoch milliseconds", "1700000000123", fieldFormatStruct{SourceFormat: "epochms"}, time.Date(2023, 11, 14, 22, 13, 20, 123000000, time.UTC)},
+		{"epoch ignores time zone", "1700000000", fieldFormatStruct{SourceTimeZone: "Europe/London"}, time.Date(2023, 11, 14, 22, 13, 20, 0, time.UTC)},
+		{"epoch before 1970", "-86400", fieldFormatStruct{}, time.Date(1969, 12, 31, 0, 0, 0, 0, time.UTC)},
+		{"epoch decimal before 1970", "-1.5", fieldFormatStruct{}, time.Date(1969, 12, 31, 23, 59, 58, 500000000, time.UTC)},
+		{"epoch after 2262", "9300000000", fieldFormatStruct{}, time.Date(2264, 9, 14, 21, 20, 0, 0, time.UTC)},
+		{"epoch milliseconds before 1970", "-1500", fieldFormatStruct{SourceFormat: "epochms"}, time.Date(1969, 12, 31, 23, 59, 58, 500000000, time.UTC)},
+		{"epoch decimal milliseconds", "1700000000123.5", fieldFormatStruct{SourceFormat: "epochms"}, time.Date(2023, 11, 14, 22, 13, 20, 123500000, time.UTC)},
+		{"epoch last date", "253402300799", fieldFormatStruct{}, time.Date(9999, 12, 31, 23, 59, 59, 0, time.UTC)},
+		{"common layout", "2024-01-15 10:00:00", fieldFormatStruct{}, time.Date(2024, 1, 15, 10, 0, 0, 0, time.UTC)},
+		{"common layout with T", "2024-01-15T10:00:00", fieldFormatStruct{}, time.Date(2024, 1, 15, 10, 0, 0, 0, time.UTC)},
+		{"common layout without seconds", "2024-01-15 10:00", fieldFormatStruct{}, time.Date(2024, 1, 15, 10, 0, 0, 0, time.UTC)},
+		{"common layout date only", "2024-01-15", fieldFormatStruct{}, time.Date(2024, 1, 15, 0, 0, 0, 0, time.UTC)},
+		{"common layout in source time zone", "2024-01-15 10:00:00", fieldFormatStruct{SourceTimeZone: "America/New_York"}, time.Date(2024, 1, 15, 15, 0, 0, 0, time.UTC)},
+		{"source format", "15/01/2024 10:30", fieldFormatStruct{SourceFormat: "DD/MM/YYYY HH:mm"}, time.Date(2024, 1, 15, 10, 30, 0, 0, time.UTC)},
+		{"source format in summer time", "01/07/2024 09:30", fieldFormatStruct{SourceFormat: "DD/MM/YYYY HH:mm", SourceTimeZone: "Europe/London"}, time.Date(2024, 7, 1, 8, 30, 0, 0, time.UTC)},
+		{"source format in winter time", "01/01/2024 09:30", fieldFormatStruct{SourceFormat: "DD/MM/YYYY HH:mm", SourceTimeZone: "Europe/London"}, time.Date(2024, 1, 1, 9, 30, 0, 0, time.UTC)},
+		{"date column whatever the source format", "2024-01-15T10:00:00Z", fieldFormatStruct{SourceFormat: "DD/MM/YYYY"}, time.Date(2024, 1, 15, 10, 0, 0, 0, time.UTC)},
+		{"date column with offset", "2024-01-15T10:00:00+02:00", fieldFormatStruct{}, time.Date(2024, 1, 15, 8, 0, 0, 0, time.UTC)},
+		{"date column in source time zone", "2024-07-01T09:30:00Z", fieldFormatStruct{SourceTimeZone: "Europe/London"}, time.Date(2024, 7, 1, 8, 30, 0, 0, time.UTC)},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			got, err := parseSourceDate(test.value, test.fieldFormat)
+			if err != nil {
+				t.Fatalf("parseSourceDate(%q) returned error: %v", test.value, err)
+			}
+			if !got.Equal(test.want) {
+				t.Errorf("parseSourceDate(%q) = %s, want %s", test.value, got.UTC(), test.want)
+			}
+		})
+	}
+}
+
+func TestParseSourceDateErrors(t *testing.T) {
+	tests := []struct {
+		name        string
+		value       string
+		fieldFormat fieldFormatStruct
+	}{
+		{"epoch not a number", "yesterday", fieldFormatStruct{SourceFormat: "epoch"}},
+		{"epochms not a number", "2024-01-15", fieldFormatStruct{SourceFormat: "epochms"}},
+		{"epoch not a finite number", "NaN", fieldFormatStruct{SourceFormat: "epoch"}},
+		{"epoch after year 9999", "253402300800", fieldFormatStruct{SourceFormat: "epoch"}},
+		{"epoch before year 1", "-62135596801", fieldFormatStruct{SourceFormat: "epoch"}},
+		{"epoch too large for a duration", "9300000000000", fieldFormatStruct{SourceFormat: "epoch"}},
+		{"epoch largest whole number", "9223372036854775807", fieldFormatStruct{SourceFormat: "epoch"}},
+		{"epoch decimal out of range", "1e30", fieldFormatStruct{SourceFormat: "epoch"}},
+		{"epochms after year 9999", "253402300800000", fieldFormatStruct{SourceFormat: "epochms"}},
+		{"no common layout", "15 January 2024", fieldFormatStruct{}},
+		{"wrong source format", "2024-01-15", fieldFormatStruct{SourceFormat: "DD/MM/YYYY"}},
+		{"invalid date", "31/02/2024", fieldFormatStruct{SourceFormat: "DD/MM/YYYY"}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if got, err := parseSourceDate(test.value, test.fieldFormat); err == nil {
+				t.Errorf("parseSourceDate(%q) = %s, want an error", test.value, got)
+			}
+		})
+	}
+}
+
+func TestConvertDateValue(t *testing.T) {
+	tests := []struct {
+		name        string
+		value       string
+		fieldFormat fieldFormatStruct
+		want        string
+	}{
+		{"empty", "", fieldFormatStruct{}, ""},
+		{"whitespace", "  ", fieldFormatStruct{}, ""},
+		{"zero", "0", fieldFormatStruct{}, ""},
+		{"zero epochms", "0", fieldFormatStruct{SourceFormat: "epochms"}, ""},
+		{"zero with whitespace", " 0 ", fieldFormatStruct{}, ""},
+		{"epoch", "1700000000", fieldFormatStruct{}, "2023-11-14 22:13:20"},
+		{"epoch with whitespace", " 1700000000 ", fieldFormatStruct{}, "2023-11-14 22:13:20"},
+		{"epoch to epochms", "1700000000", fieldFormatStruct{DateFormat: "epochms"}, "1700000000000"},
+		{"layout to layout", "15/01/2024 10:30", fieldFormatStruct{SourceFormat: "DD/MM/YYYY HH:mm", DateFormat: "YYYY-MM-DD"}, "2024-01-15"},
+		{"source time zone to UTC", "2024-07-01 09:30:00", fieldFormatStruct{SourceTimeZone: "Europe/London"}, "2024-07-01 08:30:00"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if got := convertDateValue(test.value, test.fieldFormat); got != test.want {
+				t.Errorf("convertDateValue(%q) = %q, want %q", test.value, got, test.want)
+			}
+		})
+	}
+}
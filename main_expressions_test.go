@@ -0,0 +1,145 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestParseFieldTemplateErrors(t *testing.T) {
+	tests := []struct {
+		name    string
+		mapping string
+		pos     int
+		message string
+	}{
+		{"unknown function", "{{ summary }}", 3, "unknown function summary - columns must be written as [summary]"},
+		{"unknown function after text", "Ref [callref] {{ upper(nope([x])) }}", 23, "unknown function nope"},
+		{"unclosed single quote string", "{{ default([a], 'none) }}", 16, "string is not closed with '"},
+		{"unclosed double quote string", `{{ upper("text }}`, 9, `string is not closed with "`},
+		{"unclosed expression", "{{ upper([a])", 13, "expected }} to end the expression started at character 1"},
+		{"unclosed expression after text", "Title: {{ [a]", 13, "expected }} to end the expression started at character 8"},
+		{"empty expression", "{{ }}", 3, "unexpected '}'"},
+		{"unclosed function", "{{ upper([a]", 12, "upper( is not closed with )"},
+		{"unclosed column", "{{ upper([a }}", 9, "[ is not closed with ]"},
+		{"empty column", "{{ [] }}", 3, "column name is empty"},
+		{"missing bracket", "{{ upper [a] }}", 9, "expected ( after upper"},
+		{"missing comma", "{{ join(' ' [a]) }}", 12, "expected , or ) in the arguments of join"},
+		{"too few arguments", "{{ default([a]) }}", 3, "default takes 2 or more arguments, not 1"},
+		{"too many arguments", "{{ substr([a], 1, 2, 3) }}", 3, "substr takes 2 to 3 arguments, not 4"},
+		{"lone minus", "{{ substr([a], -) }}", 15, "- must be followed by a number"},
+		{"invalid pattern", "{{ matches([a], '(') }}", 3, "invalid pattern in matches"},
+		{"lookup table not a string", "{{ lookup([table], [a]) }}", 3, "the table name in lookup must be a string"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			fieldTemplate := parseFieldTemplate(test.mapping)
+			if fieldTemplate.err == nil {
+				t.Fatalf("parseFieldTemplate(%q) returned no error", test.mapping)
+			}
+			exprErr, ok := fieldTemplate.err.(*fieldExprError)
+			if !ok {
+				t.Fatalf("parseFieldTemplate(%q) returned %T, not *fieldExprError", test.mapping, fieldTemplate.err)
+			}
+			if exprErr.Pos != test.pos {
+				t.Errorf("parseFieldTemplate(%q) error at %d, want %d: %s", test.mapping, exprErr.Pos, test.pos, exprErr.Message)
+			}
+			if !strings.HasPrefix(exprErr.Message, test.message) {
+				t.Errorf("parseFieldTemplate(%q) error %q, want it to start %q", test.mapping, exprErr.Message, test.message)
+			}
+		})
+	}
+}
+
+func TestParseFieldTemplateReferences(t *testing.T) {
+	fieldTemplate := parseFieldTemplate("[callref] - {{ lookup('Sites', [site]) }} {{ default([a], [b]) }}")
+	if fieldTemplate.err != nil {
+		t.Fatalf("unexpected error: %v", fieldTemplate.err)
+	}
+	if got, want := strings.Join(fieldTemplate.columns, ","), "callref,site,a,b"; got != want {
+		t.Errorf("columns = %q, want %q", got, want)
+	}
+	if got, want := strings.Join(fieldTemplate.lookups, ","), "Sites"; got != want {
+		t.Errorf("lookups = %q, want %q", got, want)
+	}
+}
+
+func TestEvalFieldTemplate(t *testing.T) {
+	callMap := map[string]interface{}{
+		"callref": int64(1234),
+		"title":   "  Printer jammed  ",
+		"site":    []byte("Head Office"),
+		"blank":   "   ",
+		"group":   "service desk",
+		"empty":   "",
+		"unicode": "héllo wörld",
+	}
+	tests := []struct {
+		name    string
+		mapping string
+		want    string
+	}{
+		{"text only", "Call [callref]", "Call 1234"},
+		{"text and expression", "Call [callref]: {{ trim([title]) }}", "Call 1234: Printer jammed"},
+		{"missing column", "{{ [nocolumn] }}", ""},
+		{"join drops empty parts", "{{ join(' - ', [site], [blank], [empty], [nocolumn], upper([group])) }}", "Head Office - SERVICE DESK"},
+		{"join all parts empty", "{{ join(', ', [blank], [empty]) }}", ""},
+		{"join single part", "{{ join(', ', [site]) }}", "Head Office"},
+		{"concat keeps empty parts", "{{ concat('[', [blank], ']') }}", "[   ]"},
+		{"substr from start", "{{ substr([site], 1, 4) }}", "Head"},
+		{"substr to end", "{{ substr([site], 6) }}", "Office"},
+		{"substr length past end", "{{ substr([site], 6, 100) }}", "Office"},
+		{"substr start past end", "{{ substr([site], 50) }}", ""},
+		{"substr start at last character", "{{ substr([site], 11) }}", "e"},
+		{"substr zero length", "{{ substr([site], 1, 0) }}", ""},
+		{"substr counts characters not bytes", "{{ substr([unicode], 2, 4) }}", "éllo"},
+		{"if true", "{{ if([site], 'yes', 'no') }}", "yes"},
+		{"if whitespace is false", "{{ if([blank], 'yes', 'no') }}", "no"},
+		{"if missing column is false", "{{ if([nocolumn], 'yes', 'no') }}", "no"},
+		{"if false without else", "{{ if([empty], 'yes') }}", ""},
+		{"if with condition function", "{{ if(eq([group], 'service desk'), 'SD', 'Other') }}", "SD"},
+		{"default first non empty", "{{ default([blank], [empty], [site], 'none') }}", "Head Office"},
+		{"default falls back to literal", "{{ default([nocolumn], [blank], 'No Summary') }}", "No Summary"},
+		{"default all empty", "{{ default([blank], [empty]) }}", ""},
+		{"default keeps value as it is", "{{ default([title], 'x') }}", "  Printer jammed  "},
+		{"nested functions", "{{ upper(default(trim([blank]), [group])) }}", "SERVICE DESK"},
+		{"doubled quote", "{{ 'it''s' }}", "it's"},
+		{"number literal", "{{ concat(-1, 23) }}", "-123"},
+		{"function names ignore case", "{{ UPPER([group]) }}", "SERVICE DESK"},
+		{"replace", `{{ replace([group], '\s+', '_') }}`, "service_desk"},
+		{"matches", "{{ if(matches([site], '^Head'), 'HQ') }}", "HQ"},
+		{"and", "{{ and([site], [blank]) }}", ""},
+		{"or", "{{ or([blank], [site]) }}", "true"},
+		{"not", "{{ not([blank]) }}", "true"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if got := evalFieldTemplate(test.mapping, callMap, fieldFormatStruct{}); got != test.want {
+				t.Errorf("evalFieldTemplate(%q) = %q, want %q", test.mapping, got, test.want)
+			}
+		})
+	}
+}
+
+func TestEvalSubstrErrors(t *testing.T) {
+	tests := []struct {
+		name string
+		args []string
+	}{
+		{"start of zero", []string{"value", "0"}},
+		{"negative start", []string{"value", "-1"}},
+		{"start not a number", []string{"value", "one"}},
+		{"negative length", []string{"value", "1", "-2"}},
+		{"length not a number", []string{"value", "1", "two"}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			got, err := evalSubstr(test.args, nil)
+			if err == nil {
+				t.Errorf("evalSubstr(%q) = %q, want an error", test.args, got)
+			}
+			if got != "" {
+				t.Errorf("evalSubstr(%q) = %q with an error, want empty", test.args, got)
+			}
+		})
+	}
+}